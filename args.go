@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/secrets"
 	"gitlab.com/yakshaving.art/hurrdurr/version"
 )
 
@@ -32,9 +33,28 @@ type Args struct {
 
 	AutoDevOpsMode bool
 	YoloMode       bool
+	PruneVariables bool
 
 	SnoopDepth int
 
+	MaxRemovals         int
+	MaxRemovalPercent   int
+	OverrideBlastRadius bool
+
+	PlanFormat string
+	PlanFile   string
+	ApplyPlan  string
+
+	BackupRecipient string
+	BackupDir       string
+	NoBackup        bool
+
+	VariablesReport bool
+	ReportSalt      string
+
+	AllowExecSecrets bool
+	AgeIdentityFile  string
+
 	Concurrency int
 }
 
@@ -59,38 +79,70 @@ func parseArgs() Args {
 		"where you have no admin rights but still do what you gotta do")
 	flag.BoolVar(&args.YoloMode, "yolo-force-secrets-overwrite", false,
 		"life is too short to not overwrite group and project environment variables")
+	flag.BoolVar(&args.PruneVariables, "prune-variables", false,
+		"deletes every variable that is not declared in the configuration from every managed group and project, "+
+			"set prune_variables in a group or project to prune only that one")
 	flag.IntVar(&args.SnoopDepth, "snoopdepth", 0, "max depth to report unhandled groups. 0 means all")
+	flag.IntVar(&args.MaxRemovals, "max-removals", 0,
+		"max number of memberships that can be removed in a single run. 0 means no limit")
+	flag.IntVar(&args.MaxRemovalPercent, "max-removal-percent", 0,
+		"max percentage of the members of a group or project that can be removed in a single run. 0 means no limit")
+	flag.BoolVar(&args.OverrideBlastRadius, "override-blast-radius", false,
+		"applies the changes even when they exceed the blast radius limits, or leave a group without owners")
+	flag.StringVar(&args.PlanFormat, "plan-format", "text", "format used to print the dryrun plan: text, json or yaml")
+	flag.StringVar(&args.PlanFile, "plan-file", "", "saves the dryrun plan to this file so it can be applied later")
+	flag.StringVar(&args.ApplyPlan, "apply-plan", "", "executes exactly the changes in this plan file instead of diffing")
+
+	flag.StringVar(&args.BackupRecipient, "backup-recipient", "",
+		"age public key used to encrypt the backup of the variables before overwriting or deleting them")
+	flag.StringVar(&args.BackupDir, "backup-dir", ".", "directory where the variables backups are written")
+	flag.BoolVar(&args.NoBackup, "no-backup", false,
+		"overwrites or deletes variables without a backup when there is no -backup-recipient")
+
+	flag.BoolVar(&args.VariablesReport, "variables-report", false,
+		"reports the status of every managed variable, without printing their values, and exits")
+	flag.BoolVar(&args.AllowExecSecrets, "allow-exec-secrets", false,
+		"runs the commands of exec: secret sources, they come from the configuration and run even in dryrun mode")
 
 	flag.IntVar(&args.Concurrency, "concurrency", 50, "how many concurrent jobs we allow when pre-loading from Gitlab")
 
 	flag.Parse()
 
-	args.GitlabToken = os.Getenv("GITLAB_TOKEN")
-	args.GitlabBaseURL = os.Getenv("GITLAB_BASEURL")
 	args.BotUsernameRegex = os.Getenv("BOT_USERNAME_REGEX")
+	args.ReportSalt = os.Getenv("HURRDURR_REPORT_SALT")
+	args.AgeIdentityFile = os.Getenv(secrets.AgeIdentityFileVariable)
 
 	if args.ShowVersion {
 		logrus.Printf(version.GetVersion())
 		os.Exit(0)
 	}
 
-	if args.GitlabToken == "" {
-		logrus.Fatal("GITLAB_TOKEN is a required environment variable")
+	args.GitlabToken, args.GitlabBaseURL = parseGitlabEnvironment()
+
+	if !(args.ManageACLs || args.ManageUsers || args.VariablesReport) {
+		logrus.Fatal("Nothing to manage, set one of -manage-acls or -manage-users")
 	}
 
-	if args.GitlabBaseURL == "" {
-		logrus.Fatal("GITLAB_BASEURL is a required environment variable")
+	switch args.PlanFormat {
+	case "text":
+	case "json", "yaml":
+		if !args.DryRun {
+			logrus.Fatalf("-plan-format %s can only be used with -dryrun", args.PlanFormat)
+		}
+	default:
+		logrus.Fatalf("invalid plan format '%s', use one of text, json or yaml", args.PlanFormat)
 	}
 
-	if !strings.HasPrefix(args.GitlabBaseURL, "https://") {
-		logrus.Fatal("Validate error: base_url should use https:// scheme")
+	if args.PlanFile != "" && !args.DryRun {
+		logrus.Fatalf("-plan-file can only be used with -dryrun")
 	}
-	if !strings.HasSuffix(args.GitlabBaseURL, "/api/v4/") {
-		logrus.Fatal("Validate error: base_url should end with '/api/v4/'")
+
+	if args.PlanFile != "" && args.ApplyPlan != "" {
+		logrus.Fatalf("-plan-file and -apply-plan can't be used at the same time")
 	}
 
-	if !(args.ManageACLs || args.ManageUsers) {
-		logrus.Fatal("Nothing to manage, set one of -manage-acls or -manage-users")
+	if args.NoBackup && args.BackupRecipient != "" {
+		logrus.Fatalf("-no-backup and -backup-recipient can't be used at the same time")
 	}
 
 	if args.ManageBots && args.BotUsernameRegex == "" {
@@ -99,3 +151,27 @@ func parseArgs() Args {
 
 	return args
 }
+
+// parseGitlabEnvironment loads and validates the gitlab token and base url
+// from the environment
+func parseGitlabEnvironment() (string, string) {
+	token := os.Getenv("GITLAB_TOKEN")
+	baseURL := os.Getenv("GITLAB_BASEURL")
+
+	if token == "" {
+		logrus.Fatal("GITLAB_TOKEN is a required environment variable")
+	}
+
+	if baseURL == "" {
+		logrus.Fatal("GITLAB_BASEURL is a required environment variable")
+	}
+
+	if !strings.HasPrefix(baseURL, "https://") {
+		logrus.Fatal("Validate error: base_url should use https:// scheme")
+	}
+	if !strings.HasSuffix(baseURL, "/api/v4/") {
+		logrus.Fatal("Validate error: base_url should end with '/api/v4/'")
+	}
+
+	return token, baseURL
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/api"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ExplainArgs is used to load the flags and arguments of the explain command
+type ExplainArgs struct {
+	Username string
+	Path     string
+
+	ConfigFile    string
+	ChecksumCheck bool
+
+	GitlabToken   string
+	GitlabBaseURL string
+	GhostUser     string
+
+	AutoDevOpsMode bool
+	Concurrency    int
+	Debug          bool
+}
+
+func parseExplainArgs(arguments []string) ExplainArgs {
+	args := ExplainArgs{}
+
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	flags.Usage = func() {
+		logrus.Printf("usage: hurrdurr explain [flags] username [group or project]")
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&args.ConfigFile, "config", "config.yaml", "configuration file to load")
+	flags.BoolVar(&args.ChecksumCheck, "checksum-check", false, "validates the configuration checksum "+
+		"reading it from a file called as the configuratio file ended in .md5")
+	flags.StringVar(&args.GhostUser, "ghost-user", "ghost", "system wide gitlab ghost user.")
+	flags.BoolVar(&args.AutoDevOpsMode, "autodevopsmode", false,
+		"where you have no admin rights but still do what you gotta do")
+	flags.IntVar(&args.Concurrency, "concurrency", 50, "how many concurrent jobs we allow when pre-loading from Gitlab")
+	flags.BoolVar(&args.Debug, "debug", false, "executes with logging in debug mode")
+
+	flags.Parse(arguments)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		logrus.Fatal("explain needs a username and optionally a group or project")
+	}
+	args.Username = flags.Arg(0)
+	args.Path = flags.Arg(1)
+
+	args.GitlabToken, args.GitlabBaseURL = parseGitlabEnvironment()
+
+	return args
+}
+
+// explainMemberships prints why a user has a level in every group and
+// project it ends up in
+func explainMemberships(arguments []string) {
+	args := parseExplainArgs(arguments)
+
+	SetupLogger(args.Debug, false)
+
+	conf, err := util.LoadConfig(args.ConfigFile, args.ChecksumCheck)
+	if err != nil {
+		logrus.Fatalf("failed to load configuration: %s", err)
+	}
+
+	client := api.NewGitlabAPIClient(
+		api.GitlabAPIClientArgs{
+			GitlabToken:     args.GitlabToken,
+			GitlabBaseURL:   args.GitlabBaseURL,
+			GitlabGhostUser: args.GhostUser,
+			Concurrency:     args.Concurrency,
+		})
+
+	createQuerier(&client, args.AutoDevOpsMode)
+
+	memberships, err := state.Explain(conf, client.Querier, args.Username, args.Path)
+	if err != nil {
+		logrus.Fatalf("%s", err)
+	}
+
+	if len(memberships) == 0 {
+		logrus.Infof("user '%s' is not a member of any managed group or project", args.Username)
+		return
+	}
+	for _, m := range memberships {
+		fmt.Fprintln(os.Stdout, m)
+	}
+}
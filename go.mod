@@ -1,11 +1,14 @@
 module gitlab.com/yakshaving.art/hurrdurr
 
 require (
+	filippo.io/age v1.0.0
+	github.com/hashicorp/go-retryablehttp v0.6.8
 	github.com/sirupsen/logrus v1.8.0
 	github.com/stretchr/testify v1.6.0
 	github.com/xanzy/go-gitlab v0.50.1
 	golang.org/x/oauth2 v0.0.0-20181203162652-d668ce993890 // indirect
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 go 1.16
@@ -38,7 +38,7 @@ func LoadPartialGitlabState(cnf internal.Config, client GitlabAPIClient) (intern
 			sharedWithGroups[sg.GroupName] = internal.Level(sg.GroupAccessLevel)
 		}
 
-		members, err := client.fetchGroupMembers(g.FullPath)
+		members, expires, err := client.fetchGroupMembers(g.FullPath)
 		if err != nil {
 			errs.Append(fmt.Errorf("failed to fetch members for group '%s'", err))
 			continue
@@ -58,11 +58,16 @@ func LoadPartialGitlabState(cnf internal.Config, client GitlabAPIClient) (intern
 			fullpath:   g.FullPath,
 			sharedWith: sharedWithGroups,
 			members:    members,
+			expires:    expires,
 			variables:  vars,
 		}
 	}
 
 	for p := range cnf.Projects {
+		if util.IsPathPattern(p) {
+			logrus.Debugf("skipping project pattern '%s', patterns can't be expanded in autodevops mode", p)
+			continue
+		}
 		project, err := client.fetchProject(p)
 		if err != nil {
 			errs.Append(fmt.Errorf("failed to fetch project: %s", p))
@@ -73,7 +78,7 @@ func LoadPartialGitlabState(cnf internal.Config, client GitlabAPIClient) (intern
 			continue
 		}
 
-		members, err := client.fetchProjectMembers(p)
+		members, expires, err := client.fetchProjectMembers(p)
 		if err != nil {
 			errs.Append(fmt.Errorf("failed to fetch project members for '%s': %s", project.PathWithNamespace, err))
 			continue
@@ -99,6 +104,7 @@ func LoadPartialGitlabState(cnf internal.Config, client GitlabAPIClient) (intern
 			fullpath:   p,
 			sharedWith: groups,
 			members:    members,
+			expires:    expires,
 			variables:  vars,
 		}
 	}
@@ -135,8 +141,7 @@ func CreateLazyQuerier(client *GitlabAPIClient) error {
 	return errs.ErrorOrNil()
 }
 
-// GetUserID implements the internal Querier interface
-func (g GitlabLazyQuerier) GetUserID(username string) int {
+func (g GitlabLazyQuerier) getUser(username string) GitlabUser {
 	u, ok := g.users[username]
 	if !ok {
 		user := g.api.fetchUser(username)
@@ -145,16 +150,16 @@ func (g GitlabLazyQuerier) GetUserID(username string) int {
 				ID: -1,
 			}
 		} else {
-			u = GitlabUser{
-				ID:             user.ID,
-				PrincipalEmail: user.Email,
-				Role:           UserUserRole,
-			}
+			u = newGitlabUser(*user, UserUserRole)
 		}
 		g.users[username] = u
 	}
+	return u
+}
 
-	return u.ID
+// GetUserID implements the internal Querier interface
+func (g GitlabLazyQuerier) GetUserID(username string) int {
+	return g.getUser(username).ID
 }
 
 // GetGroupID implements the internal Querier interface
@@ -250,3 +255,12 @@ func (g GitlabLazyQuerier) CurrentUser() string {
 func (g GitlabLazyQuerier) GetUserEmail(username string) (string, bool) {
 	return "", false
 }
+
+// GetUserAttributes fetches the user and returns its attributes
+func (g GitlabLazyQuerier) GetUserAttributes(username string) (internal.UserAttributes, bool) {
+	u := g.getUser(username)
+	if u.ID == -1 {
+		return internal.UserAttributes{}, false
+	}
+	return u.attributes(), true
+}
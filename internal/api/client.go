@@ -3,10 +3,12 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/go-retryablehttp"
 	"github.com/sirupsen/logrus"
 	gitlab "github.com/xanzy/go-gitlab"
 	"gitlab.com/yakshaving.art/hurrdurr/internal"
@@ -101,7 +103,7 @@ func (m GitlabAPIClient) RemoveGroupSharing(group, shared_group string) error {
 }
 
 // AddGroupMembership implements the APIClient interface
-func (m GitlabAPIClient) AddGroupMembership(username, group string, level internal.Level) error {
+func (m GitlabAPIClient) AddGroupMembership(username, group string, level internal.Level, expiresAt string) error {
 	userID := m.Querier.GetUserID(username)
 	acl := gitlab.AccessLevelValue(level)
 
@@ -109,29 +111,34 @@ func (m GitlabAPIClient) AddGroupMembership(username, group string, level intern
 		UserID:      &userID,
 		AccessLevel: &acl,
 	}
+	if expiresAt != "" {
+		opt.ExpiresAt = &expiresAt
+	}
 
-	_, _, err := m.client.GroupMembers.AddGroupMember(group, opt)
+	_, err := m.groupMembersRequest(http.MethodPost, group, "", opt, &GroupMember{})
 	if err != nil {
 		return fmt.Errorf("failed to add user '%s' to group '%s': %s", username, group, err)
 	}
-	logrus.Printf("[apply] '%s' to '%s' at level '%s'\n", username, group, level)
+	logrus.Printf("[apply] '%s' to '%s' at level '%s'%s\n", username, group, level, expiring(expiresAt))
 	return nil
 }
 
 // ChangeGroupMembership implements the APIClient interface
-func (m GitlabAPIClient) ChangeGroupMembership(username, group string, level internal.Level) error {
+func (m GitlabAPIClient) ChangeGroupMembership(username, group string, level internal.Level, expiresAt string) error {
 	userID := m.Querier.GetUserID(username)
 	acl := gitlab.AccessLevelValue(level)
 
+	// An empty expiration date removes the current one
 	opt := &gitlab.EditGroupMemberOptions{
 		AccessLevel: &acl,
+		ExpiresAt:   &expiresAt,
 	}
-	_, _, err := m.client.GroupMembers.EditGroupMember(group, userID, opt)
+	_, err := m.groupMembersRequest(http.MethodPut, group, fmt.Sprintf("/%d", userID), opt, &GroupMember{})
 	if err != nil {
 		return fmt.Errorf("failed to change user '%s' in group '%s': %s", username, group, err)
 	}
 
-	logrus.Printf("[apply] changed '%s' in '%s' at level '%s'\n", username, group, level)
+	logrus.Printf("[apply] changed '%s' in '%s' at level '%s'%s\n", username, group, level, expiring(expiresAt))
 	return nil
 }
 
@@ -177,7 +184,7 @@ func (m GitlabAPIClient) RemoveProjectSharing(project, group string) error {
 }
 
 // AddProjectMembership implements the APIClient interface
-func (m GitlabAPIClient) AddProjectMembership(username, project string, level internal.Level) error {
+func (m GitlabAPIClient) AddProjectMembership(username, project string, level internal.Level, expiresAt string) error {
 	userID := m.Querier.GetUserID(username)
 	acl := gitlab.AccessLevelValue(level)
 
@@ -185,29 +192,34 @@ func (m GitlabAPIClient) AddProjectMembership(username, project string, level in
 		UserID:      &userID,
 		AccessLevel: &acl,
 	}
+	if expiresAt != "" {
+		opt.ExpiresAt = &expiresAt
+	}
 
 	_, _, err := m.client.ProjectMembers.AddProjectMember(project, opt)
 	if err != nil {
 		return fmt.Errorf("failed to add user '%s' to project '%s': %s", username, project, err)
 	}
-	logrus.Printf("[apply] added '%s' to '%s' at level '%s'\n", username, project, level)
+	logrus.Printf("[apply] added '%s' to '%s' at level '%s'%s\n", username, project, level, expiring(expiresAt))
 	return nil
 }
 
 // ChangeProjectMembership implements the APIClient interface
-func (m GitlabAPIClient) ChangeProjectMembership(username, project string, level internal.Level) error {
+func (m GitlabAPIClient) ChangeProjectMembership(username, project string, level internal.Level, expiresAt string) error {
 	userID := m.Querier.GetUserID(username)
 	acl := gitlab.AccessLevelValue(level)
 
+	// An empty expiration date removes the current one
 	opt := &gitlab.EditProjectMemberOptions{
 		AccessLevel: &acl,
+		ExpiresAt:   &expiresAt,
 	}
 	_, _, err := m.client.ProjectMembers.EditProjectMember(project, userID, opt)
 	if err != nil {
 		return fmt.Errorf("failed to change user '%s' in project '%s': %s", username, project, err)
 	}
 
-	logrus.Printf("[apply] user '%s' changed in '%s' to level '%s'\n", username, project, level)
+	logrus.Printf("[apply] user '%s' changed in '%s' to level '%s'%s\n", username, project, level, expiring(expiresAt))
 	return nil
 }
 
@@ -284,59 +296,106 @@ func (m GitlabAPIClient) UnsetAdminUser(username string) error {
 }
 
 // CreateGroupVariable implements APIClient interface
-func (m GitlabAPIClient) CreateGroupVariable(group, key, value string) error {
+func (m GitlabAPIClient) CreateGroupVariable(group string, v internal.Variable) error {
 	_, _, err := m.client.GroupVariables.CreateVariable(group,
 		&gitlab.CreateGroupVariableOptions{
-			Key:   &key,
-			Value: &value,
+			Key:              &v.Key,
+			Value:            &v.Value,
+			VariableType:     variableType(v),
+			Protected:        v.Protected,
+			Masked:           v.Masked,
+			EnvironmentScope: &v.EnvironmentScope,
 		})
 	if err != nil {
-		return fmt.Errorf("failed to create group variable '%s' in group '%s'", key, group)
+		return fmt.Errorf("failed to create group variable '%s' in group '%s': %s", v.ID(), group, err)
 	}
-	logrus.Printf("[apply] variable '%s' in group '%s' was created\n", key, group)
+	logrus.Printf("[apply] variable '%s' in group '%s' was created\n", v.ID(), group)
 	return nil
 }
 
 // UpdateGroupVariable implements APIClient interface
-func (m GitlabAPIClient) UpdateGroupVariable(group, key, value string) error {
-	_, _, err := m.client.GroupVariables.UpdateVariable(group, key,
+func (m GitlabAPIClient) UpdateGroupVariable(group string, v internal.Variable) error {
+	_, _, err := m.client.GroupVariables.UpdateVariable(group, v.Key,
 		&gitlab.UpdateGroupVariableOptions{
-			Value: &value,
-		})
+			Value:            &v.Value,
+			VariableType:     variableType(v),
+			Protected:        v.Protected,
+			Masked:           v.Masked,
+			EnvironmentScope: &v.EnvironmentScope,
+		}, withEnvironmentScope(v.EnvironmentScope))
 	if err != nil {
-		return fmt.Errorf("failed to update group variable '%s' in group '%s'", key, group)
+		return fmt.Errorf("failed to update group variable '%s' in group '%s': %s", v.ID(), group, err)
 	}
-	logrus.Printf("[apply] variable '%s' in group '%s' was updated\n", key, group)
+	logrus.Printf("[apply] variable '%s' in group '%s' was updated\n", v.ID(), group)
 	return nil
 }
 
 // CreateProjectVariable implements APIClient interface
-func (m GitlabAPIClient) CreateProjectVariable(fullpath, key, value string) error {
+func (m GitlabAPIClient) CreateProjectVariable(fullpath string, v internal.Variable) error {
 	_, _, err := m.client.ProjectVariables.CreateVariable(fullpath,
 		&gitlab.CreateProjectVariableOptions{
-			Key:   &key,
-			Value: &value,
+			Key:              &v.Key,
+			Value:            &v.Value,
+			VariableType:     variableType(v),
+			Protected:        v.Protected,
+			Masked:           v.Masked,
+			EnvironmentScope: &v.EnvironmentScope,
 		})
 	if err != nil {
-		return fmt.Errorf("failed to create project variable '%s' in group '%s'", key, fullpath)
+		return fmt.Errorf("failed to create project variable '%s' in project '%s': %s", v.ID(), fullpath, err)
 	}
-	logrus.Printf("[apply] variable '%s' in project '%s' was created\n", key, fullpath)
+	logrus.Printf("[apply] variable '%s' in project '%s' was created\n", v.ID(), fullpath)
 	return nil
 }
 
 // UpdateProjectVariable implements APIClient interface
-func (m GitlabAPIClient) UpdateProjectVariable(fullpath, key, value string) error {
-	_, _, err := m.client.ProjectVariables.UpdateVariable(fullpath, key,
+func (m GitlabAPIClient) UpdateProjectVariable(fullpath string, v internal.Variable) error {
+	_, _, err := m.client.ProjectVariables.UpdateVariable(fullpath, v.Key,
 		&gitlab.UpdateProjectVariableOptions{
-			Value: &value,
-		})
+			Value:            &v.Value,
+			VariableType:     variableType(v),
+			Protected:        v.Protected,
+			Masked:           v.Masked,
+			EnvironmentScope: &v.EnvironmentScope,
+		}, withEnvironmentScope(v.EnvironmentScope))
+	if err != nil {
+		return fmt.Errorf("failed to update project variable '%s' in project '%s': %s", v.ID(), fullpath, err)
+	}
+	logrus.Printf("[apply] variable '%s' in project '%s' was updated\n", v.ID(), fullpath)
+	return nil
+}
+
+// DeleteGroupVariable implements APIClient interface
+func (m GitlabAPIClient) DeleteGroupVariable(group string, v internal.Variable) error {
+	_, err := m.client.GroupVariables.RemoveVariable(group, v.Key, withEnvironmentScope(v.EnvironmentScope))
+	if err != nil {
+		return fmt.Errorf("failed to delete group variable '%s' in group '%s': %s", v.ID(), group, err)
+	}
+	logrus.Printf("[apply] variable '%s' in group '%s' was deleted\n", v.ID(), group)
+	return nil
+}
+
+// DeleteProjectVariable implements APIClient interface
+func (m GitlabAPIClient) DeleteProjectVariable(fullpath string, v internal.Variable) error {
+	_, err := m.client.ProjectVariables.RemoveVariable(fullpath, v.Key, withEnvironmentScope(v.EnvironmentScope))
 	if err != nil {
-		return fmt.Errorf("failed to update project variable '%s' in group '%s'", key, fullpath)
+		return fmt.Errorf("failed to delete project variable '%s' in project '%s': %s", v.ID(), fullpath, err)
 	}
-	logrus.Printf("[apply] variable '%s' in project '%s' was updated\n", key, fullpath)
+	logrus.Printf("[apply] variable '%s' in project '%s' was deleted\n", v.ID(), fullpath)
 	return nil
 }
 
+// withEnvironmentScope picks the variable with the given environment scope,
+// as the same key can be defined once per scope
+func withEnvironmentScope(scope string) gitlab.RequestOptionFunc {
+	return func(req *retryablehttp.Request) error {
+		q := req.URL.Query()
+		q.Set("filter[environment_scope]", scope)
+		req.URL.RawQuery = q.Encode()
+		return nil
+	}
+}
+
 // CreateBotUser creates a bot user
 func (m GitlabAPIClient) CreateBotUser(username, email string) error {
 	p := random.Password(32)
@@ -516,13 +575,14 @@ func (m GitlabAPIClient) fetchGroups(allAvailable bool, ch chan gitlab.Group, er
 	logrus.Infof("done fetching all groups (took %s)", time.Since(startTime))
 }
 
-func (m GitlabAPIClient) fetchGroupMembers(fullpath string) (map[string]internal.Level, error) {
+func (m GitlabAPIClient) fetchGroupMembers(fullpath string) (map[string]internal.Level, map[string]string, error) {
 	logrus.Debugf("fetching all group members for '%s'", fullpath)
 	startTime := time.Now()
 
 	wg := &sync.WaitGroup{}
 	lock := &sync.Mutex{}
 	groupMembers := make(map[string]internal.Level)
+	groupExpires := make(map[string]string)
 
 	fff := func(page int) (int, error) {
 		defer wg.Done()
@@ -534,7 +594,8 @@ func (m GitlabAPIClient) fetchGroupMembers(fullpath string) (map[string]internal
 		}
 
 		pageStartTime := time.Now()
-		members, resp, err := m.client.Groups.ListGroupMembers(fullpath, opt)
+		members := make([]GroupMember, 0)
+		resp, err := m.groupMembersRequest(http.MethodGet, fullpath, "", opt, &members)
 		if err != nil {
 			return 0, fmt.Errorf("failed to fetch group members for '%s': %s (took %s)", fullpath, err, time.Since(pageStartTime))
 		}
@@ -545,6 +606,9 @@ func (m GitlabAPIClient) fetchGroupMembers(fullpath string) (map[string]internal
 
 		for _, member := range members {
 			groupMembers[member.Username] = internal.Level(member.AccessLevel)
+			if member.ExpiresAt != nil {
+				groupExpires[member.Username] = member.ExpiresAt.String()
+			}
 		}
 
 		return resp.TotalPages, nil
@@ -553,7 +617,7 @@ func (m GitlabAPIClient) fetchGroupMembers(fullpath string) (map[string]internal
 	wg.Add(1)
 	totalPages, err := fff(1)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	wg.Add(totalPages - 1)
 
@@ -563,13 +627,33 @@ func (m GitlabAPIClient) fetchGroupMembers(fullpath string) (map[string]internal
 
 	wg.Wait()
 	logrus.Debugf("done fetching all group members for '%s' (took %s)", fullpath, time.Since(startTime))
-	return groupMembers, nil
+	return groupMembers, groupExpires, nil
+}
+
+// GroupMember is a member of a group as the API returns it. gitlab.GroupMember
+// can't be used, it decodes expires_at as a timestamp while it's a date.
+type GroupMember struct {
+	Username    string                  `json:"username"`
+	AccessLevel gitlab.AccessLevelValue `json:"access_level"`
+	ExpiresAt   *gitlab.ISOTime         `json:"expires_at"`
+}
+
+// groupMembersRequest sends a request about the members of a group, with the
+// members in the response decoded as GroupMember
+func (m GitlabAPIClient) groupMembersRequest(method, group, path string, opt, v interface{}) (*gitlab.Response, error) {
+	u := fmt.Sprintf("groups/%s/members%s", strings.Replace(url.PathEscape(group), ".", "%2E", -1), path)
+
+	req, err := m.client.NewRequest(method, u, opt, nil)
+	if err != nil {
+		return nil, err
+	}
+	return m.client.Do(req, v)
 }
 
-func (m GitlabAPIClient) fetchGroupVariables(fullpath string) (map[string]string, error) {
+func (m GitlabAPIClient) fetchGroupVariables(fullpath string) (map[string]internal.Variable, error) {
 	logrus.Debugf("fetching group variables for '%s'", fullpath)
 
-	variables := make(map[string]string)
+	variables := make(map[string]internal.Variable)
 	_, _, err := m.client.Groups.GetGroup(fullpath)
 	if err != nil {
 		logrus.Fatalf("failed to fetch group '%s': %s", fullpath, err)
@@ -586,7 +670,8 @@ func (m GitlabAPIClient) fetchGroupVariables(fullpath string) (map[string]string
 	logrus.Debugf("done fetching group variables for '%s' (took %s)", fullpath, time.Since(startTime))
 
 	for _, v := range vars {
-		variables[v.Key] = v.Value
+		variable := internal.NewVariable(v.Key, v.Value, string(v.VariableType), &v.Protected, &v.Masked, v.EnvironmentScope)
+		variables[variable.ID()] = variable
 	}
 
 	return variables, nil
@@ -639,13 +724,14 @@ func (m GitlabAPIClient) fetchAllProjects(ch chan gitlab.Project, errs *errors.E
 	logrus.Infof("done fetching all projects (took %s)", time.Since(startTime))
 }
 
-func (m GitlabAPIClient) fetchProjectMembers(fullpath string) (map[string]internal.Level, error) {
+func (m GitlabAPIClient) fetchProjectMembers(fullpath string) (map[string]internal.Level, map[string]string, error) {
 	logrus.Debugf("fetching project members for '%s'", fullpath)
 	startTime := time.Now()
 
 	wg := &sync.WaitGroup{}
 	lock := &sync.Mutex{}
 	projectMembers := make(map[string]internal.Level)
+	projectExpires := make(map[string]string)
 
 	fff := func(page int) (int, error) {
 		defer wg.Done()
@@ -669,6 +755,9 @@ func (m GitlabAPIClient) fetchProjectMembers(fullpath string) (map[string]intern
 
 		for _, member := range members {
 			projectMembers[member.Username] = internal.Level(member.AccessLevel)
+			if member.ExpiresAt != nil {
+				projectExpires[member.Username] = member.ExpiresAt.String()
+			}
 		}
 		return resp.TotalPages, nil
 	}
@@ -676,7 +765,7 @@ func (m GitlabAPIClient) fetchProjectMembers(fullpath string) (map[string]intern
 	wg.Add(1) // The initial call to get the total number of pages
 	totalPages, err := fff(1)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	wg.Add(totalPages - 1) // The total number of pages but the initial one done before
@@ -687,12 +776,12 @@ func (m GitlabAPIClient) fetchProjectMembers(fullpath string) (map[string]intern
 
 	wg.Wait()
 	logrus.Debugf("done fetching project members for %s (took %s)", fullpath, time.Since(startTime))
-	return projectMembers, nil
+	return projectMembers, projectExpires, nil
 }
 
-func (m GitlabAPIClient) fetchProjectVariables(fullpath string) (map[string]string, error) {
+func (m GitlabAPIClient) fetchProjectVariables(fullpath string) (map[string]internal.Variable, error) {
 	logrus.Tracef("fetching project variables for '%s'", fullpath)
-	projectVariables := make(map[string]string)
+	projectVariables := make(map[string]internal.Variable)
 
 	startTime := time.Now()
 	_, _, err := m.client.Projects.GetProject(fullpath, nil)
@@ -709,7 +798,8 @@ func (m GitlabAPIClient) fetchProjectVariables(fullpath string) (map[string]stri
 	}
 
 	for _, v := range vars {
-		projectVariables[v.Key] = v.Value
+		variable := internal.NewVariable(v.Key, v.Value, string(v.VariableType), &v.Protected, &v.Masked, v.EnvironmentScope)
+		projectVariables[variable.ID()] = variable
 	}
 
 	logrus.Debugf("done fetching variables for project '%s' (took %s)", fullpath, time.Since(startTime))
@@ -727,3 +817,12 @@ func (m GitlabAPIClient) fetchProject(fullpath string) (*gitlab.Project, error)
 	logrus.Debugf("done fetching project '%s' (took %s)", fullpath, time.Since(startTime))
 	return p, nil
 }
+
+// variableType returns the type to send to gitlab, nil when the variable
+// doesn't set it so it's left as it is
+func variableType(v internal.Variable) *gitlab.VariableTypeValue {
+	if v.VariableType == "" {
+		return nil
+	}
+	return gitlab.VariableType(gitlab.VariableTypeValue(v.VariableType))
+}
@@ -0,0 +1,32 @@
+package api_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/api"
+
+	"github.com/stretchr/testify/assert"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestDecodingMembersExpirationDates(t *testing.T) {
+	a := assert.New(t)
+
+	body := []byte(`[
+		{"username": "user1", "access_level": 30, "expires_at": "2026-12-31"},
+		{"username": "user2", "access_level": 40, "expires_at": null}
+	]`)
+
+	groupMembers := make([]api.GroupMember, 0)
+	a.NoError(json.Unmarshal(body, &groupMembers))
+	a.Len(groupMembers, 2)
+	a.Equal("2026-12-31", groupMembers[0].ExpiresAt.String())
+	a.Nil(groupMembers[1].ExpiresAt)
+
+	projectMembers := make([]*gitlab.ProjectMember, 0)
+	a.NoError(json.Unmarshal(body, &projectMembers))
+	a.Len(projectMembers, 2)
+	a.Equal("2026-12-31", projectMembers[0].ExpiresAt.String())
+	a.Nil(projectMembers[1].ExpiresAt)
+}
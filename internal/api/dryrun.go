@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"strings"
 
 	"gitlab.com/yakshaving.art/hurrdurr/internal"
 )
@@ -13,14 +14,14 @@ type DryRunAPIClient struct {
 }
 
 // AddGroupMembership implements the APIClient interface
-func (m DryRunAPIClient) AddGroupMembership(username, group string, level internal.Level) error {
-	m.Append(fmt.Sprintf("add '%s' to '%s' at level '%s'", username, group, level))
+func (m DryRunAPIClient) AddGroupMembership(username, group string, level internal.Level, expiresAt string) error {
+	m.Append(fmt.Sprintf("add '%s' to '%s' at level '%s'%s", username, group, level, expiring(expiresAt)))
 	return nil
 }
 
 // ChangeGroupMembership implements the APIClient interface
-func (m DryRunAPIClient) ChangeGroupMembership(username, group string, level internal.Level) error {
-	m.Append(fmt.Sprintf("change '%s' in '%s' at level '%s'", username, group, level))
+func (m DryRunAPIClient) ChangeGroupMembership(username, group string, level internal.Level, expiresAt string) error {
+	m.Append(fmt.Sprintf("change '%s' in '%s' at level '%s'%s", username, group, level, expiring(expiresAt)))
 	return nil
 }
 
@@ -55,14 +56,14 @@ func (m DryRunAPIClient) RemoveProjectSharing(project, group string) error {
 }
 
 // AddProjectMembership implements the APIClient interface
-func (m DryRunAPIClient) AddProjectMembership(username, project string, level internal.Level) error {
-	m.Append(fmt.Sprintf("add '%s' to '%s' at level '%s'", username, project, level))
+func (m DryRunAPIClient) AddProjectMembership(username, project string, level internal.Level, expiresAt string) error {
+	m.Append(fmt.Sprintf("add '%s' to '%s' at level '%s'%s", username, project, level, expiring(expiresAt)))
 	return nil
 }
 
 // ChangeProjectMembership implements the APIClient interface
-func (m DryRunAPIClient) ChangeProjectMembership(username, project string, level internal.Level) error {
-	m.Append(fmt.Sprintf("change '%s' in '%s' to level '%s'", username, project, level))
+func (m DryRunAPIClient) ChangeProjectMembership(username, project string, level internal.Level, expiresAt string) error {
+	m.Append(fmt.Sprintf("change '%s' in '%s' to level '%s'%s", username, project, level, expiring(expiresAt)))
 	return nil
 }
 
@@ -97,26 +98,38 @@ func (m DryRunAPIClient) UnsetAdminUser(username string) error {
 }
 
 // CreateGroupVariable implements APIClient interface
-func (m DryRunAPIClient) CreateGroupVariable(group, key, value string) error {
-	m.Append(fmt.Sprintf("create group variable '%s' in '%s'", key, group))
+func (m DryRunAPIClient) CreateGroupVariable(group string, v internal.Variable) error {
+	m.Append(fmt.Sprintf("create group variable '%s' in '%s'%s", v.ID(), group, attributes(v)))
 	return nil
 }
 
 // UpdateGroupVariable implements APIClient interface
-func (m DryRunAPIClient) UpdateGroupVariable(group, key, value string) error {
-	m.Append(fmt.Sprintf("update group variable '%s' in '%s'", key, group))
+func (m DryRunAPIClient) UpdateGroupVariable(group string, v internal.Variable) error {
+	m.Append(fmt.Sprintf("update group variable '%s' in '%s'%s", v.ID(), group, attributes(v)))
+	return nil
+}
+
+// DeleteGroupVariable implements APIClient interface
+func (m DryRunAPIClient) DeleteGroupVariable(group string, v internal.Variable) error {
+	m.Append(fmt.Sprintf("!!! DELETE group variable '%s' in '%s'", v.ID(), group))
 	return nil
 }
 
 // CreateProjectVariable implements APIClient interface
-func (m DryRunAPIClient) CreateProjectVariable(fullpath, key, value string) error {
-	m.Append(fmt.Sprintf("create project variable '%s' in '%s'", key, fullpath))
+func (m DryRunAPIClient) CreateProjectVariable(fullpath string, v internal.Variable) error {
+	m.Append(fmt.Sprintf("create project variable '%s' in '%s'%s", v.ID(), fullpath, attributes(v)))
 	return nil
 }
 
 // UpdateProjectVariable implements APIClient interface
-func (m DryRunAPIClient) UpdateProjectVariable(fullpath, key, value string) error {
-	m.Append(fmt.Sprintf("update project variable '%s' in '%s'", key, fullpath))
+func (m DryRunAPIClient) UpdateProjectVariable(fullpath string, v internal.Variable) error {
+	m.Append(fmt.Sprintf("update project variable '%s' in '%s'%s", v.ID(), fullpath, attributes(v)))
+	return nil
+}
+
+// DeleteProjectVariable implements APIClient interface
+func (m DryRunAPIClient) DeleteProjectVariable(fullpath string, v internal.Variable) error {
+	m.Append(fmt.Sprintf("!!! DELETE project variable '%s' in '%s'", v.ID(), fullpath))
 	return nil
 }
 
@@ -131,3 +144,28 @@ func (m DryRunAPIClient) UpdateBotEmail(username, desiredEmail string) error {
 	m.Append(fmt.Sprintf("update bot '%s' email to '%s'", username, desiredEmail))
 	return nil
 }
+
+func expiring(expiresAt string) string {
+	if expiresAt == "" {
+		return ""
+	}
+	return fmt.Sprintf(" until %s", expiresAt)
+}
+
+// attributes lists the variable attributes that are not gitlab defaults
+func attributes(v internal.Variable) string {
+	attrs := make([]string, 0)
+	if v.IsProtected() {
+		attrs = append(attrs, "protected")
+	}
+	if v.IsMasked() {
+		attrs = append(attrs, "masked")
+	}
+	if v.VariableType == internal.FileVariableType {
+		attrs = append(attrs, "file")
+	}
+	if len(attrs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(attrs, ", "))
+}
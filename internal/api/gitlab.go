@@ -40,27 +40,15 @@ func CreatePreloadedQuerier(m *GitlabAPIClient) error {
 	adminCount := 0
 	for u := range usersCh {
 		if u.State == "blocked" {
-			users[u.Username] = GitlabUser{
-				ID:             u.ID,
-				PrincipalEmail: u.Email,
-				Role:           BlockedUserRole,
-			}
+			users[u.Username] = newGitlabUser(u, BlockedUserRole)
 
 		} else if u.IsAdmin {
-			users[u.Username] = GitlabUser{
-				ID:             u.ID,
-				PrincipalEmail: u.Email,
-				Role:           AdminUserRole,
-			}
+			users[u.Username] = newGitlabUser(u, AdminUserRole)
 			adminCount++
 
 		} else {
 			// TODO - identify bots
-			users[u.Username] = GitlabUser{
-				ID:             u.ID,
-				PrincipalEmail: u.Email,
-				Role:           UserUserRole,
-			}
+			users[u.Username] = newGitlabUser(u, UserUserRole)
 			// logrus.Debugf("appending user %s (took %s)", u.Username, time.Since(startTime))
 		}
 	}
@@ -151,7 +139,7 @@ func LoadFullGitlabState(m GitlabAPIClient) (internal.State, error) {
 						sharedGroups[g.FullPath] = internal.Level(sg.GroupAccessLevel)
 					}
 
-					members, err := m.fetchGroupMembers(group.FullPath)
+					members, expires, err := m.fetchGroupMembers(group.FullPath)
 					if err != nil {
 						errs.Append(fmt.Errorf("failed fetching group members (took %s): %s", time.Since(jobTime), err))
 						return
@@ -170,6 +158,7 @@ func LoadFullGitlabState(m GitlabAPIClient) (internal.State, error) {
 						fullpath:   group.FullPath,
 						sharedWith: sharedGroups,
 						members:    members,
+						expires:    expires,
 						variables:  variables,
 					}
 					logrus.Debugf("done fetching group %q variables and members (took %s)", group.FullPath, time.Since(jobTime))
@@ -206,13 +195,13 @@ func LoadFullGitlabState(m GitlabAPIClient) (internal.State, error) {
 						groups[group.FullPath] = internal.Level(g.GroupAccessLevel)
 					}
 
-					members, err := m.fetchProjectMembers(project.PathWithNamespace)
+					members, expires, err := m.fetchProjectMembers(project.PathWithNamespace)
 					if err != nil {
 						errs.Append(fmt.Errorf("failed to fetch project members for '%s' (took %s): %s", project.PathWithNamespace, time.Since(jobTime), err))
 						return
 					}
 
-					variables := make(map[string]string)
+					variables := make(map[string]internal.Variable)
 
 					// Only try to fetch variables from projects with enabled pipelines
 					// Skip archived projects (they are read-only by definition)
@@ -233,6 +222,7 @@ func LoadFullGitlabState(m GitlabAPIClient) (internal.State, error) {
 						fullpath:   project.PathWithNamespace,
 						sharedWith: groups,
 						members:    members,
+						expires:    expires,
 						variables:  variables,
 					}
 
@@ -263,6 +253,34 @@ type GitlabUser struct {
 	Role           string
 	ID             int
 	PrincipalEmail string
+	External       bool
+	CreatedAt      time.Time
+	LastActivityOn time.Time
+}
+
+func newGitlabUser(u gitlab.User, role string) GitlabUser {
+	user := GitlabUser{
+		ID:             u.ID,
+		PrincipalEmail: u.Email,
+		Role:           role,
+		External:       u.External,
+	}
+	if u.CreatedAt != nil {
+		user.CreatedAt = *u.CreatedAt
+	}
+	if u.LastActivityOn != nil {
+		user.LastActivityOn = time.Time(*u.LastActivityOn)
+	}
+	return user
+}
+
+func (u GitlabUser) attributes() internal.UserAttributes {
+	return internal.UserAttributes{
+		Email:          u.PrincipalEmail,
+		External:       u.External,
+		CreatedAt:      u.CreatedAt,
+		LastActivityOn: u.LastActivityOn,
+	}
 }
 
 // GitlabQuerier implements the internal.Querier interface
@@ -346,6 +364,15 @@ func (m GitlabQuerier) GetUserEmail(username string) (string, bool) {
 	return u.PrincipalEmail, true
 }
 
+// GetUserAttributes implements Querier interface
+func (m GitlabQuerier) GetUserAttributes(username string) (internal.UserAttributes, bool) {
+	u, ok := m.getUser(username)
+	if !ok {
+		return internal.UserAttributes{}, false
+	}
+	return u.attributes(), true
+}
+
 // GroupExists implements Querier interface
 func (m GitlabQuerier) GroupExists(g string) bool {
 	_, ok := m.groups[g]
@@ -475,7 +502,8 @@ type GitlabGroup struct {
 	fullpath   string
 	sharedWith map[string]internal.Level
 	members    map[string]internal.Level
-	variables  map[string]string
+	expires    map[string]string
+	variables  map[string]internal.Variable
 }
 
 // GetFullpath implements the internal.Group interface
@@ -499,25 +527,40 @@ func (g GitlabGroup) GetMembers() map[string]internal.Level {
 	return g.members
 }
 
+// GetExpirations implements the internal.Group interface
+func (g GitlabGroup) GetExpirations() map[string]string {
+	return g.expires
+}
+
 // HasVariable implements internal.HasVariable interface
-func (g GitlabGroup) HasVariable(key string) bool {
-	_, ok := g.variables[key]
+func (g GitlabGroup) HasVariable(id string) bool {
+	_, ok := g.variables[id]
 	return ok
 }
 
 // VariableEquals implements internal.VariableEquals interface
-func (g GitlabGroup) VariableEquals(key, value string) bool {
-	if current, ok := g.variables[key]; ok {
-		return current == value
+func (g GitlabGroup) VariableEquals(v internal.Variable) bool {
+	if current, ok := g.variables[v.ID()]; ok {
+		return current.Satisfies(v)
 	}
 	return false
 }
 
 // GetVariables implements internal.GetVariables interface
-func (g GitlabGroup) GetVariables() map[string]string {
+func (g GitlabGroup) GetVariables() map[string]internal.Variable {
 	return g.variables
 }
 
+// IsAdditive implements internal.Group interface, a live group is never additive
+func (GitlabGroup) IsAdditive() bool {
+	return false
+}
+
+// PrunesVariables implements internal.Group interface, it's only meaningful in a desired state
+func (GitlabGroup) PrunesVariables() bool {
+	return false
+}
+
 // GitlabProject implements internal.Project interface
 //
 // This is a helper object that is used to load a project with the list of
@@ -527,7 +570,8 @@ type GitlabProject struct {
 	fullpath   string
 	sharedWith map[string]internal.Level
 	members    map[string]internal.Level
-	variables  map[string]string
+	expires    map[string]string
+	variables  map[string]internal.Variable
 }
 
 // GetFullpath implements internal.Project interface
@@ -551,25 +595,40 @@ func (g GitlabProject) GetMembers() map[string]internal.Level {
 	return g.members
 }
 
+// GetExpirations implements internal.Project interface
+func (g GitlabProject) GetExpirations() map[string]string {
+	return g.expires
+}
+
 // HasVariable implements internal.HasVariable interface
-func (g GitlabProject) HasVariable(key string) bool {
-	_, ok := g.variables[key]
+func (g GitlabProject) HasVariable(id string) bool {
+	_, ok := g.variables[id]
 	return ok
 }
 
 // VariableEquals implements internal.VariableEquals interface
-func (g GitlabProject) VariableEquals(key, value string) bool {
-	if current, ok := g.variables[key]; ok {
-		return current == value
+func (g GitlabProject) VariableEquals(v internal.Variable) bool {
+	if current, ok := g.variables[v.ID()]; ok {
+		return current.Satisfies(v)
 	}
 	return false
 }
 
 // GetVariables implements internal.GetVariables interface
-func (g GitlabProject) GetVariables() map[string]string {
+func (g GitlabProject) GetVariables() map[string]internal.Variable {
 	return g.variables
 }
 
+// IsAdditive implements internal.Project interface, a live project is never additive
+func (GitlabProject) IsAdditive() bool {
+	return false
+}
+
+// PrunesVariables implements internal.Project interface, it's only meaningful in a desired state
+func (GitlabProject) PrunesVariables() bool {
+	return false
+}
+
 func b(bb bool) *bool {
 	return &bb
 }
@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"filippo.io/age"
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+)
+
+// TimestampFormat is the format of the timestamp in the snapshot filenames
+const TimestampFormat = "20060102T150405Z"
+
+// Snapshot is a copy of the variables as they were in gitlab before being
+// overwritten or deleted
+type Snapshot struct {
+	Created   time.Time `json:"created"`
+	Variables []Entry   `json:"variables"`
+}
+
+// Entry is a variable in a snapshot along with the group or project it
+// belongs to
+type Entry struct {
+	Group            string `json:"group,omitempty"`
+	Project          string `json:"project,omitempty"`
+	Key              string `json:"key"`
+	Value            string `json:"value"`
+	Protected        bool   `json:"protected,omitempty"`
+	Masked           bool   `json:"masked,omitempty"`
+	VariableType     string `json:"variable_type"`
+	EnvironmentScope string `json:"environment_scope"`
+}
+
+// NewEntry returns the entry for a variable in a group or project, variables
+// without type are env vars in gitlab
+func NewEntry(group, project string, v internal.Variable) Entry {
+	e := Entry{
+		Group:            group,
+		Project:          project,
+		Key:              v.Key,
+		Value:            v.Value,
+		Protected:        v.IsProtected(),
+		Masked:           v.IsMasked(),
+		VariableType:     v.VariableType,
+		EnvironmentScope: v.EnvironmentScope,
+	}
+	if e.VariableType == "" {
+		e.VariableType = internal.EnvVariableType
+	}
+	return e
+}
+
+// Variable returns the variable of the entry
+func (e Entry) Variable() internal.Variable {
+	return internal.NewVariable(e.Key, e.Value, e.VariableType, &e.Protected, &e.Masked, e.EnvironmentScope)
+}
+
+// Add appends a variable of a group or project to the snapshot
+func (s *Snapshot) Add(group, project string, v internal.Variable) {
+	s.Variables = append(s.Variables, NewEntry(group, project, v))
+}
+
+// Filename returns the name of the file the snapshot is saved to
+func (s Snapshot) Filename() string {
+	return fmt.Sprintf("variables-%s.age", s.Created.UTC().Format(TimestampFormat))
+}
+
+// Save encrypts the snapshot for the given age recipient and writes it to
+// the given directory, returning the path of the file
+func (s Snapshot) Save(dir, recipient string) (string, error) {
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return "", fmt.Errorf("invalid backup recipient: %s", err)
+	}
+
+	sort.SliceStable(s.Variables, func(i, j int) bool {
+		a, b := s.Variables[i], s.Variables[j]
+		if a.Group+a.Project != b.Group+b.Project {
+			return a.Group+a.Project < b.Group+b.Project
+		}
+		return a.Variable().ID() < b.Variable().ID()
+	})
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize snapshot: %s", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %s", err)
+	}
+
+	filename := filepath.Join(dir, s.Filename())
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot file: %s", err)
+	}
+	defer f.Close()
+
+	w, err := age.Encrypt(f, r)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt snapshot: %s", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return "", fmt.Errorf("failed to write snapshot: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to write snapshot: %s", err)
+	}
+	return filename, f.Close()
+}
+
+// Load decrypts the snapshot in the given file with the age identities in
+// the identity file
+func Load(filename, identityFile string) (Snapshot, error) {
+	s := Snapshot{}
+
+	identities, err := loadIdentities(identityFile)
+	if err != nil {
+		return s, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return s, fmt.Errorf("failed to open snapshot: %s", err)
+	}
+	defer f.Close()
+
+	r, err := age.Decrypt(f, identities...)
+	if err != nil {
+		return s, fmt.Errorf("failed to decrypt snapshot %s: %s", filename, err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return s, fmt.Errorf("failed to decrypt snapshot %s: %s", filename, err)
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("failed to parse snapshot %s: %s", filename, err)
+	}
+	return s, nil
+}
+
+func loadIdentities(identityFile string) ([]age.Identity, error) {
+	if identityFile == "" {
+		return nil, fmt.Errorf("an age identity file is required to decrypt snapshots")
+	}
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file: %s", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identities in %s: %s", identityFile, err)
+	}
+	return identities, nil
+}
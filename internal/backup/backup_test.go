@@ -0,0 +1,98 @@
+package backup_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/backup"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSavingAndLoadingSnapshots(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hurrdurr-backup")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	a.NoError(err)
+	identityFile := filepath.Join(dir, "identity.txt")
+	a.NoError(ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600))
+
+	s := backup.Snapshot{
+		Created: time.Date(2026, 10, 16, 10, 30, 0, 0, time.UTC),
+	}
+	masked := true
+	s.Add("", "root_group/a_project", internal.Variable{
+		Key:              "mykey",
+		Value:            "projectvalue",
+		Masked:           &masked,
+		VariableType:     internal.EnvVariableType,
+		EnvironmentScope: "production",
+	})
+	s.Add("other_group", "", internal.Variable{
+		Key:              "mygroupkey",
+		Value:            "groupvalue",
+		VariableType:     internal.FileVariableType,
+		EnvironmentScope: internal.DefaultEnvironmentScope,
+	})
+
+	filename, err := s.Save(filepath.Join(dir, "backups"), identity.Recipient().String())
+	a.NoError(err)
+	a.Equal(filepath.Join(dir, "backups", "variables-20261016T103000Z.age"), filename)
+
+	b, err := ioutil.ReadFile(filename)
+	a.NoError(err)
+	a.NotContains(string(b), "projectvalue", "the snapshot is encrypted")
+
+	loaded, err := backup.Load(filename, identityFile)
+	a.NoError(err)
+	a.True(s.Created.Equal(loaded.Created))
+	a.Equal([]backup.Entry{
+		{
+			Group:            "other_group",
+			Key:              "mygroupkey",
+			Value:            "groupvalue",
+			VariableType:     internal.FileVariableType,
+			EnvironmentScope: internal.DefaultEnvironmentScope,
+		},
+		{
+			Project:          "root_group/a_project",
+			Key:              "mykey",
+			Value:            "projectvalue",
+			Masked:           true,
+			VariableType:     internal.EnvVariableType,
+			EnvironmentScope: "production",
+		},
+	}, loaded.Variables)
+	a.Equal("mykey@production", loaded.Variables[1].Variable().ID())
+
+	_, err = s.Save(filepath.Join(dir, "backups"), identity.Recipient().String())
+	a.Error(err, "snapshots are never overwritten")
+
+	other, err := age.GenerateX25519Identity()
+	a.NoError(err)
+	otherFile := filepath.Join(dir, "other.txt")
+	a.NoError(ioutil.WriteFile(otherFile, []byte(other.String()+"\n"), 0600))
+
+	_, err = backup.Load(filename, otherFile)
+	a.EqualError(err, "failed to decrypt snapshot "+filename+": no identity matched any of the recipients")
+
+	_, err = backup.Load(filename, "")
+	a.EqualError(err, "an age identity file is required to decrypt snapshots")
+}
+
+func TestSavingWithAnInvalidRecipient(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := backup.Snapshot{}.Save(os.TempDir(), "not-a-key")
+	a.Error(err)
+	a.Contains(err.Error(), "invalid backup recipient: malformed recipient \"not-a-key\"")
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"sort"
+	"strings"
 )
 
 // Errors is an error aggregator, it's useful for aggregating all the errors in
@@ -33,7 +34,7 @@ func formatErrors(errors []error) string {
 	buffer := bytes.NewBufferString(fmt.Sprintf("%d errors: ", len(errors)))
 
 	sort.Slice(errors, func(i, j int) bool {
-		return errors[i].Error() < errors[j].Error()
+		return naturalLess(errors[i].Error(), errors[j].Error())
 	})
 
 	for i, e := range errors {
@@ -45,6 +46,38 @@ func formatErrors(errors []error) string {
 	return buffer.String()
 }
 
+// naturalLess compares strings comparing runs of digits by their value, so
+// errors prefixed with file:line:col positions are sorted by line
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digits(a), digits(b)
+		if da > 0 && db > 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func digits(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return i
+}
+
 // Append adds a new error to the list, it doesn't if the passed in error is nil
 func (e *Errors) Append(err error) {
 	if err != nil {
@@ -62,5 +95,5 @@ func (e Errors) ErrorOrNil() error {
 	if len(e.errors) == 0 {
 		return nil
 	}
-	return fmt.Errorf(e.Error())
+	return fmt.Errorf("%s", e.Error())
 }
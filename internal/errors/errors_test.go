@@ -38,3 +38,12 @@ func TestMultipleErrors(t *testing.T) {
 	assert.EqualError(t, errs.ErrorOrNil(), "2 errors: my error; my other error")
 	assert.EqualError(t, errs, "2 errors: my error; my other error")
 }
+
+func TestErrorsAreSortedByPosition(t *testing.T) {
+	errs := errors.New()
+	errs.Append(fmt.Errorf("config.yml:10:3: my error"))
+	errs.Append(fmt.Errorf("config.yml:9:12: my error"))
+	errs.Append(fmt.Errorf("config.yml:9:3: my error"))
+
+	assert.EqualError(t, errs, "3 errors: config.yml:9:3: my error; config.yml:9:12: my error; config.yml:10:3: my error")
+}
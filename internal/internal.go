@@ -1,5 +1,11 @@
 package internal
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 // Level represents the access level granted to a user in a group
 type Level int
 
@@ -26,15 +32,44 @@ func (l Level) String() string {
 	return levels[(l-Guest)/10]
 }
 
+// ParseLevel turns a level name like Developer into a Level
+func ParseLevel(name string) (Level, error) {
+	for _, l := range []Level{Guest, Reporter, Developer, Maintainer, Owner} {
+		if strings.EqualFold(l.String(), name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid level '%s'", name)
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
 // Group represents a gitlab group
 type Group interface {
 	GetFullpath() string
 	GetMembers() map[string]Level
+	GetExpirations() map[string]string
 
 	GetSharedGroups() map[string]Level
-	GetVariables() map[string]string
-	HasVariable(key string) bool
-	VariableEquals(key, value string) bool
+	GetVariables() map[string]Variable
+	HasVariable(id string) bool
+	VariableEquals(v Variable) bool
+	PrunesVariables() bool
+
+	IsAdditive() bool
 }
 
 // Project represents a gitlab project
@@ -44,10 +79,122 @@ type Project interface {
 
 	GetSharedGroups() map[string]Level
 	GetMembers() map[string]Level
+	GetExpirations() map[string]string
+
+	GetVariables() map[string]Variable
+	HasVariable(id string) bool
+	VariableEquals(v Variable) bool
+	PrunesVariables() bool
+
+	IsAdditive() bool
+}
+
+// Variable types
+const (
+	EnvVariableType  = "env_var"
+	FileVariableType = "file"
+)
+
+// DefaultEnvironmentScope is the scope of the variables available to every environment
+const DefaultEnvironmentScope = "*"
+
+// Variable represents a CI/CD variable with its value and attributes. In the
+// desired state the attributes the configuration doesn't set are nil or empty,
+// and they are left as they are in gitlab.
+type Variable struct {
+	Key              string
+	Value            string
+	Protected        *bool
+	Masked           *bool
+	VariableType     string
+	EnvironmentScope string
+}
+
+// NewVariable builds a variable, variables without environment scope belong
+// to the default one
+func NewVariable(key, value, variableType string, protected, masked *bool, scope string) Variable {
+	v := Variable{
+		Key:              key,
+		Value:            value,
+		Protected:        copyBool(protected),
+		Masked:           copyBool(masked),
+		VariableType:     variableType,
+		EnvironmentScope: scope,
+	}
+	if v.EnvironmentScope == "" {
+		v.EnvironmentScope = DefaultEnvironmentScope
+	}
+	return v
+}
+
+// IsProtected returns true when the variable is set as protected
+func (v Variable) IsProtected() bool {
+	return v.Protected != nil && *v.Protected
+}
+
+// IsMasked returns true when the variable is set as masked
+func (v Variable) IsMasked() bool {
+	return v.Masked != nil && *v.Masked
+}
 
-	GetVariables() map[string]string
-	HasVariable(key string) bool
-	VariableEquals(key, value string) bool
+// Differences lists what has to change for the variable to be as the desired
+// one, attributes the desired variable doesn't set are ignored
+func (v Variable) Differences(desired Variable) []string {
+	differences := make([]string, 0)
+	if v.Value != desired.Value {
+		differences = append(differences, "value")
+	}
+	if desired.Protected != nil && v.IsProtected() != *desired.Protected {
+		differences = append(differences, fmt.Sprintf("protected %t -> %t", v.IsProtected(), *desired.Protected))
+	}
+	if desired.Masked != nil && v.IsMasked() != *desired.Masked {
+		differences = append(differences, fmt.Sprintf("masked %t -> %t", v.IsMasked(), *desired.Masked))
+	}
+	currentType := v.VariableType
+	if currentType == "" {
+		currentType = EnvVariableType
+	}
+	if desired.VariableType != "" && currentType != desired.VariableType {
+		differences = append(differences, fmt.Sprintf("variable_type %s -> %s", currentType, desired.VariableType))
+	}
+	return differences
+}
+
+// Satisfies returns true when the variable has the value of the desired one
+// and every attribute it sets
+func (v Variable) Satisfies(desired Variable) bool {
+	return v.ID() == desired.ID() && len(v.Differences(desired)) == 0
+}
+
+func copyBool(b *bool) *bool {
+	if b == nil {
+		return nil
+	}
+	c := *b
+	return &c
+}
+
+// ID returns the variable identifier, a key can be defined once per
+// environment scope so both are part of it
+func (v Variable) ID() string {
+	return VariableID(v.Key, v.EnvironmentScope)
+}
+
+// VariableID builds the identifier of the variable with the given key and
+// environment scope, it's the plain key for the default scope
+func VariableID(key, scope string) string {
+	if scope == "" || scope == DefaultEnvironmentScope {
+		return key
+	}
+	return key + "@" + scope
+}
+
+// ParseVariableID splits a variable identifier in its key and environment scope
+func ParseVariableID(id string) (string, string) {
+	if i := strings.Index(id, "@"); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+	return id, DefaultEnvironmentScope
 }
 
 // State represents a state which includes groups and memberships
@@ -80,6 +227,7 @@ type Querier interface {
 	IsAdmin(string) bool
 	IsBlocked(u string) bool
 	GetUserEmail(string) (string, bool)
+	GetUserAttributes(string) (UserAttributes, bool)
 
 	GroupExists(string) bool
 	ProjectExists(string) bool
@@ -94,6 +242,15 @@ type Querier interface {
 	Projects() []string
 }
 
+// UserAttributes are the attributes of a user that queries can filter on,
+// times are zero when they are not known
+type UserAttributes struct {
+	Email          string
+	External       bool
+	CreatedAt      time.Time
+	LastActivityOn time.Time
+}
+
 // ActionPriority is used to prioritize different actions according to when
 // should they be executed
 type ActionPriority int
@@ -123,8 +280,8 @@ type Action interface {
 
 // APIClient is the tool used to reach the remote instance and perform actions on it
 type APIClient interface {
-	AddGroupMembership(username, group string, level Level) error
-	ChangeGroupMembership(username, group string, level Level) error
+	AddGroupMembership(username, group string, level Level, expiresAt string) error
+	ChangeGroupMembership(username, group string, level Level, expiresAt string) error
 	RemoveGroupMembership(username, group string) error
 
 	AddGroupSharing(group, shared_group string, level Level) error
@@ -133,15 +290,17 @@ type APIClient interface {
 	AddProjectSharing(project, group string, level Level) error
 	RemoveProjectSharing(project, group string) error
 
-	AddProjectMembership(username, project string, level Level) error
-	ChangeProjectMembership(username, project string, level Level) error
+	AddProjectMembership(username, project string, level Level, expiresAt string) error
+	ChangeProjectMembership(username, project string, level Level, expiresAt string) error
 	RemoveProjectMembership(username, project string) error
 
-	CreateGroupVariable(group, key, value string) error
-	UpdateGroupVariable(group, key, value string) error
+	CreateGroupVariable(group string, variable Variable) error
+	UpdateGroupVariable(group string, variable Variable) error
+	DeleteGroupVariable(group string, variable Variable) error
 
-	CreateProjectVariable(fullpath, key, value string) error
-	UpdateProjectVariable(fullpath, key, value string) error
+	CreateProjectVariable(fullpath string, variable Variable) error
+	UpdateProjectVariable(fullpath string, variable Variable) error
+	DeleteProjectVariable(fullpath string, variable Variable) error
 
 	BlockUser(username string) error
 	UnblockUser(username string) error
@@ -154,23 +313,363 @@ type APIClient interface {
 }
 
 // Config represents the configuration structure supporter by hurrdurr
+//
+// Teams are named lists of users, queries and other teams, levels in groups
+// and projects include them with "team: name".
+//
+// MergeStrategy is how groups, projects and teams defined in more than one
+// file are merged, strict by default, which fails, or deep. It can only be set
+// in the main file.
 type Config struct {
-	Groups   map[string]Acls `yaml:"groups,omitempty"`
-	Projects map[string]Acls `yaml:"projects,omitempty"`
+	Groups   map[string]Acls     `yaml:"groups,omitempty"`
+	Projects map[string]Acls     `yaml:"projects,omitempty"`
+	Teams    map[string][]Member `yaml:"teams,omitempty"`
+
+	Users         Users  `yaml:"users,omitempty"`
+	Files         []File `yaml:"files,omitempty"`
+	MergeStrategy string `yaml:"merge_strategy,omitempty"`
+	Bots          []Bot  `yaml:"bots,omitempty"`
+
+	Origins   Origins   `yaml:"-"`
+	Positions Positions `yaml:"-"`
+}
+
+// Origins records the file each group, project and team was loaded from
+type Origins struct {
+	Groups   map[string]string
+	Projects map[string]string
+	Teams    map[string]string
+}
+
+// Position is a line and column in a configuration file
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
 
-	Users Users    `yaml:"users,omitempty"`
-	Files []string `yaml:"files,omitempty"`
-	Bots  []Bot    `yaml:"bots,omitempty"`
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
 }
 
+// Errorf formats an error prefixed with the position, when it's known
+func (p Position) Errorf(format string, args ...interface{}) error {
+	if p.File == "" {
+		return fmt.Errorf(format, args...)
+	}
+	return fmt.Errorf("%s: %s", p, fmt.Sprintf(format, args...))
+}
+
+// Positions records where the top level sections, groups, projects and teams
+// are defined
+type Positions struct {
+	Sections map[string]Position
+	Groups   map[string]EntryPositions
+	Projects map[string]EntryPositions
+	Teams    map[string]EntryPositions
+}
+
+// EntryPositions is the position of a group, project or team along with the
+// positions of its members and secret variables
+type EntryPositions struct {
+	Position
+	Members   map[string]Position
+	Variables map[string]Position
+}
+
+// Member returns the position of the member, or the one of the entry when
+// it's not known
+func (e EntryPositions) Member(member string) Position {
+	if p, ok := e.Members[member]; ok {
+		return p
+	}
+	return e.Position
+}
+
+// Variable returns the position of the secret variable, or the one of the
+// entry when it's not known
+func (e EntryPositions) Variable(name string) Position {
+	if p, ok := e.Variables[name]; ok {
+		return p
+	}
+	return e.Position
+}
+
+// File is an entry of the files list, a plain path or a path with the
+// allowance of what the file, and the files it includes, can define: the
+// top level sections, the group and project path prefixes and the sources
+// secret variables can be read from.
+type File struct {
+	Path          string   `yaml:"path"`
+	Paths         []string `yaml:"paths,omitempty"`
+	Sections      []string `yaml:"sections,omitempty"`
+	SecretSources []string `yaml:"secret_sources,omitempty"`
+}
+
+// Sections a restricted file can be allowed to define
+var Sections = []string{"groups", "projects", "teams", "users", "bots", "files"}
+
+// SecretSources a restricted file can be allowed to read secret variables from
+var SecretSources = []string{"env", "file", "exec", "age"}
+
+// Restricted returns true when the file has an allowance
+func (f File) Restricted() bool {
+	return len(f.Paths) > 0 || len(f.Sections) > 0
+}
+
+// Allows returns true when the allowance includes the section
+func (f File) Allows(section string) bool {
+	for _, s := range f.Sections {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSecretSource returns true when the allowance includes the source type
+func (f File) AllowsSecretSource(sourceType string) bool {
+	for _, s := range f.SecretSources {
+		if s == sourceType {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPath returns true when the path is one of the allowed prefixes or is
+// below one of them, or when the paths are not restricted
+func (f File) AllowsPath(path string) bool {
+	if len(f.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range f.Paths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, files with paths and without
+// sections are allowed groups and projects
+func (f *File) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		*f = File{Path: path}
+		return nil
+	}
+
+	type plain File
+	var p plain
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.Path == "" {
+		return fmt.Errorf("file without path")
+	}
+	if len(p.Paths) > 0 && len(p.Sections) == 0 {
+		p.Sections = []string{"groups", "projects"}
+	}
+	for _, section := range p.Sections {
+		valid := false
+		for _, s := range Sections {
+			valid = valid || s == section
+		}
+		if !valid {
+			return fmt.Errorf("invalid section '%s' for file '%s', use one of %s", section, p.Path,
+				strings.Join(Sections, ", "))
+		}
+	}
+	for _, source := range p.SecretSources {
+		valid := false
+		for _, s := range SecretSources {
+			valid = valid || s == source
+		}
+		if !valid {
+			return fmt.Errorf("invalid secret source '%s' for file '%s', use one of %s", source, p.Path,
+				strings.Join(SecretSources, ", "))
+		}
+	}
+	*f = File(p)
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler, files without allowance are written
+// as plain strings
+func (f File) MarshalYAML() (interface{}, error) {
+	if !f.Restricted() {
+		return f.Path, nil
+	}
+	type plain File
+	return plain(f), nil
+}
+
+// Merge strategies
+const (
+	StrictMergeStrategy = "strict"
+	DeepMergeStrategy   = "deep"
+)
+
+// Management modes
+const (
+	AuthoritativeMode = "authoritative"
+	AdditiveMode      = "additive"
+)
+
 // Acls represents a set of levels and users in each level in a configuration file
+//
+// Mode is either authoritative, the default, where every member not declared
+// is removed, or additive, where members are only added or upgraded.
+//
+// PruneVariables deletes every variable that is not declared.
 type Acls struct {
-	Guests      []string          `yaml:"guests,omitempty"`
-	Reporters   []string          `yaml:"reporters,omitempty"`
-	Developers  []string          `yaml:"developers,omitempty"`
-	Maintainers []string          `yaml:"maintainers,omitempty"`
-	Owners      []string          `yaml:"owners,omitempty"`
-	Variables   map[string]string `yaml:"secret_variables,omitempty"`
+	Mode           string                         `yaml:"mode,omitempty"`
+	PruneVariables bool                           `yaml:"prune_variables,omitempty"`
+	Guests         []Member                       `yaml:"guests,omitempty"`
+	Reporters      []Member                       `yaml:"reporters,omitempty"`
+	Developers     []Member                       `yaml:"developers,omitempty"`
+	Maintainers    []Member                       `yaml:"maintainers,omitempty"`
+	Owners         []Member                       `yaml:"owners,omitempty"`
+	Variables      map[string]VariableDefinitions `yaml:"secret_variables,omitempty"`
+}
+
+// ExpiresFormat is the format of membership expiration dates
+const ExpiresFormat = "2006-01-02"
+
+// Member represents an entry in a level list, it can be a plain string with
+// a username, a query or a sharing; or a mapping with a username and the date
+// in which the membership expires
+type Member struct {
+	Username string `yaml:"username"`
+	Expires  string `yaml:"expires,omitempty"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (m *Member) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var username string
+	if err := unmarshal(&username); err == nil {
+		*m = Member{Username: username}
+		return nil
+	}
+
+	type plain Member
+	var p plain
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.Username == "" {
+		return fmt.Errorf("member without username")
+	}
+	if _, err := time.Parse(ExpiresFormat, p.Expires); p.Expires != "" && err != nil {
+		return fmt.Errorf("invalid expiration date '%s' for member '%s', use YYYY-MM-DD", p.Expires, p.Username)
+	}
+	*m = Member(p)
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler, members without expiration are
+// written as plain strings
+func (m Member) MarshalYAML() (interface{}, error) {
+	if m.Expires == "" {
+		return m.Username, nil
+	}
+	type plain Member
+	return plain(m), nil
+}
+
+// VariableDefinition represents a secret variable in a configuration file, it
+// can be a plain string with the source of the value or a mapping with the
+// source and the variable attributes
+type VariableDefinition struct {
+	Source           string `yaml:"source"`
+	Protected        *bool  `yaml:"protected,omitempty"`
+	Masked           *bool  `yaml:"masked,omitempty"`
+	VariableType     string `yaml:"variable_type,omitempty"`
+	EnvironmentScope string `yaml:"environment_scope,omitempty"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *VariableDefinition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var source string
+	if err := unmarshal(&source); err == nil {
+		*d = VariableDefinition{Source: source}
+		return nil
+	}
+
+	type plain VariableDefinition
+	var p plain
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.Source == "" {
+		return fmt.Errorf("secret variable without source")
+	}
+	switch p.VariableType {
+	case "", EnvVariableType, FileVariableType:
+	default:
+		return fmt.Errorf("invalid variable type '%s' for source '%s', use %s or %s", p.VariableType, p.Source,
+			EnvVariableType, FileVariableType)
+	}
+	*d = VariableDefinition(p)
+	return nil
+}
+
+// SourceType returns the prefix of the source, sources without prefix are
+// read from the environment
+func (d VariableDefinition) SourceType() string {
+	if i := strings.Index(d.Source, ":"); i >= 0 {
+		return d.Source[:i]
+	}
+	return "env"
+}
+
+// MarshalYAML implements yaml.Marshaler, definitions without attributes are
+// written as plain strings
+func (d VariableDefinition) MarshalYAML() (interface{}, error) {
+	if d.Protected == nil && d.Masked == nil && d.VariableType == "" && d.EnvironmentScope == "" {
+		return d.Source, nil
+	}
+	type plain VariableDefinition
+	return plain(d), nil
+}
+
+// VariableDefinitions is the list of definitions of a single variable key,
+// one per environment scope. A single definition can be written without the
+// list.
+type VariableDefinitions []VariableDefinition
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *VariableDefinitions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if _, ok := raw.([]interface{}); ok {
+		var definitions []VariableDefinition
+		if err := unmarshal(&definitions); err != nil {
+			return err
+		}
+		*d = definitions
+		return nil
+	}
+
+	var definition VariableDefinition
+	if err := unmarshal(&definition); err != nil {
+		return err
+	}
+	*d = VariableDefinitions{definition}
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (d VariableDefinitions) MarshalYAML() (interface{}, error) {
+	if len(d) == 1 {
+		return d[0].MarshalYAML()
+	}
+	return []VariableDefinition(d), nil
 }
 
 // Users represents the pair of admins and blocked users
@@ -0,0 +1,136 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+)
+
+// Draft is the JSON Schema version of the generated schema
+const Draft = "http://json-schema.org/draft-07/schema#"
+
+// enums are the values allowed for some fields, by type and field name
+var enums = map[string][]string{
+	"Acls.Mode":                       {internal.AuthoritativeMode, internal.AdditiveMode},
+	"Config.MergeStrategy":            {internal.StrictMergeStrategy, internal.DeepMergeStrategy},
+	"File.SecretSources":              internal.SecretSources,
+	"File.Sections":                   internal.Sections,
+	"VariableDefinition.VariableType": {internal.EnvVariableType, internal.FileVariableType},
+}
+
+// Generate builds the JSON Schema of the configuration file out of the yaml
+// tags of internal.Config. Types that can also be written as plain strings,
+// like members, accept both forms.
+func Generate() ([]byte, error) {
+	g := generator{
+		definitions: make(map[string]interface{}),
+	}
+
+	root := g.object(reflect.TypeOf(internal.Config{}))
+	root["$schema"] = Draft
+	root["title"] = "hurrdurr configuration"
+	root["definitions"] = g.definitions
+
+	b, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+type generator struct {
+	definitions map[string]interface{}
+}
+
+// object returns the schema of the fields of a struct
+func (g generator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("yaml")
+		if tag == "-" || tag == "" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		s := g.schema(f.Type)
+		if values, ok := enums[t.Name()+"."+f.Name]; ok {
+			if f.Type.Kind() == reflect.Slice {
+				s["items"] = map[string]interface{}{"type": "string", "enum": values}
+			} else {
+				s["enum"] = values
+			}
+		}
+		properties[name] = s
+		if !strings.Contains(tag, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	o := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		o["required"] = required
+	}
+	return o
+}
+
+// schema returns the schema of a type, named structs are added to the
+// definitions and referenced
+func (g generator) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(internal.Member{}), reflect.TypeOf(internal.File{}), reflect.TypeOf(internal.VariableDefinition{}):
+		return g.define(t, func() interface{} {
+			return map[string]interface{}{
+				"oneOf": []interface{}{
+					map[string]interface{}{"type": "string"},
+					g.object(t),
+				},
+			}
+		})
+	case reflect.TypeOf(internal.VariableDefinitions{}):
+		return g.define(t, func() interface{} {
+			definition := g.schema(reflect.TypeOf(internal.VariableDefinition{}))
+			return map[string]interface{}{
+				"oneOf": []interface{}{
+					definition,
+					map[string]interface{}{"type": "array", "items": definition},
+				},
+			}
+		})
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.define(t, func() interface{} { return g.object(t) })
+	}
+	panic("unsupported configuration type " + t.String())
+}
+
+// define adds the definition of a type once and returns a reference to it
+func (g generator) define(t reflect.Type, definition func() interface{}) map[string]interface{} {
+	name := t.Name()
+	if _, ok := g.definitions[name]; !ok {
+		g.definitions[name] = nil
+		g.definitions[name] = definition()
+	}
+	return map[string]interface{}{"$ref": "#/definitions/" + name}
+}
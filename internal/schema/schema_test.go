@@ -0,0 +1,42 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/schema"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaIsUpToDate(t *testing.T) {
+	a := assert.New(t)
+
+	b, err := schema.Generate()
+	a.NoError(err)
+
+	committed, err := ioutil.ReadFile("../../config.schema.json")
+	a.NoError(err)
+	a.Equal(string(committed), string(b), "config.schema.json is outdated, run make schema")
+}
+
+func TestSchemaAcceptsPlainStrings(t *testing.T) {
+	a := assert.New(t)
+
+	b, err := schema.Generate()
+	a.NoError(err)
+
+	var s struct {
+		Schema      string `json:"$schema"`
+		Definitions map[string]struct {
+			OneOf []map[string]interface{} `json:"oneOf"`
+		} `json:"definitions"`
+	}
+	a.NoError(json.Unmarshal(b, &s))
+	a.Equal(schema.Draft, s.Schema)
+	for _, name := range []string{"File", "Member", "VariableDefinition"} {
+		a.Contains(s.Definitions[name].OneOf, map[string]interface{}{"type": "string"},
+			"%s can be written as a plain string", name)
+	}
+}
@@ -0,0 +1,182 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// AgeIdentityFileVariable is the environment variable that holds the path to
+// the age identities used to decrypt age sources
+const AgeIdentityFileVariable = "HURRDURR_AGE_IDENTITY_FILE"
+
+// Backend resolves the value of a source without its prefix, relative paths
+// are relative to dir, the directory of the file that declares the source.
+// Errors are read after the source, as in "secret 'KEY'='file:/path' which
+// can't be read", so they should complete that sentence.
+type Backend func(source, dir string) (string, error)
+
+// Resolver turns secret variable sources into their values using the backend
+// registered for the source prefix. Sources without a prefix are looked up in
+// the environment.
+type Resolver struct {
+	backends map[string]Backend
+}
+
+// NewResolver returns a resolver with the env, file, exec and age backends,
+// age files are decrypted with the identities in identityFile. Commands of
+// exec sources are only run when allowExec is set, as they come from the
+// configuration.
+func NewResolver(identityFile string, allowExec bool) Resolver {
+	r := Resolver{
+		backends: make(map[string]Backend),
+	}
+	r.Register("env", fromEnv)
+	r.Register("file", fromFile)
+	if allowExec {
+		r.Register("exec", fromExec)
+	} else {
+		r.Register("exec", execDisabled)
+	}
+	r.Register("age", newAgeBackend(identityFile))
+	return r
+}
+
+// Register adds a backend for the given prefix, replacing any previous one
+func (r Resolver) Register(prefix string, b Backend) {
+	r.backends[prefix] = b
+}
+
+// Resolve returns the value of the given source declared in a file in dir
+func (r Resolver) Resolve(source, dir string) (string, error) {
+	i := strings.Index(source, ":")
+	if i < 0 {
+		return fromEnv(source, dir)
+	}
+	b, ok := r.backends[source[:i]]
+	if !ok {
+		return "", fmt.Errorf("uses an unknown source type '%s', use one of %s", source[:i],
+			strings.Join(r.prefixes(), ", "))
+	}
+	return b(source[i+1:], dir)
+}
+
+func (r Resolver) prefixes() []string {
+	prefixes := make([]string, 0, len(r.backends))
+	for p := range r.backends {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+func fromEnv(name, _ string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("is not loaded in the environment")
+	}
+	return value, nil
+}
+
+// fromFile reads the value from a local file, like a mounted kubernetes
+// secret. Trailing newlines are dropped as most editors add one.
+func fromFile(path, dir string) (string, error) {
+	b, err := ioutil.ReadFile(relativeTo(dir, path))
+	if err != nil {
+		return "", fmt.Errorf("can't be read: %s", err)
+	}
+	return strings.TrimRight(string(b), "\n"), nil
+}
+
+// fromExec runs the command with sh and reads the value from its output,
+// dropping the trailing newlines just like the shell does
+func fromExec(command, _ string) (string, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+func execDisabled(_, _ string) (string, error) {
+	return "", fmt.Errorf("runs a command, which is not allowed")
+}
+
+// newAgeBackend returns a backend that decrypts age encrypted files, binary or
+// armored, with the identities in the given file. The identities are only
+// loaded when the first file is decrypted.
+func newAgeBackend(identityFile string) Backend {
+	var once sync.Once
+	var identities []age.Identity
+	var identitiesErr error
+
+	return func(path, dir string) (string, error) {
+		once.Do(func() {
+			identities, identitiesErr = loadIdentities(identityFile)
+		})
+		if identitiesErr != nil {
+			return "", identitiesErr
+		}
+
+		f, err := os.Open(relativeTo(dir, path))
+		if err != nil {
+			return "", fmt.Errorf("can't be read: %s", err)
+		}
+		defer f.Close()
+
+		var in io.Reader = bufio.NewReader(f)
+		if peek, _ := in.(*bufio.Reader).Peek(len(armor.Header)); string(peek) == armor.Header {
+			in = armor.NewReader(in)
+		}
+
+		r, err := age.Decrypt(in, identities...)
+		if err != nil {
+			return "", fmt.Errorf("can't be decrypted: %s", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("can't be decrypted: %s", err)
+		}
+		return strings.TrimRight(string(b), "\n"), nil
+	}
+}
+
+func loadIdentities(identityFile string) ([]age.Identity, error) {
+	if identityFile == "" {
+		return nil, fmt.Errorf("can't be decrypted: %s is not set", AgeIdentityFileVariable)
+	}
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't be decrypted: %s", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("can't be decrypted: invalid identities in %s: %s", identityFile, err)
+	}
+	return identities, nil
+}
+
+// relativeTo returns the path joined to dir unless it's absolute
+func relativeTo(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,100 @@
+package secrets_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/secrets"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvingSources(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(os.Setenv("HURRDURR_TEST_SECRET", "envvalue"))
+	defer os.Unsetenv("HURRDURR_TEST_SECRET")
+
+	r := secrets.NewResolver("fixtures/identity.txt", true)
+
+	tt := []struct {
+		source        string
+		expected      string
+		expectedError string
+	}{
+		{source: "HURRDURR_TEST_SECRET", expected: "envvalue"},
+		{source: "env:HURRDURR_TEST_SECRET", expected: "envvalue"},
+		{source: "env:HURRDURR_TEST_MISSING_SECRET", expectedError: "is not loaded in the environment"},
+		{source: "file:secret.txt", expected: "filevalue"},
+		{source: "file:missing.txt",
+			expectedError: "can't be read: open fixtures/missing.txt: no such file or directory"},
+		{source: "exec:echo execvalue", expected: "execvalue"},
+		{source: "exec:echo oops >&2; exit 3", expectedError: "failed to run: exit status 3 oops"},
+		{source: "age:secret.age", expected: "agevalue"},
+		{source: "age:secret.age.asc", expected: "armoredvalue"},
+		{source: "age:secret.txt", expectedError: "can't be decrypted: failed to read header: parsing age header: " +
+			"unexpected intro: \"filevalue\\n\""},
+		{source: "vault:secret/data/key", expectedError: "uses an unknown source type 'vault', use one of age, env, exec, file"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.source, func(t *testing.T) {
+			value, err := r.Resolve(tc.source, "fixtures")
+			if tc.expectedError != "" {
+				a.EqualError(err, tc.expectedError)
+				return
+			}
+			a.NoError(err)
+			a.Equal(tc.expected, value)
+		})
+	}
+}
+
+func TestDecryptingWithTheWrongIdentity(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := secrets.NewResolver("fixtures/other-identity.txt", false).Resolve("age:fixtures/secret.age", "")
+	a.EqualError(err, "can't be decrypted: no identity matched any of the recipients")
+}
+
+func TestDecryptingWithoutIdentity(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := secrets.NewResolver("", false).Resolve("age:fixtures/secret.age", "")
+	a.EqualError(err, "can't be decrypted: HURRDURR_AGE_IDENTITY_FILE is not set")
+}
+
+func TestRegisteringBackends(t *testing.T) {
+	a := assert.New(t)
+
+	r := secrets.NewResolver("", false)
+	r.Register("static", func(source, _ string) (string, error) {
+		return "static " + source, nil
+	})
+
+	value, err := r.Resolve("static:value", "")
+	a.NoError(err)
+	a.Equal("static value", value)
+}
+
+func TestResolvingRelativeAndAbsolutePaths(t *testing.T) {
+	a := assert.New(t)
+
+	absolute, err := filepath.Abs("fixtures/secret.txt")
+	a.NoError(err)
+
+	r := secrets.NewResolver("", false)
+	for _, source := range []string{"file:secret.txt", "file:" + absolute} {
+		value, err := r.Resolve(source, "fixtures")
+		a.NoError(err)
+		a.Equal("filevalue", value)
+	}
+}
+
+func TestRunningCommandsIsDisabledByDefault(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := secrets.NewResolver("", false).Resolve("exec:echo execvalue", "")
+	a.EqualError(err, "runs a command, which is not allowed")
+}
@@ -0,0 +1,95 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/backup"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
+)
+
+// VariablesBackup returns a snapshot with the current value of every variable
+// the actions are going to overwrite or delete. Updates that only change the
+// attributes keep the value, they are left out.
+func VariablesBackup(current internal.State, actions []internal.Action) backup.Snapshot {
+	s := backup.Snapshot{
+		Created:   time.Now(),
+		Variables: make([]backup.Entry, 0),
+	}
+
+	addGroupVariable := func(fullpath string, v internal.Variable, update bool) {
+		g, ok := current.Group(fullpath)
+		if !ok || !g.HasVariable(v.ID()) {
+			return
+		}
+		if c := g.GetVariables()[v.ID()]; !update || c.Value != v.Value {
+			s.Add(fullpath, "", c)
+		}
+	}
+	addProjectVariable := func(fullpath string, v internal.Variable, update bool) {
+		p, ok := current.Project(fullpath)
+		if !ok || !p.HasVariable(v.ID()) {
+			return
+		}
+		if c := p.GetVariables()[v.ID()]; !update || c.Value != v.Value {
+			s.Add("", fullpath, c)
+		}
+	}
+
+	for _, action := range actions {
+		switch a := action.(type) {
+		case updateGroupVariable:
+			addGroupVariable(a.Group, a.Variable, true)
+		case deleteGroupVariable:
+			addGroupVariable(a.Group, a.Variable, false)
+		case updateProjectVariable:
+			addProjectVariable(a.Project, a.Variable, true)
+		case deleteProjectVariable:
+			addProjectVariable(a.Project, a.Variable, false)
+		}
+	}
+	return s
+}
+
+// RestoreVariables returns the actions that put the variables of the
+// snapshot back as they were, creating the ones that were deleted since
+func RestoreVariables(current internal.State, s backup.Snapshot) ([]internal.Action, error) {
+	d := &differ{
+		actions: make(map[internal.ActionPriority][]internal.Action, 0),
+		errs:    errors.New(),
+		current: current,
+	}
+
+	for _, e := range s.Variables {
+		v := e.Variable()
+		switch {
+		case e.Group != "":
+			g, ok := current.Group(e.Group)
+			switch {
+			case !ok:
+				d.Error(fmt.Errorf("can't restore variable %s in group %s: the group does not exist", v.ID(), e.Group))
+			case !g.HasVariable(v.ID()):
+				d.Action(createGroupVariable{Group: e.Group, Variable: v})
+			case !g.VariableEquals(v):
+				d.Action(updateGroupVariable{Group: e.Group, Variable: v})
+			}
+
+		case e.Project != "":
+			p, ok := current.Project(e.Project)
+			switch {
+			case !ok:
+				d.Error(fmt.Errorf("can't restore variable %s in project %s: the project does not exist", v.ID(), e.Project))
+			case !p.HasVariable(v.ID()):
+				d.Action(createProjectVariable{Project: e.Project, Variable: v})
+			case !p.VariableEquals(v):
+				d.Action(updateProjectVariable{Project: e.Project, Variable: v})
+			}
+
+		default:
+			d.Error(fmt.Errorf("can't restore variable %s: it belongs to no group nor project", v.ID()))
+		}
+	}
+
+	return d.prioritizedActions(), d.errs.ErrorOrNil()
+}
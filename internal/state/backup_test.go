@@ -0,0 +1,119 @@
+package state_test
+
+import (
+	"os"
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/api"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/backup"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackingUpAndRestoringVariables(t *testing.T) {
+	a := assert.New(t)
+
+	defer os.Unsetenv("myenvkey")
+	defer os.Unsetenv("myenvgroupkey")
+	defer os.Unsetenv("myotherenvkey")
+
+	execute := func(actions []internal.Action) []string {
+		executed := make([]string, 0)
+		c := api.DryRunAPIClient{
+			Append: func(action string) {
+				executed = append(executed, action)
+			},
+		}
+		for _, action := range actions {
+			a.NoError(action.Execute(c))
+		}
+		return executed
+	}
+
+	a.NoError(os.Setenv("myenvkey", "oldvalue"))
+	a.NoError(os.Setenv("myenvgroupkey", "oldgroupvalue"))
+	a.NoError(os.Setenv("myotherenvkey", "oldproductionvalue"))
+	current := loadFixture(t, "fixtures/plain-with-project-with-scoped-secrets.yaml")
+
+	a.NoError(os.Setenv("myenvkey", "newvalue"))
+	desired := loadFixture(t, "fixtures/plain-with-project-pruning-secrets.yaml")
+
+	actions, err := state.Diff(current, desired, state.DiffArgs{DiffGroups: true, DiffProjects: true, Yolo: true})
+	a.NoError(err)
+
+	snapshot := state.VariablesBackup(current, actions)
+	a.False(snapshot.Created.IsZero())
+	a.Equal([]backup.Entry{
+		{
+			Group:            "other_group",
+			Key:              "mygroupkey",
+			Value:            "oldgroupvalue",
+			Protected:        true,
+			Masked:           true,
+			VariableType:     internal.EnvVariableType,
+			EnvironmentScope: internal.DefaultEnvironmentScope,
+		},
+		{
+			Project:          "root_group/a_project",
+			Key:              "mykey",
+			Value:            "oldvalue",
+			VariableType:     internal.EnvVariableType,
+			EnvironmentScope: internal.DefaultEnvironmentScope,
+		},
+		{
+			Project:          "root_group/a_project",
+			Key:              "mykey",
+			Value:            "oldproductionvalue",
+			VariableType:     internal.FileVariableType,
+			EnvironmentScope: "production",
+		},
+	}, snapshot.Variables)
+
+	restore, err := state.RestoreVariables(desired, snapshot)
+	a.NoError(err)
+	a.Equal([]string{
+		"create group variable 'mygroupkey' in 'other_group' (protected, masked)",
+		"update project variable 'mykey' in 'root_group/a_project'",
+		"create project variable 'mykey@production' in 'root_group/a_project' (file)",
+	}, execute(restore))
+
+	restore, err = state.RestoreVariables(current, snapshot)
+	a.NoError(err)
+	a.Empty(restore, "nothing to restore when the variables are still the same")
+
+	snapshot.Add("missing_group", "", internal.Variable{Key: "mykey"})
+	_, err = state.RestoreVariables(current, snapshot)
+	a.EqualError(err, "1 error: can't restore variable mykey in group missing_group: the group does not exist")
+}
+
+func TestUpdatingOnlyTheAttributesNeedsNoBackup(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(os.Setenv("myenvkey", "value"))
+	a.NoError(os.Setenv("myenvgroupkey", "groupvalue"))
+	a.NoError(os.Setenv("myotherenvkey", "productionvalue"))
+	defer os.Unsetenv("myenvkey")
+	defer os.Unsetenv("myenvgroupkey")
+	defer os.Unsetenv("myotherenvkey")
+
+	current := loadFixture(t, "fixtures/plain-with-project-with-scoped-secrets.yaml")
+	desired := loadFixture(t, "fixtures/plain-with-project-with-drifted-secrets.yaml")
+
+	actions, err := state.Diff(current, desired, state.DiffArgs{DiffGroups: true, DiffProjects: true})
+	a.NoError(err)
+
+	executed := make([]string, 0)
+	c := api.DryRunAPIClient{
+		Append: func(action string) {
+			executed = append(executed, action)
+		},
+	}
+	for _, action := range actions {
+		a.NoError(action.Execute(c))
+	}
+	a.Contains(executed, "update group variable 'mygroupkey' in 'other_group' (protected)")
+
+	a.Empty(state.VariablesBackup(current, actions).Variables)
+}
@@ -0,0 +1,128 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
+)
+
+// BlastRadius represents the limits of how destructive a list of actions is
+// allowed to be before refusing to apply it
+type BlastRadius struct {
+	// MaxRemovals is the max number of group and project memberships that can
+	// be removed in a single run, 0 means no limit
+	MaxRemovals int
+
+	// MaxRemovalPercent is the max percentage of the current members of a
+	// single group or project that can be removed, 0 means no limit
+	MaxRemovalPercent int
+}
+
+// CheckBlastRadius validates that the actions don't exceed the blast radius
+// limits when applied to the current state, returning an error with every
+// violation found
+func CheckBlastRadius(current internal.State, actions []internal.Action, limits BlastRadius) error {
+	errs := errors.New()
+	errs.Formatter = formatBlastRadius
+
+	removals := 0
+	groupRemovals := make(map[string]int)
+	projectRemovals := make(map[string]int)
+	groupMembers := make(map[string]map[string]internal.Level)
+
+	membersOf := func(group string) map[string]internal.Level {
+		members, ok := groupMembers[group]
+		if ok {
+			return members
+		}
+		members = make(map[string]internal.Level)
+		if g, ok := current.Group(group); ok {
+			for u, l := range g.GetMembers() {
+				members[u] = l
+			}
+		}
+		groupMembers[group] = members
+		return members
+	}
+
+	for _, action := range actions {
+		switch a := action.(type) {
+		case removeGroupMembership:
+			removals++
+			groupRemovals[a.Group]++
+			delete(membersOf(a.Group), a.Username)
+		case removeProjectMembership:
+			removals++
+			projectRemovals[a.Project]++
+		case addGroupMembership:
+			membersOf(a.Group)[a.Username] = a.Level
+		case changeGroupMembership:
+			membersOf(a.Group)[a.Username] = a.Level
+		}
+	}
+
+	if limits.MaxRemovals > 0 && removals > limits.MaxRemovals {
+		errs.Append(fmt.Errorf("the plan removes %d memberships, the limit is %d", removals, limits.MaxRemovals))
+	}
+
+	if limits.MaxRemovalPercent > 0 {
+		for group, count := range groupRemovals {
+			g, ok := current.Group(group)
+			if !ok {
+				continue
+			}
+			if total := len(g.GetMembers()); count*100 > total*limits.MaxRemovalPercent {
+				errs.Append(fmt.Errorf("the plan removes %d out of %d members of group '%s', the limit is %d percent",
+					count, total, group, limits.MaxRemovalPercent))
+			}
+		}
+		for project, count := range projectRemovals {
+			p, ok := current.Project(project)
+			if !ok {
+				continue
+			}
+			if total := len(p.GetMembers()); count*100 > total*limits.MaxRemovalPercent {
+				errs.Append(fmt.Errorf("the plan removes %d out of %d members of project '%s', the limit is %d percent",
+					count, total, project, limits.MaxRemovalPercent))
+			}
+		}
+	}
+
+	for group, members := range groupMembers {
+		g, ok := current.Group(group)
+		if !ok || countOwners(g.GetMembers()) == 0 {
+			continue // we can't leave without owners a group that has none
+		}
+		if countOwners(members) == 0 {
+			errs.Append(fmt.Errorf("the plan leaves group '%s' without owners", group))
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+func countOwners(members map[string]internal.Level) int {
+	owners := 0
+	for _, l := range members {
+		if l == internal.Owner {
+			owners++
+		}
+	}
+	return owners
+}
+
+func formatBlastRadius(errs []error) string {
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	buffer := bytes.NewBufferString("the plan exceeds the blast radius limits:")
+	for _, e := range errs {
+		buffer.WriteString("\n  - ")
+		buffer.WriteString(e.Error())
+	}
+	return buffer.String()
+}
@@ -0,0 +1,101 @@
+package state_test
+
+import (
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlastRadius(t *testing.T) {
+	tt := []struct {
+		name          string
+		sourceState   string
+		desiredState  string
+		limits        state.BlastRadius
+		expectedError string
+	}{
+		{
+			"no limits",
+			"fixtures/diff-root-with-multi-level-user.yaml",
+			"fixtures/diff-root-with-multi-level-admin.yaml",
+			state.BlastRadius{},
+			"",
+		},
+		{
+			"within the removals limit",
+			"fixtures/diff-root-with-multi-level-user.yaml",
+			"fixtures/diff-root-with-multi-level-admin.yaml",
+			state.BlastRadius{MaxRemovals: 4},
+			"",
+		},
+		{
+			"too many removals",
+			"fixtures/diff-root-with-multi-level-user.yaml",
+			"fixtures/diff-root-with-multi-level-admin.yaml",
+			state.BlastRadius{MaxRemovals: 3},
+			"the plan exceeds the blast radius limits:\n" +
+				"  - the plan removes 4 memberships, the limit is 3",
+		},
+		{
+			"too many members removed from a group",
+			"fixtures/diff-root-with-multi-level-user.yaml",
+			"fixtures/diff-root-with-multi-level-admin.yaml",
+			state.BlastRadius{MaxRemovalPercent: 49},
+			"the plan exceeds the blast radius limits:\n" +
+				"  - the plan removes 1 out of 2 members of group 'root_group', the limit is 49 percent\n" +
+				"  - the plan removes 1 out of 2 members of group 'root_group/subgroup1', the limit is 49 percent\n" +
+				"  - the plan removes 1 out of 2 members of group 'root_group/subgroup2', the limit is 49 percent\n" +
+				"  - the plan removes 1 out of 2 members of project 'root_group/a_project', the limit is 49 percent",
+		},
+		{
+			"half of the members removed is within the limit",
+			"fixtures/diff-root-with-multi-level-user.yaml",
+			"fixtures/diff-root-with-multi-level-admin.yaml",
+			state.BlastRadius{MaxRemovalPercent: 50},
+			"",
+		},
+		{
+			"leaving groups without owners",
+			"fixtures/diff-root-with-multi-level-user.yaml",
+			"fixtures/blast-radius-ownerless.yaml",
+			state.BlastRadius{},
+			"the plan exceeds the blast radius limits:\n" +
+				"  - the plan leaves group 'root_group' without owners\n" +
+				"  - the plan leaves group 'root_group/subgroup1' without owners",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			sourceConfig, err := util.LoadConfig(tc.sourceState, false)
+			a.NoError(err, "source config")
+
+			sourceState, err := state.LoadStateFromFile(sourceConfig, querier, resolver)
+			a.NoError(err, "source state")
+
+			desiredConfig, err := util.LoadConfig(tc.desiredState, false)
+			a.NoError(err, "desired config")
+
+			desiredState, err := state.LoadStateFromFile(desiredConfig, querier, resolver)
+			a.NoError(err, "desired state")
+
+			actions, err := state.Diff(sourceState, desiredState, state.DiffArgs{
+				DiffGroups:   true,
+				DiffProjects: true,
+			})
+			a.NoError(err, "diff")
+
+			err = state.CheckBlastRadius(sourceState, actions, tc.limits)
+			if tc.expectedError == "" {
+				a.NoError(err)
+			} else {
+				a.EqualError(err, tc.expectedError)
+			}
+		})
+	}
+}
@@ -19,6 +19,10 @@ type DiffArgs struct {
 	DiffBots     bool
 
 	Yolo bool
+
+	// PruneVariables deletes the variables that are not declared in every
+	// group and project, not only in the ones that set prune_variables
+	PruneVariables bool
 }
 
 type differ struct {
@@ -26,7 +30,8 @@ type differ struct {
 	errs             errors.Errors
 	current, desired internal.State
 
-	yolo bool
+	yolo           bool
+	pruneVariables bool
 }
 
 func (d *differ) Action(a internal.Action) {
@@ -86,6 +91,8 @@ func Diff(current, desired internal.State, args DiffArgs) ([]internal.Action, er
 		current: current,
 		desired: desired,
 		yolo:    args.Yolo,
+
+		pruneVariables: args.PruneVariables,
 	}
 
 	if args.DiffGroups {
@@ -138,6 +145,9 @@ func (d *differ) diffGroups() {
 							SharedGroup: sharedGroup,
 							Level:       sharedLevel,
 						})
+					} else if currentLevel > sharedLevel && desiredGroup.IsAdditive() {
+						logrus.Debugf("      Keeping group %s sharing as %s because group %s is additive",
+							sharedGroup, currentLevel, desiredGroup.GetFullpath())
 					} else if currentLevel != sharedLevel {
 						logrus.Debugf("      Changing group %s sharing as %s because current level is %s",
 							sharedGroup, sharedLevel, currentLevel)
@@ -145,6 +155,7 @@ func (d *differ) diffGroups() {
 						d.Action(removeGroupSharing{
 							Group:       desiredGroup.GetFullpath(),
 							SharedGroup: sharedGroup,
+							OldLevel:    currentLevel,
 						})
 
 						d.Action(shareGroupWithGroup{
@@ -165,61 +176,86 @@ func (d *differ) diffGroups() {
 				logrus.Debugf("    Member: %s", m.name)
 				desiredName := m.name
 				desiredLevel := m.level
+				desiredExpires := desiredGroup.GetExpirations()[desiredName]
 
 				currentLevel, currentMemberPresent := currentMembers[desiredName]
+				currentExpires := currentGroup.GetExpirations()[desiredName]
 				if !currentMemberPresent {
 					logrus.Debugf("  Adding %s to group %s at level %s", desiredName, desiredGroup.GetFullpath(),
 						desiredLevel)
 					d.Action(addGroupMembership{
-						Group:    desiredGroup.GetFullpath(),
-						Username: desiredName,
-						Level:    desiredLevel})
-				} else if currentLevel != desiredLevel {
-					logrus.Debugf("  Changing %s in group %s to level %s", desiredName, desiredGroup.GetFullpath(),
-						desiredLevel)
+						Group:     desiredGroup.GetFullpath(),
+						Username:  desiredName,
+						Level:     desiredLevel,
+						ExpiresAt: desiredExpires})
+				} else if currentLevel > desiredLevel && desiredGroup.IsAdditive() {
+					logrus.Debugf("  Keeping %s in group %s at level %s because the group is additive", desiredName,
+						desiredGroup.GetFullpath(), currentLevel)
+				} else if currentLevel != desiredLevel || currentExpires != desiredExpires {
+					logrus.Debugf("  Changing %s in group %s to level %s expiring on '%s'", desiredName,
+						desiredGroup.GetFullpath(), desiredLevel, desiredExpires)
 					d.Action(changeGroupMembership{
-						Group:    desiredGroup.GetFullpath(),
-						Username: desiredName,
-						Level:    desiredLevel})
+						Group:        desiredGroup.GetFullpath(),
+						Username:     desiredName,
+						OldLevel:     currentLevel,
+						Level:        desiredLevel,
+						OldExpiresAt: currentExpires,
+						ExpiresAt:    desiredExpires})
 				} else {
 					// Do nothing, there's no change
 				}
 			}
 
 			logrus.Debugf("  Processing current group %s members not in desired state", desiredGroup.GetFullpath())
-			for currentMember := range currentMembers {
+			for currentMember, currentLevel := range currentMembers {
+				if desiredGroup.IsAdditive() {
+					break // additive groups never lose members
+				}
 				if _, desiredMemberPresent := desiredMembers[currentMember]; !desiredMemberPresent {
 					logrus.Debugf("  Removing %s from group %s because it's not present in the desired state",
 						currentMember, currentGroup.GetFullpath())
-					d.Action(removeGroupMembership{Username: currentMember, Group: currentGroup.GetFullpath()})
+					d.Action(removeGroupMembership{
+						Username: currentMember,
+						Group:    currentGroup.GetFullpath(),
+						OldLevel: currentLevel,
+					})
 				}
 			}
 
 			logrus.Debugf("  Processing group %s secret vars", desiredGroup.GetFullpath())
-			for k, v := range desiredGroup.GetVariables() {
-				if !currentGroup.HasVariable(k) {
+			for id, v := range desiredGroup.GetVariables() {
+				if !currentGroup.HasVariable(id) {
 					d.Action(createGroupVariable{
-						Group: desiredGroup.GetFullpath(),
-						Key:   k,
-						Value: v,
+						Group:    desiredGroup.GetFullpath(),
+						Variable: v,
 					})
 					continue
 				}
-				if !currentGroup.VariableEquals(k, v) {
+				if !currentGroup.VariableEquals(v) {
 
-					if d.yolo {
+					// Only changing the attributes is safe, overwriting the value is not
+					if d.yolo || currentGroup.GetVariables()[id].Value == v.Value {
 						d.Action(updateGroupVariable{
-							Group: desiredGroup.GetFullpath(),
-							Key:   k,
-							Value: v,
+							Group:    desiredGroup.GetFullpath(),
+							Variable: v,
 						})
 					} else {
-						d.Error(fmt.Errorf("variable %s in group %s is not as expected", k,
+						d.Error(fmt.Errorf("variable %s in group %s is not as expected", id,
 							desiredGroup.GetFullpath()))
 					}
 				}
 			}
 
+			if d.pruneVariables || desiredGroup.PrunesVariables() {
+				logrus.Debugf("  Pruning group %s secret vars", desiredGroup.GetFullpath())
+				for _, v := range unmanagedVariables(currentGroup.GetVariables(), desiredGroup.GetVariables()) {
+					d.Action(deleteGroupVariable{
+						Group:    desiredGroup.GetFullpath(),
+						Variable: v,
+					})
+				}
+			}
+
 		} else { // !currentGroupPresent
 			logrus.Debugf("  Appending desired group %s members because the current group is not present",
 				desiredGroup.GetFullpath())
@@ -227,15 +263,15 @@ func (d *differ) diffGroups() {
 				logrus.Debugf("  Adding %s to group %s at level %s", desiredName, desiredGroup.GetFullpath(),
 					desiredLevel)
 				d.Action(addGroupMembership{
-					Group:    desiredGroup.GetFullpath(),
-					Username: desiredName,
-					Level:    desiredLevel})
+					Group:     desiredGroup.GetFullpath(),
+					Username:  desiredName,
+					Level:     desiredLevel,
+					ExpiresAt: desiredGroup.GetExpirations()[desiredName]})
 			}
-			for k, v := range desiredGroup.GetVariables() {
+			for _, v := range desiredGroup.GetVariables() {
 				d.Action(createGroupVariable{
-					Group: desiredGroup.GetFullpath(),
-					Key:   k,
-					Value: v,
+					Group:    desiredGroup.GetFullpath(),
+					Variable: v,
 				})
 			}
 		}
@@ -261,13 +297,17 @@ func (d *differ) diffProjects() {
 						Group:   desiredGroup,
 						Level:   desiredLevel,
 					})
+				} else if currentLevel > desiredLevel && desiredProject.IsAdditive() {
+					logrus.Debugf("  Keeping group %s sharing as %s because project %s is additive",
+						desiredGroup, currentLevel, desiredProject.GetFullpath())
 				} else if currentLevel != desiredLevel {
 					logrus.Debugf("  Changing group %s sharing as %s because current level is %s",
 						desiredGroup, desiredLevel, currentLevel)
 
 					d.Action(removeProjectGroupSharing{
-						Project: desiredProject.GetFullpath(),
-						Group:   desiredGroup,
+						Project:  desiredProject.GetFullpath(),
+						Group:    desiredGroup,
+						OldLevel: currentLevel,
 					})
 
 					d.Action(shareProjectWithGroup{
@@ -286,50 +326,68 @@ func (d *differ) diffProjects() {
 			currentMembers := currentProject.GetMembers()
 
 			for desiredName, desiredLevel := range desiredMembers {
+				desiredExpires := desiredProject.GetExpirations()[desiredName]
 
 				currentLevel, currentMemberPresent := currentMembers[desiredName]
+				currentExpires := currentProject.GetExpirations()[desiredName]
 				if !currentMemberPresent {
 					logrus.Debugf("  Adding project %s membership for %s as %s", desiredProject.GetFullpath(),
 						desiredName, desiredLevel)
 					d.Action(addProjectMembership{
-						Project:  desiredProject.GetFullpath(),
-						Username: desiredName,
-						Level:    desiredLevel})
-
-				} else if currentLevel != desiredLevel {
-					logrus.Debugf("  Changing project %s membership for %s to %s", desiredProject.GetFullpath(),
-						desiredName, desiredLevel)
+						Project:   desiredProject.GetFullpath(),
+						Username:  desiredName,
+						Level:     desiredLevel,
+						ExpiresAt: desiredExpires})
+
+				} else if currentLevel > desiredLevel && desiredProject.IsAdditive() {
+					logrus.Debugf("  Keeping project %s membership for %s as %s because the project is additive",
+						desiredProject.GetFullpath(), desiredName, currentLevel)
+				} else if currentLevel != desiredLevel || currentExpires != desiredExpires {
+					logrus.Debugf("  Changing project %s membership for %s to %s expiring on '%s'",
+						desiredProject.GetFullpath(), desiredName, desiredLevel, desiredExpires)
 					d.Action(changeProjectMembership{
-						Project:  desiredProject.GetFullpath(),
-						Username: desiredName,
-						Level:    desiredLevel})
+						Project:      desiredProject.GetFullpath(),
+						Username:     desiredName,
+						OldLevel:     currentLevel,
+						Level:        desiredLevel,
+						OldExpiresAt: currentExpires,
+						ExpiresAt:    desiredExpires})
 				}
 
 			}
 			logrus.Debugf("  Processing project %s secret vars", desiredProject.GetFullpath())
-			for k, v := range desiredProject.GetVariables() {
-				if !currentProject.HasVariable(k) {
+			for id, v := range desiredProject.GetVariables() {
+				if !currentProject.HasVariable(id) {
 					d.Action(createProjectVariable{
-						Project: desiredProject.GetFullpath(),
-						Key:     k,
-						Value:   v,
+						Project:  desiredProject.GetFullpath(),
+						Variable: v,
 					})
 					continue
 				}
-				if !currentProject.VariableEquals(k, v) {
-					if d.yolo {
+				if !currentProject.VariableEquals(v) {
+					// Only changing the attributes is safe, overwriting the value is not
+					if d.yolo || currentProject.GetVariables()[id].Value == v.Value {
 						d.Action(updateProjectVariable{
-							Project: desiredProject.GetFullpath(),
-							Key:     k,
-							Value:   v,
+							Project:  desiredProject.GetFullpath(),
+							Variable: v,
 						})
 					} else {
-						d.Error(fmt.Errorf("variable %s in project %s is not as expected", k,
+						d.Error(fmt.Errorf("variable %s in project %s is not as expected", id,
 							desiredProject.GetFullpath()))
 					}
 				}
 			}
 
+			if d.pruneVariables || desiredProject.PrunesVariables() {
+				logrus.Debugf("  Pruning project %s secret vars", desiredProject.GetFullpath())
+				for _, v := range unmanagedVariables(currentProject.GetVariables(), desiredProject.GetVariables()) {
+					d.Action(deleteProjectVariable{
+						Project:  desiredProject.GetFullpath(),
+						Variable: v,
+					})
+				}
+			}
+
 		} else { // currentProject not present
 			logrus.Debugf("  Appending project %s because current state is not present", desiredProject.GetFullpath())
 
@@ -348,17 +406,17 @@ func (d *differ) diffProjects() {
 				logrus.Debugf("  Adding project %s membership for %s as %s", desiredProject.GetFullpath(),
 					desiredName, desiredLevel)
 				d.Action(addProjectMembership{
-					Username: desiredName,
-					Project:  desiredProject.GetFullpath(),
-					Level:    desiredLevel,
+					Username:  desiredName,
+					Project:   desiredProject.GetFullpath(),
+					Level:     desiredLevel,
+					ExpiresAt: desiredProject.GetExpirations()[desiredName],
 				})
 			}
 
-			for k, v := range desiredProject.GetVariables() {
+			for _, v := range desiredProject.GetVariables() {
 				d.Action(createProjectVariable{
-					Project: desiredProject.GetFullpath(),
-					Key:     k,
-					Value:   v,
+					Project:  desiredProject.GetFullpath(),
+					Variable: v,
 				})
 			}
 		}
@@ -372,20 +430,26 @@ func (d *differ) diffProjects() {
 				currentProject.GetFullpath())
 			continue
 		}
+		if desiredProject.IsAdditive() {
+			logrus.Debugf("Skipping removals in current project '%s' because it's additive in desired state",
+				currentProject.GetFullpath())
+			continue
+		}
 
-		for group := range currentProject.GetSharedGroups() {
+		for group, currentLevel := range currentProject.GetSharedGroups() {
 			if _, desiredGroupPresent := desiredProject.GetGroupLevel(group); !desiredGroupPresent {
 				logrus.Debugf("  Removing project %s sharing with group %s because project is not in the desired state",
 					currentProject.GetFullpath(), group)
 
 				d.Action(removeProjectGroupSharing{
-					Project: currentProject.GetFullpath(),
-					Group:   group,
+					Project:  currentProject.GetFullpath(),
+					Group:    group,
+					OldLevel: currentLevel,
 				})
 			}
 		}
 
-		for member := range currentProject.GetMembers() {
+		for member, currentLevel := range currentProject.GetMembers() {
 			_, memberPresent := desiredProject.GetMembers()[member]
 			if !memberPresent {
 				logrus.Debugf("  Removing project %s membership for %s because member is not in the desired state",
@@ -394,6 +458,7 @@ func (d *differ) diffProjects() {
 				d.Action(removeProjectMembership{
 					Project:  currentProject.GetFullpath(),
 					Username: member,
+					OldLevel: currentLevel,
 				})
 			}
 		}
@@ -490,6 +555,7 @@ func (shareGroupWithGroup) Priority() internal.ActionPriority {
 type removeGroupSharing struct {
 	Group       string
 	SharedGroup string
+	OldLevel    internal.Level
 }
 
 func (r removeGroupSharing) Execute(c internal.APIClient) error {
@@ -501,13 +567,16 @@ func (removeGroupSharing) Priority() internal.ActionPriority {
 }
 
 type changeGroupMembership struct {
-	Username string
-	Group    string
-	Level    internal.Level
+	Username     string
+	Group        string
+	OldLevel     internal.Level
+	Level        internal.Level
+	OldExpiresAt string
+	ExpiresAt    string
 }
 
 func (s changeGroupMembership) Execute(c internal.APIClient) error {
-	return c.ChangeGroupMembership(s.Username, s.Group, s.Level)
+	return c.ChangeGroupMembership(s.Username, s.Group, s.Level, s.ExpiresAt)
 }
 
 func (changeGroupMembership) Priority() internal.ActionPriority {
@@ -515,13 +584,14 @@ func (changeGroupMembership) Priority() internal.ActionPriority {
 }
 
 type addGroupMembership struct {
-	Username string
-	Group    string
-	Level    internal.Level
+	Username  string
+	Group     string
+	Level     internal.Level
+	ExpiresAt string
 }
 
 func (s addGroupMembership) Execute(c internal.APIClient) error {
-	return c.AddGroupMembership(s.Username, s.Group, s.Level)
+	return c.AddGroupMembership(s.Username, s.Group, s.Level, s.ExpiresAt)
 }
 
 func (addGroupMembership) Priority() internal.ActionPriority {
@@ -531,6 +601,7 @@ func (addGroupMembership) Priority() internal.ActionPriority {
 type removeGroupMembership struct {
 	Username string
 	Group    string
+	OldLevel internal.Level
 }
 
 func (r removeGroupMembership) Execute(c internal.APIClient) error {
@@ -542,13 +613,12 @@ func (removeGroupMembership) Priority() internal.ActionPriority {
 }
 
 type createGroupVariable struct {
-	Group string
-	Key   string
-	Value string
+	Group    string
+	Variable internal.Variable
 }
 
 func (p createGroupVariable) Execute(c internal.APIClient) error {
-	return c.CreateGroupVariable(p.Group, p.Key, p.Value)
+	return c.CreateGroupVariable(p.Group, p.Variable)
 }
 
 func (createGroupVariable) Priority() internal.ActionPriority {
@@ -556,19 +626,31 @@ func (createGroupVariable) Priority() internal.ActionPriority {
 }
 
 type updateGroupVariable struct {
-	Group string
-	Key   string
-	Value string
+	Group    string
+	Variable internal.Variable
 }
 
 func (p updateGroupVariable) Execute(c internal.APIClient) error {
-	return c.UpdateGroupVariable(p.Group, p.Key, p.Value)
+	return c.UpdateGroupVariable(p.Group, p.Variable)
 }
 
 func (updateGroupVariable) Priority() internal.ActionPriority {
 	return internal.ManageGroupVariables
 }
 
+type deleteGroupVariable struct {
+	Group    string
+	Variable internal.Variable
+}
+
+func (p deleteGroupVariable) Execute(c internal.APIClient) error {
+	return c.DeleteGroupVariable(p.Group, p.Variable)
+}
+
+func (deleteGroupVariable) Priority() internal.ActionPriority {
+	return internal.ManageGroupVariables
+}
+
 type shareProjectWithGroup struct {
 	Project string
 	Group   string
@@ -584,8 +666,9 @@ func (shareProjectWithGroup) Priority() internal.ActionPriority {
 }
 
 type removeProjectGroupSharing struct {
-	Project string
-	Group   string
+	Project  string
+	Group    string
+	OldLevel internal.Level
 }
 
 func (r removeProjectGroupSharing) Execute(c internal.APIClient) error {
@@ -597,13 +680,14 @@ func (removeProjectGroupSharing) Priority() internal.ActionPriority {
 }
 
 type addProjectMembership struct {
-	Project  string
-	Username string
-	Level    internal.Level
+	Project   string
+	Username  string
+	Level     internal.Level
+	ExpiresAt string
 }
 
 func (r addProjectMembership) Execute(c internal.APIClient) error {
-	return c.AddProjectMembership(r.Username, r.Project, r.Level)
+	return c.AddProjectMembership(r.Username, r.Project, r.Level, r.ExpiresAt)
 }
 
 func (addProjectMembership) Priority() internal.ActionPriority {
@@ -611,13 +695,16 @@ func (addProjectMembership) Priority() internal.ActionPriority {
 }
 
 type changeProjectMembership struct {
-	Project  string
-	Username string
-	Level    internal.Level
+	Project      string
+	Username     string
+	OldLevel     internal.Level
+	Level        internal.Level
+	OldExpiresAt string
+	ExpiresAt    string
 }
 
 func (r changeProjectMembership) Execute(c internal.APIClient) error {
-	return c.ChangeProjectMembership(r.Username, r.Project, r.Level)
+	return c.ChangeProjectMembership(r.Username, r.Project, r.Level, r.ExpiresAt)
 }
 
 func (changeProjectMembership) Priority() internal.ActionPriority {
@@ -627,6 +714,7 @@ func (changeProjectMembership) Priority() internal.ActionPriority {
 type removeProjectMembership struct {
 	Project  string
 	Username string
+	OldLevel internal.Level
 }
 
 func (r removeProjectMembership) Execute(c internal.APIClient) error {
@@ -638,13 +726,12 @@ func (removeProjectMembership) Priority() internal.ActionPriority {
 }
 
 type createProjectVariable struct {
-	Project string
-	Key     string
-	Value   string
+	Project  string
+	Variable internal.Variable
 }
 
 func (p createProjectVariable) Execute(c internal.APIClient) error {
-	return c.CreateProjectVariable(p.Project, p.Key, p.Value)
+	return c.CreateProjectVariable(p.Project, p.Variable)
 }
 
 func (createProjectVariable) Priority() internal.ActionPriority {
@@ -652,19 +739,31 @@ func (createProjectVariable) Priority() internal.ActionPriority {
 }
 
 type updateProjectVariable struct {
-	Project string
-	Key     string
-	Value   string
+	Project  string
+	Variable internal.Variable
 }
 
 func (p updateProjectVariable) Execute(c internal.APIClient) error {
-	return c.UpdateProjectVariable(p.Project, p.Key, p.Value)
+	return c.UpdateProjectVariable(p.Project, p.Variable)
 }
 
 func (updateProjectVariable) Priority() internal.ActionPriority {
 	return internal.ManageProjectVariables
 }
 
+type deleteProjectVariable struct {
+	Project  string
+	Variable internal.Variable
+}
+
+func (p deleteProjectVariable) Execute(c internal.APIClient) error {
+	return c.DeleteProjectVariable(p.Project, p.Variable)
+}
+
+func (deleteProjectVariable) Priority() internal.ActionPriority {
+	return internal.ManageProjectVariables
+}
+
 type setAdminUser struct {
 	Username string
 }
@@ -744,6 +843,28 @@ type member struct {
 	level internal.Level
 }
 
+// unmanagedVariables returns the current variables that are not declared,
+// sorted by id. Only the key and the scope are kept, values are not needed to
+// delete them.
+func unmanagedVariables(current, desired map[string]internal.Variable) []internal.Variable {
+	ids := make([]string, 0)
+	for id := range current {
+		if _, ok := desired[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	variables := make([]internal.Variable, 0, len(ids))
+	for _, id := range ids {
+		variables = append(variables, internal.Variable{
+			Key:              current[id].Key,
+			EnvironmentScope: current[id].EnvironmentScope,
+		})
+	}
+	return variables
+}
+
 func sortedMembers(members map[string]internal.Level) []member {
 	sorted := make([]member, 0)
 	for name, level := range members {
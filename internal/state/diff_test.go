@@ -4,7 +4,9 @@ import (
 	"os"
 	"testing"
 
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
 	"gitlab.com/yakshaving.art/hurrdurr/internal/api"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/secrets"
 	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
 	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
 
@@ -35,13 +37,28 @@ var querier = querierMock{
 	},
 }
 
+var resolver = secrets.NewResolver("", true)
+
+// loadFixture loads the state of a configuration fixture with the querier
+// and the resolver of the tests
+func loadFixture(t *testing.T, filename string) internal.State {
+	t.Helper()
+
+	c, err := util.LoadConfig(filename, false)
+	assert.NoError(t, err, filename)
+
+	s, err := state.LoadStateFromFile(c, querier, resolver)
+	assert.NoError(t, err, filename)
+	return s
+}
+
 func TestDiffWithoutOneStateFails(t *testing.T) {
 	a := assert.New(t)
 
 	c, err := util.LoadConfig("fixtures/plain.yaml", false)
 	a.NoError(err)
 
-	s, err := state.LoadStateFromFile(c, querier)
+	s, err := state.LoadStateFromFile(c, querier, resolver)
 	a.NoError(err)
 
 	_, err = state.Diff(nil, s, state.DiffArgs{})
@@ -57,13 +74,13 @@ func TestDiffRemovingCurrentAdminUserFails(t *testing.T) {
 	sourceConfig, err := util.LoadConfig("fixtures/plain-with-admins.yaml", false)
 	a.NoError(err)
 
-	sourceState, err := state.LoadStateFromFile(sourceConfig, querier)
+	sourceState, err := state.LoadStateFromFile(sourceConfig, querier, resolver)
 	a.NoError(err)
 
 	desiredConfig, err := util.LoadConfig("fixtures/plain-without-current-user.yaml", false)
 	a.NoError(err)
 
-	desiredState, err := state.LoadStateFromFile(desiredConfig, querier)
+	desiredState, err := state.LoadStateFromFile(desiredConfig, querier, resolver)
 	a.NoError(err)
 
 	_, err = state.Diff(sourceState, desiredState, state.DiffArgs{
@@ -202,6 +219,57 @@ func TestDiffingStates(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"additive entries never remove or downgrade",
+			"fixtures/plain-with-other-levels-project.yaml",
+			"fixtures/plain-with-additive-project.yaml",
+			[]string{
+				"share project 'root_group/a_project' with group 'other_group' at level 'Developer'",
+			},
+			true,
+		},
+		{
+			"additive entries still add members",
+			"fixtures/plain-minimal.yaml",
+			"fixtures/plain-with-additive-project.yaml",
+			[]string{
+				"add 'user2' to 'other_group' at level 'Owner'",
+				"share project 'root_group/a_project' with group 'other_group' at level 'Developer'",
+				"add 'user2' to 'root_group/a_project' at level 'Developer'",
+				"add 'admin' to 'root_group/a_project' at level 'Maintainer'",
+			},
+			false,
+		},
+		{
+			"setting expiration dates",
+			"fixtures/plain-without-expiring-members.yaml",
+			"fixtures/plain-with-expiring-members.yaml",
+			[]string{
+				"change 'user1' in 'root_group' at level 'Developer' until 2099-12-31",
+				"change 'user3' in 'root_group/a_project' to level 'Reporter' until 2099-06-30",
+			},
+			false,
+		},
+		{
+			"removing expiration dates",
+			"fixtures/plain-with-expiring-members.yaml",
+			"fixtures/plain-without-expiring-members.yaml",
+			[]string{
+				"change 'user1' in 'root_group' at level 'Developer'",
+				"change 'user3' in 'root_group/a_project' to level 'Reporter'",
+			},
+			false,
+		},
+		{
+			"adding expiring members",
+			"fixtures/plain-minimal.yaml",
+			"fixtures/plain-with-expiring-members.yaml",
+			[]string{
+				"add 'user1' to 'root_group' at level 'Developer' until 2099-12-31",
+				"add 'user3' to 'root_group/a_project' at level 'Reporter' until 2099-06-30",
+			},
+			false,
+		},
 		{
 			"plain project permissions without changes",
 			"fixtures/plain-with-project.yaml",
@@ -276,13 +344,13 @@ func TestDiffingStates(t *testing.T) {
 			sourceConfig, err := util.LoadConfig(tc.sourceState, false)
 			a.NoError(err, "source config")
 
-			sourceState, err := state.LoadStateFromFile(sourceConfig, querier)
+			sourceState, err := state.LoadStateFromFile(sourceConfig, querier, resolver)
 			a.NoError(err, "source state")
 
 			desiredConfig, err := util.LoadConfig(tc.desiredState, false)
 			a.NoError(err, "desired config")
 
-			desiredState, err := state.LoadStateFromFile(desiredConfig, querier)
+			desiredState, err := state.LoadStateFromFile(desiredConfig, querier, resolver)
 			a.NoError(err, "desired state")
 
 			actions, err := state.Diff(sourceState, desiredState, state.DiffArgs{
@@ -331,12 +399,91 @@ func TestLoadingStateWithoutEnvironmentSetFails(t *testing.T) {
 	desiredConfig, err := util.LoadConfig("fixtures/plain-with-project-with-secrets.yaml", false)
 	a.NoError(err, "desired config")
 
-	_, err = state.LoadStateFromFile(desiredConfig, querier)
+	_, err = state.LoadStateFromFile(desiredConfig, querier, resolver)
 	a.EqualError(err, "failed to build local state: 2 errors: "+
+		"fixtures/plain-with-project-with-secrets.yaml:7:7: "+
 		"Group contains secret 'mygroupkey'='myenvgroupkey' which is not loaded in the environment; "+
+		"fixtures/plain-with-project-with-secrets.yaml:16:7: "+
 		"Project contains secret 'mykey'='myenvkey' which is not loaded in the environment")
 }
 
+func TestLoadingStateResolvesSecretSources(t *testing.T) {
+	a := assert.New(t)
+
+	desiredConfig, err := util.LoadConfig("fixtures/plain-with-project-with-secret-sources.yaml", false)
+	a.NoError(err, "desired config")
+
+	_, err = state.LoadStateFromFile(desiredConfig, querier, resolver)
+	a.EqualError(err, "failed to build local state: 2 errors: "+
+		"fixtures/plain-with-project-with-secret-sources.yaml:17:7: "+
+		"Project contains secret 'myotherkey'='file:missing.txt' which can't be read: "+
+		"open fixtures/missing.txt: no such file or directory; "+
+		"fixtures/plain-with-project-with-secret-sources.yaml:18:7: "+
+		"Project contains secret 'mylastkey'='vault:secret/data/key' which uses an unknown source type 'vault', "+
+		"use one of age, env, exec, file")
+
+	delete(desiredConfig.Projects["root_group/a_project"].Variables, "myotherkey")
+	delete(desiredConfig.Projects["root_group/a_project"].Variables, "mylastkey")
+
+	desiredState, err := state.LoadStateFromFile(desiredConfig, querier, resolver)
+	a.NoError(err)
+
+	group, ok := desiredState.Group("other_group")
+	a.True(ok)
+	a.Equal("filevalue", group.GetVariables()["mygroupkey"].Value)
+
+	project, ok := desiredState.Project("root_group/a_project")
+	a.True(ok)
+	a.Equal("execvalue", project.GetVariables()["mykey"].Value)
+}
+
+func TestPruningVariables(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(os.Setenv("myenvkey", "value"))
+	a.NoError(os.Setenv("myenvgroupkey", "othervalue"))
+	a.NoError(os.Setenv("myotherenvkey", "productionvalue"))
+	defer os.Setenv("myenvkey", "")
+	defer os.Setenv("myenvgroupkey", "")
+	defer os.Setenv("myotherenvkey", "")
+
+	diff := func(current, desired internal.State, prune bool) []string {
+		actions, err := state.Diff(current, desired, state.DiffArgs{
+			DiffGroups:     true,
+			DiffProjects:   true,
+			PruneVariables: prune,
+		})
+		a.NoError(err)
+
+		executedActions := make([]string, 0)
+		c := api.DryRunAPIClient{
+			Append: func(action string) {
+				executedActions = append(executedActions, action)
+			},
+		}
+		for _, action := range actions {
+			a.NoError(action.Execute(c))
+		}
+		return executedActions
+	}
+
+	current := loadFixture(t, "fixtures/plain-with-project-with-scoped-secrets.yaml")
+
+	a.Equal([]string{
+		"!!! DELETE group variable 'mygroupkey' in 'other_group'",
+		"!!! DELETE project variable 'mykey@production' in 'root_group/a_project'",
+	}, diff(current, loadFixture(t, "fixtures/plain-with-project-pruning-secrets.yaml"), false))
+
+	a.Equal([]string{}, diff(current, loadFixture(t, "fixtures/plain-with-project-without-variables.yaml"), false),
+		"variables are not pruned unless asked to")
+
+	a.Equal([]string{
+		"!!! DELETE group variable 'mygroupkey' in 'other_group'",
+		"!!! DELETE project variable 'mykey' in 'root_group/a_project'",
+		"!!! DELETE project variable 'mykey@production' in 'root_group/a_project'",
+	}, diff(current, loadFixture(t, "fixtures/plain-with-project-without-variables.yaml"), true))
+}
+
 func TestDiffingVariablesWorksAsExpected(t *testing.T) {
 	tt := []struct {
 		name           string
@@ -428,6 +575,48 @@ func TestDiffingVariablesWorksAsExpected(t *testing.T) {
 			"2 errors: variable mygroupkey in group other_group is not as expected; " +
 				"variable mykey in project root_group/a_project is not as expected",
 		},
+		{
+			"update variable attributes without yolo mode and create scoped variables",
+			"fixtures/plain-with-project-with-secrets.yaml",
+			"fixtures/plain-with-project-with-scoped-secrets.yaml",
+			[]string{
+				"update group variable 'mygroupkey' in 'other_group' (protected, masked)",
+				"create project variable 'mykey@production' in 'root_group/a_project' (file)",
+			},
+			map[string]string{
+				"myenvkey":      "value",
+				"myenvgroupkey": "othervalue",
+				"myotherenvkey": "productionvalue",
+			},
+			false,
+			"",
+		},
+		{
+			"attributes the configuration doesn't set are left as they are",
+			"fixtures/plain-with-project-with-scoped-secrets.yaml",
+			"fixtures/plain-with-project-with-secrets.yaml",
+			[]string{},
+			map[string]string{
+				"myenvkey":      "value",
+				"myenvgroupkey": "othervalue",
+				"myotherenvkey": "productionvalue",
+			},
+			false,
+			"",
+		},
+		{
+			"scoped variables are the same",
+			"fixtures/plain-with-project-with-scoped-secrets.yaml",
+			"fixtures/plain-with-project-with-scoped-secrets.yaml",
+			[]string{},
+			map[string]string{
+				"myenvkey":      "value",
+				"myenvgroupkey": "othervalue",
+				"myotherenvkey": "productionvalue",
+			},
+			false,
+			"",
+		},
 	}
 
 	for _, tc := range tt {
@@ -444,13 +633,13 @@ func TestDiffingVariablesWorksAsExpected(t *testing.T) {
 			sourceConfig, err := util.LoadConfig(tc.sourceState, false)
 			a.NoError(err, "source config")
 
-			sourceState, err := state.LoadStateFromFile(sourceConfig, querier)
+			sourceState, err := state.LoadStateFromFile(sourceConfig, querier, resolver)
 			a.NoError(err, "source state")
 
 			desiredConfig, err := util.LoadConfig(tc.desiredState, false)
 			a.NoError(err, "desired config")
 
-			desiredState, err := state.LoadStateFromFile(desiredConfig, querier)
+			desiredState, err := state.LoadStateFromFile(desiredConfig, querier, resolver)
 			a.NoError(err, "desired state")
 
 			actions, err := state.Diff(sourceState, desiredState, state.DiffArgs{
@@ -0,0 +1,239 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Provenance is an entry of the configuration that gives a level to a member
+type Provenance struct {
+	Level internal.Level
+
+	// Entry is the username, query or sharing as written in the configuration
+	Entry   string
+	Expires string
+
+	// Teams is the chain of teams the entry is included through
+	Teams []string
+
+	// File is the file the entry is written in, when known
+	File string
+
+	references []queryReference
+}
+
+func (p Provenance) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s from '%s'", p.Level, p.Entry)
+	if p.Expires != "" {
+		fmt.Fprintf(b, " until %s", p.Expires)
+	}
+	if len(p.Teams) > 0 {
+		fmt.Fprintf(b, " through team %s", strings.Join(p.Teams, " -> "))
+	}
+	if p.File != "" {
+		fmt.Fprintf(b, " in %s", p.File)
+	}
+	return b.String()
+}
+
+// Membership is the level of a user in a group or project along with the
+// entries that gave it
+type Membership struct {
+	Group   string
+	Project string
+	Level   internal.Level
+	Reasons []Reason
+}
+
+// Reason is an entry that gives a level to a member along with the
+// memberships it derives from, the ones a query matched on or the group a
+// project is shared with
+type Reason struct {
+	Provenance
+	Via []Membership
+}
+
+func (m Membership) String() string {
+	b := &strings.Builder{}
+	m.write(b, "")
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (m Membership) write(b *strings.Builder, indent string) {
+	if m.Group != "" {
+		fmt.Fprintf(b, "%sgroup '%s' %s\n", indent, m.Group, m.Level)
+	} else {
+		fmt.Fprintf(b, "%sproject '%s' %s\n", indent, m.Project, m.Level)
+	}
+	for _, r := range m.Reasons {
+		fmt.Fprintf(b, "%s  %s\n", indent, r.Provenance)
+		for _, v := range r.Via {
+			v.write(b, indent+"    ")
+		}
+	}
+}
+
+// Explain loads the configuration recording where every member comes from
+// and returns the memberships of the user in every group and project, or
+// only in the one with the given path. Errors in the configuration are only
+// logged, as the memberships may not depend on them.
+func Explain(c internal.Config, querier internal.Querier, username, path string) ([]Membership, error) {
+	l, err := configToLocalState(c, querier, nil, true)
+	if err != nil {
+		logrus.Warnf("the configuration has errors, the explanation may be incomplete: %s", err)
+	}
+
+	_, isGroup := l.groups[path]
+	_, isProject := l.projects[path]
+	if path != "" && !isGroup && !isProject {
+		return nil, fmt.Errorf("'%s' is not a group or project in the configuration", path)
+	}
+
+	e := explainer{
+		state:    l,
+		origins:  c.Origins,
+		username: username,
+		visiting: make(map[string]bool),
+	}
+
+	groups := make([]string, 0, len(l.groups))
+	for g := range l.groups {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	projects := make([]string, 0, len(l.projects))
+	for p := range l.projects {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+
+	memberships := make([]Membership, 0)
+	for _, g := range groups {
+		if path != "" && path != g {
+			continue
+		}
+		if m, ok := e.group(g); ok {
+			memberships = append(memberships, m)
+		}
+	}
+	for _, p := range projects {
+		if path != "" && path != p {
+			continue
+		}
+		if m, ok := e.project(p); ok {
+			memberships = append(memberships, m)
+		}
+	}
+	return memberships, nil
+}
+
+type explainer struct {
+	state    localState
+	origins  internal.Origins
+	username string
+
+	// visiting protects from following the same group or project twice in
+	// a chain
+	visiting map[string]bool
+}
+
+func (e explainer) group(fullpath string) (Membership, bool) {
+	g, ok := e.state.groups[fullpath]
+	if !ok || e.visiting[groupNode(fullpath)] {
+		return Membership{}, false
+	}
+	level, ok := g.Members[e.username]
+	if !ok {
+		return Membership{}, false
+	}
+
+	e.visiting[groupNode(fullpath)] = true
+	defer delete(e.visiting, groupNode(fullpath))
+
+	return Membership{
+		Group:   fullpath,
+		Level:   level,
+		Reasons: e.reasons(g.Provenance[e.username]),
+	}, true
+}
+
+// project explains the membership in a project, including the one that
+// comes from the groups it is shared with
+func (e explainer) project(fullpath string) (Membership, bool) {
+	p, ok := e.state.projects[fullpath]
+	if !ok || e.visiting[projectNode(fullpath)] {
+		return Membership{}, false
+	}
+
+	e.visiting[projectNode(fullpath)] = true
+	defer delete(e.visiting, projectNode(fullpath))
+
+	m := Membership{
+		Project: fullpath,
+		Reasons: e.reasons(p.Provenance[e.username]),
+	}
+	level, ok := p.Members[e.username]
+	m.Level = level
+
+	shared := make([]string, 0, len(p.SharedGroups))
+	for g := range p.SharedGroups {
+		shared = append(shared, g)
+	}
+	sort.Strings(shared)
+	for _, g := range shared {
+		gm, member := e.group(g)
+		if !member {
+			continue
+		}
+		l := p.SharedGroups[g]
+		if gm.Level < l {
+			l = gm.Level
+		}
+		m.Reasons = append(m.Reasons, Reason{
+			Provenance: Provenance{
+				Level: l,
+				Entry: "share_with: " + g,
+				File:  e.origins.Projects[fullpath],
+			},
+			Via: []Membership{gm},
+		})
+		if l > m.Level {
+			m.Level = l
+		}
+		ok = true
+	}
+	return m, ok
+}
+
+func (e explainer) reasons(provenance []Provenance) []Reason {
+	reasons := make([]Reason, 0, len(provenance))
+	for _, p := range provenance {
+		r := Reason{Provenance: p}
+		seen := make(map[queryReference]bool)
+		for _, ref := range p.references {
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+
+			var m Membership
+			var ok bool
+			if ref.project {
+				m, ok = e.project(ref.path)
+			} else {
+				m, ok = e.group(ref.path)
+			}
+			if ok {
+				r.Via = append(r.Via, m)
+			}
+		}
+		reasons = append(reasons, r)
+	}
+	return reasons
+}
@@ -0,0 +1,57 @@
+package state_test
+
+import (
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainingMemberships(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := util.LoadConfig("fixtures/explain.yaml", false)
+	a.NoError(err)
+
+	memberships, err := state.Explain(c, querier, "user1", "")
+	a.NoError(err)
+
+	explained := make([]string, 0)
+	for _, m := range memberships {
+		explained = append(explained, m.String())
+	}
+	a.Equal([]string{
+		"group 'root_group' Developer\n" +
+			"  Developer from 'user1' in fixtures/explain.yaml\n" +
+			"  Developer from 'user1' through team sre -> oncall in fixtures/explain-teams.yaml",
+		"group 'skrrty' Maintainer\n" +
+			"  Maintainer from 'query: developers in root_group and not admins' in fixtures/explain.yaml\n" +
+			"    group 'root_group' Developer\n" +
+			"      Developer from 'user1' in fixtures/explain.yaml\n" +
+			"      Developer from 'user1' through team sre -> oncall in fixtures/explain-teams.yaml",
+		"project 'root_group/a_project' Developer\n" +
+			"  Reporter from 'user1' in fixtures/explain.yaml\n" +
+			"  Developer from 'share_with: skrrty' in fixtures/explain.yaml\n" +
+			"    group 'skrrty' Maintainer\n" +
+			"      Maintainer from 'query: developers in root_group and not admins' in fixtures/explain.yaml\n" +
+			"        group 'root_group' Developer\n" +
+			"          Developer from 'user1' in fixtures/explain.yaml\n" +
+			"          Developer from 'user1' through team sre -> oncall in fixtures/explain-teams.yaml",
+	}, explained)
+
+	memberships, err = state.Explain(c, querier, "user2", "root_group")
+	a.NoError(err)
+	a.Len(memberships, 1)
+	a.Equal("group 'root_group' Developer\n"+
+		"  Developer from 'user2' until 2100-01-01 through team sre -> oncall in fixtures/explain-teams.yaml",
+		memberships[0].String())
+
+	memberships, err = state.Explain(c, querier, "user3", "")
+	a.NoError(err)
+	a.Empty(memberships)
+
+	_, err = state.Explain(c, querier, "user1", "other_group")
+	a.EqualError(err, "'other_group' is not a group or project in the configuration")
+}
@@ -0,0 +1,120 @@
+package state
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+)
+
+// Fingerprint calculates a hash of the parts of the current state that are
+// managed by the desired state: the groups and projects it declares, and the
+// admin and blocked users. The variables of the desired state are included
+// too, as their values are read from the secret sources and not from the
+// configuration.
+//
+// Variable values are added as an HMAC-SHA256 keyed with the salt, so the
+// fingerprint can't be used to guess them without it.
+func Fingerprint(current, desired internal.State, salt []byte) string {
+	h := sha256.New()
+
+	writeLevels := func(prefix string, levels map[string]internal.Level) {
+		keys := make([]string, 0, len(levels))
+		for k := range levels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "%s:%s=%d\n", prefix, k, levels[k])
+		}
+	}
+	writeExpirations := func(expirations map[string]string) {
+		keys := make([]string, 0, len(expirations))
+		for k := range expirations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "expires:%s=%s\n", k, expirations[k])
+		}
+	}
+	writeVariables := func(prefix string, variables map[string]internal.Variable) {
+		keys := make([]string, 0, len(variables))
+		for k := range variables {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := variables[k]
+			value := hmac.New(sha256.New, salt)
+			value.Write([]byte(v.Value))
+			fmt.Fprintf(h, "%s:%s=%x protected=%s masked=%s type=%s\n", prefix, k, value.Sum(nil),
+				attribute(v.Protected), attribute(v.Masked), v.VariableType)
+		}
+	}
+	writeList := func(prefix string, list []string) {
+		sorted := append([]string{}, list...)
+		sort.Strings(sorted)
+		for _, e := range sorted {
+			fmt.Fprintf(h, "%s:%s\n", prefix, e)
+		}
+	}
+
+	groups := make([]string, 0)
+	for _, g := range desired.Groups() {
+		groups = append(groups, g.GetFullpath())
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		d, _ := desired.Group(name)
+		writeVariables("desired variable", d.GetVariables())
+
+		g, ok := current.Group(name)
+		if !ok {
+			fmt.Fprintf(h, "missing group %s\n", name)
+			continue
+		}
+		fmt.Fprintf(h, "group %s\n", name)
+		writeLevels("member", g.GetMembers())
+		writeExpirations(g.GetExpirations())
+		writeLevels("shared", g.GetSharedGroups())
+		writeVariables("variable", g.GetVariables())
+	}
+
+	projects := make([]string, 0)
+	for _, p := range desired.Projects() {
+		projects = append(projects, p.GetFullpath())
+	}
+	sort.Strings(projects)
+	for _, name := range projects {
+		d, _ := desired.Project(name)
+		writeVariables("desired variable", d.GetVariables())
+
+		p, ok := current.Project(name)
+		if !ok {
+			fmt.Fprintf(h, "missing project %s\n", name)
+			continue
+		}
+		fmt.Fprintf(h, "project %s\n", name)
+		writeLevels("member", p.GetMembers())
+		writeExpirations(p.GetExpirations())
+		writeLevels("shared", p.GetSharedGroups())
+		writeVariables("variable", p.GetVariables())
+	}
+
+	writeList("admin", current.Admins())
+	writeList("blocked", current.Blocked())
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// attribute writes the attributes the desired state doesn't set as unset
+func attribute(b *bool) string {
+	if b == nil {
+		return "unset"
+	}
+	return fmt.Sprintf("%t", *b)
+}
@@ -0,0 +1,140 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// expansion is the groups or projects of the configuration with the patterns
+// replaced by the paths they match
+type expansion struct {
+	acls    map[string]internal.Acls
+	origins map[string]string
+
+	// patterns holds the pattern each expanded path matched
+	patterns map[string]string
+}
+
+// expandPatterns replaces the pattern keys with the existing paths they
+// match. An explicit entry always wins over a pattern, and among patterns the
+// one with more literal characters wins, and then the one without "**".
+// Patterns that match the same path with the same precedence are an error.
+func expandPatterns(kind string, entries map[string]internal.Acls, origins map[string]string,
+	positions map[string]internal.EntryPositions, paths []string, errs *errors.Errors) expansion {
+	e := expansion{
+		acls:     make(map[string]internal.Acls, len(entries)),
+		origins:  make(map[string]string, len(origins)),
+		patterns: make(map[string]string),
+	}
+
+	patterns := make([]string, 0)
+	for key, acls := range entries {
+		if util.IsPathPattern(key) {
+			patterns = append(patterns, key)
+			continue
+		}
+		e.acls[key] = acls
+		if origin, ok := origins[key]; ok {
+			e.origins[key] = origin
+		}
+	}
+	if len(patterns) == 0 {
+		return e
+	}
+	sort.Strings(patterns)
+
+	compiled := make(map[string]*regexp.Regexp, len(patterns))
+	for _, p := range patterns {
+		compiled[p] = util.CompilePathPattern(p)
+	}
+
+	sort.Strings(paths)
+	matched := make(map[string]bool, len(patterns))
+	for _, path := range paths {
+		if _, explicit := entries[path]; explicit {
+			continue
+		}
+
+		candidates := make([]string, 0)
+		for _, p := range patterns {
+			if compiled[p].MatchString(path) {
+				candidates = append(candidates, p)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return patternPrecedes(candidates[i], candidates[j])
+		})
+		best := candidates[0]
+		if len(candidates) > 1 && !patternPrecedes(best, candidates[1]) {
+			errs.Append(positions[best].Errorf("%s '%s' matches patterns '%s' and '%s' with the same precedence, declare it explicitly",
+				kind, path, best, candidates[1]))
+			continue
+		}
+
+		for _, p := range candidates {
+			matched[p] = true
+		}
+		e.acls[path] = entries[best]
+		e.patterns[path] = best
+		if origin, ok := origins[best]; ok {
+			e.origins[path] = origin
+		}
+	}
+
+	for _, p := range patterns {
+		if !matched[p] {
+			logrus.Warnf("%s pattern '%s' does not match any %s", kind, p, kind)
+		}
+	}
+
+	return e
+}
+
+// key returns the key of the configuration the path comes from, the pattern
+// it matched or the path itself
+func (e expansion) key(path string) string {
+	if pattern, ok := e.patterns[path]; ok {
+		return pattern
+	}
+	return path
+}
+
+// patternPrecedes returns true when the pattern a has precedence over b
+func patternPrecedes(a, b string) bool {
+	literalsA := len(strings.ReplaceAll(a, "*", ""))
+	literalsB := len(strings.ReplaceAll(b, "*", ""))
+	if literalsA != literalsB {
+		return literalsA > literalsB
+	}
+	return !strings.Contains(a, "**") && strings.Contains(b, "**")
+}
+
+// MatchedPatterns returns the groups and projects of the desired state that
+// come from a pattern in the configuration, along with the pattern
+func MatchedPatterns(desired internal.State) []string {
+	matches := make([]string, 0)
+	for _, g := range desired.Groups() {
+		if lg, ok := g.(LocalGroup); ok && lg.Pattern != "" {
+			matches = append(matches, fmt.Sprintf("group '%s' matches pattern '%s'", lg.Fullpath, lg.Pattern))
+		}
+	}
+	for _, p := range desired.Projects() {
+		if lp, ok := p.(LocalProject); ok && lp.Pattern != "" {
+			matches = append(matches, fmt.Sprintf("project '%s' matches pattern '%s'", lp.Fullpath, lp.Pattern))
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
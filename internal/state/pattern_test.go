@@ -0,0 +1,63 @@
+package state_test
+
+import (
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadingStateWithPatterns(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := util.LoadConfig("fixtures/with-patterns.yaml", false)
+	a.NoError(err)
+
+	s, err := state.LoadStateFromFile(c, querier, resolver)
+	a.NoError(err)
+
+	members := func(g internal.Group, ok bool) map[string]internal.Level {
+		a.True(ok)
+		return g.GetMembers()
+	}
+	a.Equal(map[string]internal.Level{"admin": internal.Owner, "user1": internal.Developer},
+		members(s.Group("root_group/subgroup1")), "the longest pattern wins")
+	a.Equal(map[string]internal.Level{"admin": internal.Owner, "user2": internal.Developer},
+		members(s.Group("root_group/subgroup2")), "explicit entries win over patterns")
+	a.Equal(map[string]internal.Level{"admin": internal.Owner},
+		members(s.Group("root_group")))
+	a.Empty(s.UnhandledGroups())
+
+	p, ok := s.Project("root_group/a_project")
+	a.True(ok)
+	a.Equal(map[string]internal.Level{"user3": internal.Developer}, p.GetMembers())
+
+	a.Equal([]string{
+		"group 'other_group' matches pattern '**'",
+		"group 'root_group' matches pattern '**'",
+		"group 'root_group/subgroup1' matches pattern 'root_group/*'",
+		"group 'skrrty' matches pattern '**'",
+		"project 'root_group/a_project' matches pattern 'root_group/*'",
+		"project 'root_group/myawesomeproject' matches pattern 'root_group/*'",
+	}, state.MatchedPatterns(s))
+}
+
+func TestAmbiguousPatternsFail(t *testing.T) {
+	a := assert.New(t)
+
+	c := internal.Config{
+		Groups: map[string]internal.Acls{
+			"root_group/*":    {Owners: []internal.Member{{Username: "admin"}}},
+			"*roup/subgroup1": {Owners: []internal.Member{{Username: "user1"}}},
+			"root_group/**":   {Owners: []internal.Member{{Username: "user2"}}},
+			"root_group/sub*": {Owners: []internal.Member{{Username: "user3"}}},
+		},
+	}
+
+	_, err := state.LoadStateFromFile(c, querier, resolver)
+	a.EqualError(err, "failed to build local state: 1 error: group 'root_group/subgroup1' matches patterns "+
+		"'*roup/subgroup1' and 'root_group/sub*' with the same precedence, declare it explicitly")
+}
@@ -0,0 +1,371 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// PlanVersion is the version of the plan document schema, it will be bumped
+// whenever a field changes meaning or is removed
+const PlanVersion = 1
+
+// Change kinds, one per action the differ can produce
+const (
+	KindAddGroupMembership      = "add_group_membership"
+	KindChangeGroupMembership   = "change_group_membership"
+	KindRemoveGroupMembership   = "remove_group_membership"
+	KindShareGroup              = "share_group"
+	KindUnshareGroup            = "unshare_group"
+	KindAddProjectMembership    = "add_project_membership"
+	KindChangeProjectMembership = "change_project_membership"
+	KindRemoveProjectMembership = "remove_project_membership"
+	KindShareProject            = "share_project"
+	KindUnshareProject          = "unshare_project"
+	KindCreateGroupVariable     = "create_group_variable"
+	KindUpdateGroupVariable     = "update_group_variable"
+	KindCreateProjectVariable   = "create_project_variable"
+	KindUpdateProjectVariable   = "update_project_variable"
+	KindDeleteGroupVariable     = "delete_group_variable"
+	KindDeleteProjectVariable   = "delete_project_variable"
+	KindSetAdmin                = "set_admin"
+	KindUnsetAdmin              = "unset_admin"
+	KindBlockUser               = "block_user"
+	KindUnblockUser             = "unblock_user"
+	KindCreateBotUser           = "create_bot_user"
+	KindUpdateBotEmail          = "update_bot_email"
+)
+
+// Plan is the machine readable representation of the list of actions
+// produced by Diff
+//
+// When a plan is saved to be applied later it also records the fingerprints
+// of the configuration and the live state it was calculated from, and the
+// hex encoded random salt the state fingerprint is keyed with.
+type Plan struct {
+	Version           int      `json:"version" yaml:"version"`
+	ConfigFingerprint string   `json:"config_fingerprint,omitempty" yaml:"config_fingerprint,omitempty"`
+	StateFingerprint  string   `json:"state_fingerprint,omitempty" yaml:"state_fingerprint,omitempty"`
+	Salt              string   `json:"salt,omitempty" yaml:"salt,omitempty"`
+	Changes           []Change `json:"changes" yaml:"changes"`
+}
+
+// Change is a single action in a plan.
+//
+// Secret values are never part of a change, only the variable key is.
+type Change struct {
+	ID          string                  `json:"id" yaml:"id"`
+	Kind        string                  `json:"kind" yaml:"kind"`
+	Group       string                  `json:"group,omitempty" yaml:"group,omitempty"`
+	Project     string                  `json:"project,omitempty" yaml:"project,omitempty"`
+	SharedGroup string                  `json:"shared_group,omitempty" yaml:"shared_group,omitempty"`
+	Username    string                  `json:"username,omitempty" yaml:"username,omitempty"`
+	Email       string                  `json:"email,omitempty" yaml:"email,omitempty"`
+	Variable    string                  `json:"variable,omitempty" yaml:"variable,omitempty"`
+	OldLevel    internal.Level          `json:"old_level,omitempty" yaml:"old_level,omitempty"`
+	NewLevel    internal.Level          `json:"new_level,omitempty" yaml:"new_level,omitempty"`
+	OldExpires  string                  `json:"old_expires,omitempty" yaml:"old_expires,omitempty"`
+	NewExpires  string                  `json:"new_expires,omitempty" yaml:"new_expires,omitempty"`
+	Priority    internal.ActionPriority `json:"priority" yaml:"priority"`
+}
+
+// changer is implemented by every action that can be turned into a Change
+type changer interface {
+	change() Change
+}
+
+// NewPlan builds a plan out of a list of actions keeping their order
+func NewPlan(actions []internal.Action) (Plan, error) {
+	p := Plan{
+		Version: PlanVersion,
+		Changes: make([]Change, 0, len(actions)),
+	}
+	for _, a := range actions {
+		c, ok := a.(changer)
+		if !ok {
+			return p, fmt.Errorf("action %#v can't be represented in a plan", a)
+		}
+		change := c.change()
+		change.Priority = a.Priority()
+		change.ID = change.fingerprint()
+		p.Changes = append(p.Changes, change)
+	}
+	return p, nil
+}
+
+// Marshal serializes the plan in the given format, either json or yaml
+func (p Plan) Marshal(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.MarshalIndent(p, "", "  ")
+	case "yaml":
+		return yaml.Marshal(p)
+	default:
+		return nil, fmt.Errorf("unknown plan format '%s'", format)
+	}
+}
+
+// Save writes the plan to the given file in the given format
+func (p Plan) Save(filename, format string) error {
+	b, err := p.Marshal(format)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("failed to write plan file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// LoadPlan reads a plan file written with Save, either in json or yaml format
+func LoadPlan(filename string) (Plan, error) {
+	p := Plan{}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return p, fmt.Errorf("failed to load plan file %s: %s", filename, err)
+	}
+
+	// json is valid yaml, so a single parser handles both formats
+	if err := yaml.UnmarshalStrict(content, &p); err != nil {
+		return p, fmt.Errorf("failed to unmarshal plan file %s: %s", filename, err)
+	}
+
+	if p.Version != PlanVersion {
+		return p, fmt.Errorf("unsupported plan version %d, expected %d", p.Version, PlanVersion)
+	}
+
+	for _, c := range p.Changes {
+		if c.ID != c.fingerprint() {
+			return p, fmt.Errorf("change %s does not match its content, the plan file is corrupted or was edited", c.ID)
+		}
+	}
+
+	return p, nil
+}
+
+// Actions turns the plan changes back into actions. Variable values are not
+// part of the plan, so they are read from the desired state.
+func (p Plan) Actions(desired internal.State) ([]internal.Action, error) {
+	actions := make([]internal.Action, 0, len(p.Changes))
+	errs := errors.New()
+
+	for _, c := range p.Changes {
+		a, err := c.action(desired)
+		if err != nil {
+			errs.Append(fmt.Errorf("change %s: %s", c.ID, err))
+			continue
+		}
+		if a.Priority() != c.Priority {
+			errs.Append(fmt.Errorf("change %s: priority %d does not match kind %s", c.ID, c.Priority, c.Kind))
+			continue
+		}
+		actions = append(actions, a)
+	}
+
+	return actions, errs.ErrorOrNil()
+}
+
+func (c Change) action(desired internal.State) (internal.Action, error) {
+	groupVariable := func() (internal.Variable, error) {
+		g, ok := desired.Group(c.Group)
+		if !ok {
+			return internal.Variable{}, fmt.Errorf("group %s is not in the desired state", c.Group)
+		}
+		v, ok := g.GetVariables()[c.Variable]
+		if !ok {
+			return internal.Variable{}, fmt.Errorf("variable %s is not in the desired state of group %s", c.Variable, c.Group)
+		}
+		return v, nil
+	}
+	projectVariable := func() (internal.Variable, error) {
+		p, ok := desired.Project(c.Project)
+		if !ok {
+			return internal.Variable{}, fmt.Errorf("project %s is not in the desired state", c.Project)
+		}
+		v, ok := p.GetVariables()[c.Variable]
+		if !ok {
+			return internal.Variable{}, fmt.Errorf("variable %s is not in the desired state of project %s", c.Variable, c.Project)
+		}
+		return v, nil
+	}
+
+	switch c.Kind {
+	case KindAddGroupMembership:
+		return addGroupMembership{Group: c.Group, Username: c.Username, Level: c.NewLevel, ExpiresAt: c.NewExpires}, nil
+	case KindChangeGroupMembership:
+		return changeGroupMembership{Group: c.Group, Username: c.Username, OldLevel: c.OldLevel, Level: c.NewLevel,
+			OldExpiresAt: c.OldExpires, ExpiresAt: c.NewExpires}, nil
+	case KindRemoveGroupMembership:
+		return removeGroupMembership{Group: c.Group, Username: c.Username, OldLevel: c.OldLevel}, nil
+	case KindShareGroup:
+		return shareGroupWithGroup{Group: c.Group, SharedGroup: c.SharedGroup, Level: c.NewLevel}, nil
+	case KindUnshareGroup:
+		return removeGroupSharing{Group: c.Group, SharedGroup: c.SharedGroup, OldLevel: c.OldLevel}, nil
+	case KindAddProjectMembership:
+		return addProjectMembership{Project: c.Project, Username: c.Username, Level: c.NewLevel,
+			ExpiresAt: c.NewExpires}, nil
+	case KindChangeProjectMembership:
+		return changeProjectMembership{Project: c.Project, Username: c.Username, OldLevel: c.OldLevel,
+			Level: c.NewLevel, OldExpiresAt: c.OldExpires, ExpiresAt: c.NewExpires}, nil
+	case KindRemoveProjectMembership:
+		return removeProjectMembership{Project: c.Project, Username: c.Username, OldLevel: c.OldLevel}, nil
+	case KindShareProject:
+		return shareProjectWithGroup{Project: c.Project, Group: c.SharedGroup, Level: c.NewLevel}, nil
+	case KindUnshareProject:
+		return removeProjectGroupSharing{Project: c.Project, Group: c.SharedGroup, OldLevel: c.OldLevel}, nil
+	case KindCreateGroupVariable:
+		v, err := groupVariable()
+		return createGroupVariable{Group: c.Group, Variable: v}, err
+	case KindUpdateGroupVariable:
+		v, err := groupVariable()
+		return updateGroupVariable{Group: c.Group, Variable: v}, err
+	case KindCreateProjectVariable:
+		v, err := projectVariable()
+		return createProjectVariable{Project: c.Project, Variable: v}, err
+	case KindUpdateProjectVariable:
+		v, err := projectVariable()
+		return updateProjectVariable{Project: c.Project, Variable: v}, err
+	case KindDeleteGroupVariable:
+		key, scope := internal.ParseVariableID(c.Variable)
+		return deleteGroupVariable{Group: c.Group, Variable: internal.Variable{Key: key, EnvironmentScope: scope}}, nil
+	case KindDeleteProjectVariable:
+		key, scope := internal.ParseVariableID(c.Variable)
+		return deleteProjectVariable{Project: c.Project,
+			Variable: internal.Variable{Key: key, EnvironmentScope: scope}}, nil
+	case KindSetAdmin:
+		return setAdminUser{Username: c.Username}, nil
+	case KindUnsetAdmin:
+		return unsetAdminUser{Username: c.Username}, nil
+	case KindBlockUser:
+		return blockUser{Username: c.Username}, nil
+	case KindUnblockUser:
+		return unblockUser{Username: c.Username}, nil
+	case KindCreateBotUser:
+		return createBotUser{Username: c.Username, Email: c.Email}, nil
+	case KindUpdateBotEmail:
+		return updateBotEmail{Username: c.Username, DesiredEmail: c.Email}, nil
+	}
+	return nil, fmt.Errorf("unknown kind '%s'", c.Kind)
+}
+
+// fingerprint calculates a stable identifier for the change. The same action
+// will always get the same ID, no matter the order in which it is planned.
+func (c Change) fingerprint() string {
+	h := sha256.New()
+	h.Write([]byte(strings.Join([]string{
+		c.Kind,
+		c.Group,
+		c.Project,
+		c.SharedGroup,
+		c.Username,
+		c.Email,
+		c.Variable,
+		c.OldLevel.String(),
+		c.NewLevel.String(),
+		c.OldExpires,
+		c.NewExpires,
+	}, "\x00")))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func (r shareGroupWithGroup) change() Change {
+	return Change{Kind: KindShareGroup, Group: r.Group, SharedGroup: r.SharedGroup, NewLevel: r.Level}
+}
+
+func (r removeGroupSharing) change() Change {
+	return Change{Kind: KindUnshareGroup, Group: r.Group, SharedGroup: r.SharedGroup, OldLevel: r.OldLevel}
+}
+
+func (s changeGroupMembership) change() Change {
+	return Change{Kind: KindChangeGroupMembership, Group: s.Group, Username: s.Username,
+		OldLevel: s.OldLevel, NewLevel: s.Level, OldExpires: s.OldExpiresAt, NewExpires: s.ExpiresAt}
+}
+
+func (s addGroupMembership) change() Change {
+	return Change{Kind: KindAddGroupMembership, Group: s.Group, Username: s.Username, NewLevel: s.Level,
+		NewExpires: s.ExpiresAt}
+}
+
+func (r removeGroupMembership) change() Change {
+	return Change{Kind: KindRemoveGroupMembership, Group: r.Group, Username: r.Username, OldLevel: r.OldLevel}
+}
+
+func (p createGroupVariable) change() Change {
+	return Change{Kind: KindCreateGroupVariable, Group: p.Group, Variable: p.Variable.ID()}
+}
+
+func (p updateGroupVariable) change() Change {
+	return Change{Kind: KindUpdateGroupVariable, Group: p.Group, Variable: p.Variable.ID()}
+}
+
+func (p deleteGroupVariable) change() Change {
+	return Change{Kind: KindDeleteGroupVariable, Group: p.Group, Variable: p.Variable.ID()}
+}
+
+func (r shareProjectWithGroup) change() Change {
+	return Change{Kind: KindShareProject, Project: r.Project, SharedGroup: r.Group, NewLevel: r.Level}
+}
+
+func (r removeProjectGroupSharing) change() Change {
+	return Change{Kind: KindUnshareProject, Project: r.Project, SharedGroup: r.Group, OldLevel: r.OldLevel}
+}
+
+func (r addProjectMembership) change() Change {
+	return Change{Kind: KindAddProjectMembership, Project: r.Project, Username: r.Username, NewLevel: r.Level,
+		NewExpires: r.ExpiresAt}
+}
+
+func (r changeProjectMembership) change() Change {
+	return Change{Kind: KindChangeProjectMembership, Project: r.Project, Username: r.Username,
+		OldLevel: r.OldLevel, NewLevel: r.Level, OldExpires: r.OldExpiresAt, NewExpires: r.ExpiresAt}
+}
+
+func (r removeProjectMembership) change() Change {
+	return Change{Kind: KindRemoveProjectMembership, Project: r.Project, Username: r.Username,
+		OldLevel: r.OldLevel}
+}
+
+func (p createProjectVariable) change() Change {
+	return Change{Kind: KindCreateProjectVariable, Project: p.Project, Variable: p.Variable.ID()}
+}
+
+func (p updateProjectVariable) change() Change {
+	return Change{Kind: KindUpdateProjectVariable, Project: p.Project, Variable: p.Variable.ID()}
+}
+
+func (p deleteProjectVariable) change() Change {
+	return Change{Kind: KindDeleteProjectVariable, Project: p.Project, Variable: p.Variable.ID()}
+}
+
+func (r setAdminUser) change() Change {
+	return Change{Kind: KindSetAdmin, Username: r.Username}
+}
+
+func (r unsetAdminUser) change() Change {
+	return Change{Kind: KindUnsetAdmin, Username: r.Username}
+}
+
+func (r blockUser) change() Change {
+	return Change{Kind: KindBlockUser, Username: r.Username}
+}
+
+func (r unblockUser) change() Change {
+	return Change{Kind: KindUnblockUser, Username: r.Username}
+}
+
+func (r createBotUser) change() Change {
+	return Change{Kind: KindCreateBotUser, Username: r.Username, Email: r.Email}
+}
+
+func (r updateBotEmail) change() Change {
+	return Change{Kind: KindUpdateBotEmail, Username: r.Username, Email: r.DesiredEmail}
+}
@@ -0,0 +1,260 @@
+package state_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/api"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func loadPlan(t *testing.T, source, desired string, args state.DiffArgs) state.Plan {
+	a := assert.New(t)
+
+	actions, err := state.Diff(loadFixture(t, source), loadFixture(t, desired), args)
+	a.NoError(err, "diff")
+
+	plan, err := state.NewPlan(actions)
+	a.NoError(err, "plan")
+	return plan
+}
+
+func TestPlanRecordsLevels(t *testing.T) {
+	a := assert.New(t)
+
+	plan := loadPlan(t, "fixtures/plain-with-other-levels-project.yaml", "fixtures/plain-with-project.yaml",
+		state.DiffArgs{DiffGroups: true, DiffProjects: true})
+
+	a.Equal(state.PlanVersion, plan.Version)
+
+	changes := make(map[string]state.Change)
+	for _, c := range plan.Changes {
+		a.Len(c.ID, 16, "change id")
+		changes[c.Kind+":"+c.Username+c.SharedGroup] = c
+	}
+
+	a.Equal(state.Change{
+		ID:       changes["change_project_membership:user2"].ID,
+		Kind:     state.KindChangeProjectMembership,
+		Project:  "root_group/a_project",
+		Username: "user2",
+		OldLevel: internal.Maintainer,
+		NewLevel: internal.Developer,
+		Priority: internal.ChangeInProject,
+	}, changes["change_project_membership:user2"])
+
+	a.Equal(state.Change{
+		ID:       changes["remove_project_membership:user3"].ID,
+		Kind:     state.KindRemoveProjectMembership,
+		Project:  "root_group/a_project",
+		Username: "user3",
+		OldLevel: internal.Reporter,
+		Priority: internal.RemoveFromProject,
+	}, changes["remove_project_membership:user3"])
+
+	a.Equal(state.Change{
+		ID:          changes["share_project:other_group"].ID,
+		Kind:        state.KindShareProject,
+		Project:     "root_group/a_project",
+		SharedGroup: "other_group",
+		NewLevel:    internal.Developer,
+		Priority:    internal.ChangeInProject,
+	}, changes["share_project:other_group"])
+}
+
+func TestPlanIDsAreStable(t *testing.T) {
+	a := assert.New(t)
+
+	ids := func() map[string]bool {
+		plan := loadPlan(t, "fixtures/diff-root-with-admin.yaml", "fixtures/diff-with-skrrty-group.yaml",
+			state.DiffArgs{DiffGroups: true, DiffProjects: true})
+		m := make(map[string]bool)
+		for _, c := range plan.Changes {
+			m[c.ID] = true
+		}
+		return m
+	}
+
+	first := ids()
+	a.Len(first, 5)
+	for i := 0; i < 10; i++ {
+		a.Equal(first, ids())
+	}
+}
+
+func TestPlanDoesNotLeakSecrets(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(os.Setenv("myenvkey", "supersecretvalue"))
+	a.NoError(os.Setenv("myenvgroupkey", "othersupersecretvalue"))
+	defer os.Setenv("myenvkey", "")
+	defer os.Setenv("myenvgroupkey", "")
+
+	plan := loadPlan(t, "fixtures/plain-minimal.yaml", "fixtures/plain-with-project-with-secrets.yaml",
+		state.DiffArgs{DiffGroups: true, DiffProjects: true})
+
+	b, err := plan.Marshal("json")
+	a.NoError(err)
+	a.NotContains(string(b), "supersecretvalue")
+	a.Contains(string(b), `"variable": "mykey"`)
+
+	parsed := state.Plan{}
+	a.NoError(json.Unmarshal(b, &parsed))
+	a.Equal(plan, parsed)
+
+	b, err = plan.Marshal("yaml")
+	a.NoError(err)
+	a.NotContains(string(b), "supersecretvalue")
+
+	parsed = state.Plan{}
+	a.NoError(yaml.Unmarshal(b, &parsed))
+	a.Equal(plan, parsed)
+
+	_, err = plan.Marshal("xml")
+	a.EqualError(err, "unknown plan format 'xml'")
+}
+
+func TestSavedPlanAppliesTheSameActions(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(os.Setenv("myenvkey", "value"))
+	a.NoError(os.Setenv("myenvgroupkey", "othervalue"))
+	defer os.Setenv("myenvkey", "")
+	defer os.Setenv("myenvgroupkey", "")
+
+	sourceState := loadFixture(t, "fixtures/plain-minimal.yaml")
+	desiredState := loadFixture(t, "fixtures/plain-with-project-with-secrets.yaml")
+
+	actions, err := state.Diff(sourceState, desiredState, state.DiffArgs{DiffGroups: true, DiffProjects: true})
+	a.NoError(err)
+
+	plan, err := state.NewPlan(actions)
+	a.NoError(err)
+	plan.Salt = "73616c74"
+	plan.StateFingerprint = state.Fingerprint(sourceState, desiredState, []byte("salt"))
+
+	dir, err := ioutil.TempDir("", "hurrdurr-plan")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+
+	for _, format := range []string{"json", "yaml"} {
+		filename := filepath.Join(dir, "plan."+format)
+		a.NoError(plan.Save(filename, format))
+
+		loaded, err := state.LoadPlan(filename)
+		a.NoError(err)
+		a.Equal(plan, loaded)
+
+		planned, err := loaded.Actions(desiredState)
+		a.NoError(err)
+		a.Equal(actions, planned)
+	}
+}
+
+func TestPlanRecordsVariableDeletes(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(os.Setenv("myenvkey", "value"))
+	a.NoError(os.Setenv("myenvgroupkey", "othervalue"))
+	a.NoError(os.Setenv("myotherenvkey", "productionvalue"))
+	defer os.Setenv("myenvkey", "")
+	defer os.Setenv("myenvgroupkey", "")
+	defer os.Setenv("myotherenvkey", "")
+
+	plan := loadPlan(t, "fixtures/plain-with-project-with-scoped-secrets.yaml",
+		"fixtures/plain-with-project-pruning-secrets.yaml", state.DiffArgs{DiffGroups: true, DiffProjects: true})
+
+	a.Len(plan.Changes, 2)
+	a.Equal(state.KindDeleteGroupVariable, plan.Changes[0].Kind)
+	a.Equal("mygroupkey", plan.Changes[0].Variable)
+	a.Equal(state.KindDeleteProjectVariable, plan.Changes[1].Kind)
+	a.Equal("mykey@production", plan.Changes[1].Variable)
+
+	actions, err := plan.Actions(loadFixture(t, "fixtures/plain-with-project-pruning-secrets.yaml"))
+	a.NoError(err)
+
+	executed := make([]string, 0)
+	client := api.DryRunAPIClient{
+		Append: func(action string) {
+			executed = append(executed, action)
+		},
+	}
+	for _, action := range actions {
+		a.NoError(action.Execute(client))
+	}
+	a.Equal([]string{
+		"!!! DELETE group variable 'mygroupkey' in 'other_group'",
+		"!!! DELETE project variable 'mykey@production' in 'root_group/a_project'",
+	}, executed)
+}
+
+func TestTamperedPlanIsRejected(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hurrdurr-plan")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "plan.json")
+	a.NoError(ioutil.WriteFile(filename, []byte(`{
+  "version": 1,
+  "changes": [
+    {
+      "id": "4a1f0c1e2a1a6bb9",
+      "kind": "add_group_membership",
+      "group": "root_group",
+      "username": "user1",
+      "new_level": "Owner",
+      "priority": 10
+    }
+  ]
+}`), 0644))
+
+	_, err = state.LoadPlan(filename)
+	a.EqualError(err, "change 4a1f0c1e2a1a6bb9 does not match its content, the plan file is corrupted or was edited")
+
+	a.NoError(ioutil.WriteFile(filename, []byte(`{"version": 2, "changes": []}`), 0644))
+	_, err = state.LoadPlan(filename)
+	a.EqualError(err, "unsupported plan version 2, expected 1")
+}
+
+func TestStateFingerprintChangesWithTheState(t *testing.T) {
+	a := assert.New(t)
+
+	desired := loadFixture(t, "fixtures/plain-with-project.yaml")
+	current := loadFixture(t, "fixtures/plain-with-project.yaml")
+	other := loadFixture(t, "fixtures/plain-with-other-levels-project.yaml")
+	salt := []byte("salt")
+
+	a.Equal(state.Fingerprint(current, desired, salt), state.Fingerprint(current, desired, salt))
+	a.NotEqual(state.Fingerprint(current, desired, salt), state.Fingerprint(other, desired, salt))
+}
+
+func TestStateFingerprintChangesWithTheDesiredSecrets(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(os.Setenv("myenvkey", "value"))
+	a.NoError(os.Setenv("myenvgroupkey", "othervalue"))
+	a.NoError(os.Setenv("myotherenvkey", "productionvalue"))
+	defer os.Setenv("myenvkey", "")
+	defer os.Setenv("myenvgroupkey", "")
+	defer os.Setenv("myotherenvkey", "")
+
+	current := loadFixture(t, "fixtures/plain-with-project.yaml")
+	desired := loadFixture(t, "fixtures/plain-with-project-with-secrets.yaml")
+	salt := []byte("salt")
+	fingerprint := state.Fingerprint(current, desired, salt)
+
+	a.NotEqual(fingerprint, state.Fingerprint(current, desired, []byte("pepper")),
+		"secret values are keyed with the salt")
+
+	a.NoError(os.Setenv("myenvkey", "othervalue"))
+	a.NotEqual(fingerprint, state.Fingerprint(current, loadFixture(t, "fixtures/plain-with-project-with-secrets.yaml"), salt))
+}
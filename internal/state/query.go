@@ -0,0 +1,1022 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Queries are set expressions over users:
+//
+//	expression := term { "or" term }
+//	term       := factor { "and" [ "not" ] factor }
+//	factor     := primary [ "where" condition { "and" condition } ]
+//	primary    := "(" expression ")" | "users" | "admins" | "bots" | "blocked"
+//	            | selector ( "in" | "from" ) [ "project" ] path
+//
+// "or" is the union, "and" the intersection and "and not" the difference.
+// Keywords and acls are case insensitive, group paths are not. Words can be
+// quoted with single or double quotes to use spaces or parentheses in them.
+
+type query struct {
+	query       string
+	level       internal.Level
+	memberAdder memberAdder
+
+	// origin is the entry of the configuration the query comes from, and
+	// position where it is written
+	origin     Provenance
+	position   internal.Position
+	expression queryNode
+}
+
+type memberAdder interface {
+	addMember(member string, level internal.Level)
+	record(member string, p Provenance)
+	String() string
+}
+
+func (q query) String() string {
+	return fmt.Sprintf("'%s' for '%s/%s'", q.query, q.memberAdder, q.level)
+}
+
+func (q query) Execute(state localState, querier internal.Querier) error {
+	if q.expression == nil {
+		expression, err := parseQuery(q.query)
+		if err != nil {
+			return err
+		}
+		q.expression = expression
+	}
+
+	members, err := q.expression.eval(queryContext{
+		query:   q,
+		state:   state,
+		querier: querier,
+	})
+	if err != nil {
+		return err
+	}
+
+	origin := q.origin
+	origin.references = q.expression.references()
+	for _, member := range members.sorted() {
+		q.memberAdder.addMember(member, q.level)
+		q.memberAdder.record(member, origin)
+	}
+	return nil
+}
+
+// QueryMember is a user returned by a query along with the level it gets
+type QueryMember struct {
+	Username string         `json:"username"`
+	Level    internal.Level `json:"level"`
+}
+
+// queryResult collects the members added by a query that is not in any group
+// or project
+type queryResult map[string]internal.Level
+
+func (r queryResult) addMember(member string, level internal.Level) {
+	if l, ok := r[member]; ok && l > level {
+		return
+	}
+	r[member] = level
+}
+
+func (queryResult) record(string, Provenance) {}
+
+func (queryResult) String() string {
+	return "command line"
+}
+
+// EvaluateQuery loads the configuration, resolving all of its queries, and
+// then executes the given query as if it was assigned at the given level.
+// Errors in the configuration are only logged, as the query may not depend on
+// the groups that failed.
+func EvaluateQuery(c internal.Config, querier internal.Querier, expression string, level internal.Level) ([]QueryMember, error) {
+	l, err := configToLocalState(c, querier, nil, false)
+	if err != nil {
+		logrus.Warnf("the configuration has errors, the query result may be incomplete: %s", err)
+	}
+
+	result := make(queryResult)
+	q := query{
+		query:       expression,
+		level:       level,
+		memberAdder: result,
+	}
+	if err := q.Execute(l, querier); err != nil {
+		return nil, fmt.Errorf("failed to execute query %s: %s", q, err)
+	}
+
+	members := make([]QueryMember, 0, len(result))
+	for u, l := range result {
+		members = append(members, QueryMember{Username: u, Level: l})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Username < members[j].Username
+	})
+	return members, nil
+}
+
+// groupNode and projectNode name the nodes of the graph of queries, a group
+// or a project with queries in it
+func groupNode(fullpath string) string {
+	return fullpath
+}
+
+func projectNode(fullpath string) string {
+	return "project " + fullpath
+}
+
+// target returns the node of the group or project the query adds members to
+func (q query) target() string {
+	switch a := q.memberAdder.(type) {
+	case *LocalGroup:
+		return groupNode(a.Fullpath)
+	case *LocalProject:
+		return projectNode(a.Fullpath)
+	}
+	return q.memberAdder.String()
+}
+
+// resolveQueries parses and executes the queries. The queries of a group or
+// project are executed before any query that points at it, so queries can
+// build on top of the members added by other queries. Queries that are part
+// of a cycle, or that depend on one, are not executed.
+func resolveQueries(state localState, querier internal.Querier, queries []query, errs *errors.Errors) {
+	byTarget := make(map[string][]query)
+	for _, q := range queries {
+		expression, err := parseQuery(q.query)
+		if err != nil {
+			continue // invalid queries are reported when the configuration is checked
+		}
+		q.expression = expression
+		byTarget[q.target()] = append(byTarget[q.target()], q)
+	}
+
+	projectsByNode := make(map[string]*LocalProject, len(state.projects))
+	for _, p := range state.projects {
+		projectsByNode[projectNode(p.Fullpath)] = p
+	}
+
+	// A project depends on the queries of the groups it is shared with, as
+	// their members are members of the project too
+	dependencies := func(node string) []string {
+		deps := make(userSet)
+		for _, q := range byTarget[node] {
+			for _, r := range q.expression.references() {
+				if r.project {
+					deps[projectNode(r.path)] = true
+				} else {
+					deps[groupNode(r.path)] = true
+				}
+			}
+		}
+		if p, ok := projectsByNode[node]; ok {
+			for g := range p.SharedGroups {
+				deps[groupNode(g)] = true
+			}
+		}
+		return deps.sorted()
+	}
+
+	const (
+		visiting = iota + 1
+		visited
+	)
+	marks := make(map[string]int)
+	failed := make(map[string]bool)
+	stack := make([]string, 0)
+	order := make([]string, 0)
+
+	var visit func(node string) bool
+	visit = func(node string) bool {
+		switch marks[node] {
+		case visiting:
+			for i, n := range stack {
+				if n == node {
+					cycle := append(append([]string{}, stack[i:]...), node)
+					position := internal.Position{}
+					for _, n := range cycle {
+						if len(byTarget[n]) > 0 {
+							position = byTarget[n][0].position
+							break
+						}
+					}
+					errs.Append(position.Errorf("queries form a cycle: %s", strings.Join(cycle, " -> ")))
+				}
+			}
+			return false
+		case visited:
+			return !failed[node]
+		}
+
+		marks[node] = visiting
+		stack = append(stack, node)
+		resolved := true
+		for _, dep := range dependencies(node) {
+			if !visit(dep) {
+				resolved = false
+			}
+		}
+		stack = stack[:len(stack)-1]
+		marks[node] = visited
+
+		if !resolved {
+			failed[node] = true
+			return false
+		}
+		order = append(order, node)
+		return true
+	}
+
+	nodes := make([]string, 0, len(byTarget))
+	for n := range byTarget {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+	for _, n := range nodes {
+		visit(n)
+	}
+
+	for _, n := range order {
+		for _, q := range byTarget[n] {
+			if err := q.Execute(state, querier); err != nil {
+				errs.Append(q.position.Errorf("failed to execute query %s: %s", q, err))
+			}
+		}
+	}
+}
+
+type queryContext struct {
+	query   query
+	state   localState
+	querier internal.Querier
+}
+
+type userSet map[string]bool
+
+func newUserSet(users []string) userSet {
+	s := make(userSet, len(users))
+	for _, u := range users {
+		s[u] = true
+	}
+	return s
+}
+
+func (s userSet) sorted() []string {
+	users := make([]string, 0, len(s))
+	for u := range s {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users
+}
+
+type queryNode interface {
+	eval(queryContext) (userSet, error)
+	references() []queryReference
+}
+
+// queryReference is a group or project a query points at
+type queryReference struct {
+	path    string
+	project bool
+}
+
+type unionNode struct {
+	left, right queryNode
+}
+
+func (n unionNode) references() []queryReference {
+	return append(n.left.references(), n.right.references()...)
+}
+
+func (n unionNode) eval(ctx queryContext) (userSet, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	union := make(userSet, len(left)+len(right))
+	for u := range left {
+		union[u] = true
+	}
+	for u := range right {
+		union[u] = true
+	}
+	return union, nil
+}
+
+type intersectionNode struct {
+	left, right queryNode
+}
+
+func (n intersectionNode) references() []queryReference {
+	return append(n.left.references(), n.right.references()...)
+}
+
+func (n intersectionNode) eval(ctx queryContext) (userSet, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	intersection := make(userSet)
+	for u := range left {
+		if right[u] {
+			intersection[u] = true
+		}
+	}
+	return intersection, nil
+}
+
+type differenceNode struct {
+	left, right queryNode
+}
+
+func (n differenceNode) references() []queryReference {
+	return append(n.left.references(), n.right.references()...)
+}
+
+func (n differenceNode) eval(ctx queryContext) (userSet, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	difference := make(userSet)
+	for u := range left {
+		if !right[u] {
+			difference[u] = true
+		}
+	}
+	return difference, nil
+}
+
+type usersNode struct{}
+
+func (usersNode) references() []queryReference {
+	return nil
+}
+
+func (usersNode) eval(ctx queryContext) (userSet, error) {
+	return newUserSet(ctx.querier.Users()), nil
+}
+
+type adminsNode struct{}
+
+func (adminsNode) references() []queryReference {
+	return nil
+}
+
+func (adminsNode) eval(ctx queryContext) (userSet, error) {
+	return newUserSet(ctx.querier.Admins()), nil
+}
+
+// botsNode returns the bots declared in the configuration
+type botsNode struct{}
+
+func (botsNode) references() []queryReference {
+	return nil
+}
+
+func (botsNode) eval(ctx queryContext) (userSet, error) {
+	bots := make(userSet)
+	for u := range ctx.state.BotUsers() {
+		bots[u] = true
+	}
+	return bots, nil
+}
+
+// blockedNode returns the users that are blocked in the instance and the ones
+// the configuration blocks
+type blockedNode struct{}
+
+func (blockedNode) references() []queryReference {
+	return nil
+}
+
+func (blockedNode) eval(ctx queryContext) (userSet, error) {
+	blocked := newUserSet(ctx.querier.Blocked())
+	for _, u := range ctx.state.Blocked() {
+		blocked[u] = true
+	}
+	return blocked, nil
+}
+
+// userCondition is a predicate on a user and its attributes
+type userCondition func(username string, attributes internal.UserAttributes, now time.Time) bool
+
+// whereNode keeps the users that match all the conditions, users whose
+// attributes are not known never match
+type whereNode struct {
+	users      queryNode
+	conditions []userCondition
+}
+
+func (n whereNode) references() []queryReference {
+	return n.users.references()
+}
+
+func (n whereNode) eval(ctx queryContext) (userSet, error) {
+	users, err := n.users.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	matched := make(userSet)
+	for u := range users {
+		attributes, ok := ctx.querier.GetUserAttributes(u)
+		if !ok {
+			continue
+		}
+		matches := true
+		for _, c := range n.conditions {
+			if !c(u, attributes, now) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			matched[u] = true
+		}
+	}
+	return matched, nil
+}
+
+// membersNode picks the members of a group or project, either by their role,
+// admins, bots or users, or by their level
+type membersNode struct {
+	acl     queryToken
+	role    string
+	levels  levelRange
+	path    queryToken
+	project bool
+}
+
+// levelRange matches the levels between min and max, both included
+type levelRange struct {
+	min, max internal.Level
+}
+
+func (r levelRange) matches(l internal.Level) bool {
+	return l >= r.min && l <= r.max
+}
+
+func (n membersNode) references() []queryReference {
+	return []queryReference{{path: n.path.text, project: n.project}}
+}
+
+// members returns the members of the queried group, or the members of the
+// queried project along with the members of the groups it is shared with at
+// the lowest of both levels
+func (n membersNode) members(ctx queryContext) (map[string]internal.Level, error) {
+	q := ctx.query
+	if !n.project {
+		grp, ok := ctx.state.Group(n.path.text)
+		if !ok {
+			return nil, fmt.Errorf("could not find group '%s' to resolve query '%s' in '%s/%s'",
+				n.path.text, q.query, q.memberAdder, q.level)
+		}
+		return grp.GetMembers(), nil
+	}
+
+	if !ctx.querier.ProjectExists(n.path.text) {
+		return nil, n.path.errorf("project '%s' does not exist", n.path.text)
+	}
+	project, ok := ctx.state.projects[n.path.text]
+	if !ok {
+		return nil, fmt.Errorf("could not find project '%s' to resolve query '%s' in '%s/%s'",
+			n.path.text, q.query, q.memberAdder, q.level)
+	}
+
+	members := make(map[string]internal.Level, len(project.Members))
+	for u, l := range project.Members {
+		members[u] = l
+	}
+	for g, shareLevel := range project.SharedGroups {
+		grp, ok := ctx.state.groups[g]
+		if !ok {
+			continue
+		}
+		for u, l := range grp.Members {
+			if l > shareLevel {
+				l = shareLevel
+			}
+			if l > members[u] {
+				members[u] = l
+			}
+		}
+	}
+	return members, nil
+}
+
+func (n membersNode) eval(ctx queryContext) (userSet, error) {
+	members, err := n.members(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make(userSet)
+	for u, l := range members {
+		switch n.role {
+		case "admins":
+			if ctx.querier.IsAdmin(u) {
+				matched[u] = true
+			}
+		case "users":
+			if ctx.querier.IsUser(u) {
+				matched[u] = true
+			}
+		case "bots":
+			if ctx.state.IsBot(u) {
+				matched[u] = true
+			}
+		default:
+			if n.levels.matches(l) {
+				matched[u] = true
+			}
+		}
+	}
+	return matched, nil
+}
+
+// queryToken is a word or a parenthesis in a query along with the position
+// where it starts, counting from 1. Quoted words are never keywords.
+type queryToken struct {
+	text   string
+	pos    int
+	quoted bool
+}
+
+func (t queryToken) is(keyword string) bool {
+	return !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+func (t queryToken) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, a...), t.pos)
+}
+
+func lexQuery(q string) ([]queryToken, error) {
+	tokens := make([]queryToken, 0)
+	start := -1
+	var quote rune
+	for i, r := range q {
+		switch {
+		case quote != 0:
+			if r == quote {
+				tokens = append(tokens, queryToken{text: q[start:i], pos: start, quoted: true})
+				start = -1
+				quote = 0
+			}
+		case unicode.IsSpace(r) || r == '(' || r == ')':
+			if start >= 0 {
+				tokens = append(tokens, queryToken{text: q[start:i], pos: start + 1})
+				start = -1
+			}
+			if r == '(' || r == ')' {
+				tokens = append(tokens, queryToken{text: string(r), pos: i + 1})
+			}
+		case start < 0 && (r == '\'' || r == '"'):
+			quote = r
+			start = i + 1
+		case start < 0:
+			start = i
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed quote at position %d", start)
+	}
+	if start >= 0 {
+		tokens = append(tokens, queryToken{text: q[start:], pos: start + 1})
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	next   int
+	end    queryToken
+}
+
+func parseQuery(q string) (queryNode, error) {
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{
+		tokens: tokens,
+		end:    queryToken{pos: len(q) + 1},
+	}
+
+	n, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, t.errorf("unexpected '%s'", t.text)
+	}
+	return n, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.next >= len(p.tokens) {
+		return p.end, false
+	}
+	return p.tokens[p.next], true
+}
+
+func (p *queryParser) consume() (queryToken, bool) {
+	t, ok := p.peek()
+	if ok {
+		p.next++
+	}
+	return t, ok
+}
+
+func (p *queryParser) accept(keyword string) bool {
+	if t, ok := p.peek(); ok && t.is(keyword) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expression() (queryNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = unionNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) term() (queryNode, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		difference := p.accept("not")
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		if difference {
+			left = differenceNode{left: left, right: right}
+		} else {
+			left = intersectionNode{left: left, right: right}
+		}
+	}
+	return left, nil
+}
+
+func (p *queryParser) factor() (queryNode, error) {
+	n, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("where") {
+		return n, nil
+	}
+
+	where := whereNode{users: n}
+	for {
+		c, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		where.conditions = append(where.conditions, c)
+
+		// an "and" followed by something else than a condition is an
+		// intersection
+		if !p.nextIsCondition() {
+			return where, nil
+		}
+		p.next++
+	}
+}
+
+func (p *queryParser) primary() (queryNode, error) {
+	t, ok := p.consume()
+	if !ok {
+		return nil, t.errorf("unexpected end of query")
+	}
+
+	switch {
+	case t.text == "(" && !t.quoted:
+		n, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		closing, ok := p.consume()
+		if !ok {
+			return nil, t.errorf("unclosed '('")
+		}
+		if closing.text != ")" {
+			return nil, closing.errorf("expected ')' but got '%s'", closing.text)
+		}
+		return n, nil
+
+	case (t.text == ")" && !t.quoted) || isQueryKeyword(t):
+		return nil, t.errorf("unexpected '%s'", t.text)
+	}
+
+	if next, ok := p.peek(); !ok || !(next.is("in") || next.is("from")) {
+		switch {
+		case t.is("users"):
+			return usersNode{}, nil
+		case t.is("admins"):
+			return adminsNode{}, nil
+		case t.is("bots"):
+			return botsNode{}, nil
+		case t.is("blocked"):
+			return blockedNode{}, nil
+		}
+	}
+
+	n, err := p.selector(t)
+	if err != nil {
+		return nil, err
+	}
+
+	next, ok := p.peek()
+	if !ok || !(next.is("in") || next.is("from")) {
+		return nil, next.errorf("expected 'in' or 'from' after '%s'", p.tokens[p.next-1].text)
+	}
+	p.next++
+
+	// a group called project is still a group when nothing follows it
+	if kw, ok := p.peek(); ok && kw.is("project") && p.next+1 < len(p.tokens) && isQueryPath(p.tokens[p.next+1]) {
+		p.next++
+		n.path, _ = p.consume()
+		n.project = true
+		return n, nil
+	}
+
+	group, ok := p.consume()
+	if !ok || !isQueryPath(group) {
+		return nil, group.errorf("expected a group after '%s'", next.text)
+	}
+	n.path = group
+	return n, nil
+}
+
+// selector parses which members of a group or project are picked, starting
+// at the already consumed token t:
+//
+//	selector := "users" | "admins" | "bots" | level [ "+" ]
+//	          | "at" ( "least" | "most" ) level | ( "above" | "below" ) level
+func (p *queryParser) selector(t queryToken) (membersNode, error) {
+	n := membersNode{acl: t}
+
+	switch {
+	case t.is("users"), t.is("admins"), t.is("bots"):
+		n.role = strings.ToLower(t.text)
+		return n, nil
+
+	case t.is("at"):
+		bound, ok := p.consume()
+		if !ok || !(bound.is("least") || bound.is("most")) {
+			return n, bound.errorf("expected 'least' or 'most' after 'at'")
+		}
+		level, err := p.level()
+		if err != nil {
+			return n, err
+		}
+		if bound.is("least") {
+			n.levels = levelRange{min: level, max: internal.Owner}
+		} else {
+			n.levels = levelRange{min: internal.Guest, max: level}
+		}
+		return n, nil
+
+	case t.is("above"), t.is("below"):
+		level, err := p.level()
+		if err != nil {
+			return n, err
+		}
+		if t.is("above") {
+			n.levels = levelRange{min: level + 1, max: internal.Owner}
+		} else {
+			n.levels = levelRange{min: internal.Guest, max: level - 1}
+		}
+		return n, nil
+	}
+
+	if strings.HasSuffix(t.text, "+") {
+		level, err := parseQueryLevel(queryToken{text: strings.TrimSuffix(t.text, "+"), pos: t.pos})
+		if err != nil {
+			return n, err
+		}
+		n.levels = levelRange{min: level, max: internal.Owner}
+		return n, nil
+	}
+
+	level, err := parseQueryLevel(t)
+	if err != nil {
+		return n, t.errorf("invalid acl '%s', use one of guests, reporters, developers, maintainers, owners, admins, bots or users",
+			t.text)
+	}
+	n.levels = levelRange{min: level, max: level}
+	return n, nil
+}
+
+// condition parses a predicate on the attributes of users:
+//
+//	condition := "email" "ends" suffix | [ "not" ] "external"
+//	           | "username" "matches" regexp
+//	           | "created" ( "before" | "after" ) date
+//	           | "active" "within" number "days"
+//
+// Dates are written as YYYY-MM-DD, in UTC, and the day itself is neither
+// before nor after.
+func (p *queryParser) condition() (userCondition, error) {
+	t, ok := p.consume()
+	if !ok {
+		return nil, t.errorf("expected a condition after 'where'")
+	}
+
+	switch {
+	case t.is("external"):
+		return func(_ string, a internal.UserAttributes, _ time.Time) bool {
+			return a.External
+		}, nil
+
+	case t.is("not"):
+		if err := p.expect(t, "external"); err != nil {
+			return nil, err
+		}
+		return func(_ string, a internal.UserAttributes, _ time.Time) bool {
+			return !a.External
+		}, nil
+
+	case t.is("email"):
+		if err := p.expect(t, "ends"); err != nil {
+			return nil, err
+		}
+		suffix, err := p.argument("an email suffix")
+		if err != nil {
+			return nil, err
+		}
+		return func(_ string, a internal.UserAttributes, _ time.Time) bool {
+			return strings.HasSuffix(strings.ToLower(a.Email), strings.ToLower(suffix.text))
+		}, nil
+
+	case t.is("username"):
+		if err := p.expect(t, "matches"); err != nil {
+			return nil, err
+		}
+		expr, err := p.argument("a regular expression")
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(expr.text)
+		if err != nil {
+			return nil, expr.errorf("invalid regular expression '%s'", expr.text)
+		}
+		return func(u string, _ internal.UserAttributes, _ time.Time) bool {
+			return re.MatchString(u)
+		}, nil
+
+	case t.is("created"):
+		bound, ok := p.consume()
+		if !ok || !(bound.is("before") || bound.is("after")) {
+			return nil, bound.errorf("expected 'before' or 'after' after 'created'")
+		}
+		d, err := p.argument("a date")
+		if err != nil {
+			return nil, err
+		}
+		date, err := time.Parse("2006-01-02", d.text)
+		if err != nil {
+			return nil, d.errorf("invalid date '%s', use YYYY-MM-DD", d.text)
+		}
+		if bound.is("before") {
+			return func(_ string, a internal.UserAttributes, _ time.Time) bool {
+				return !a.CreatedAt.IsZero() && a.CreatedAt.Before(date)
+			}, nil
+		}
+		return func(_ string, a internal.UserAttributes, _ time.Time) bool {
+			return !a.CreatedAt.Before(date.AddDate(0, 0, 1))
+		}, nil
+
+	case t.is("active"):
+		if err := p.expect(t, "within"); err != nil {
+			return nil, err
+		}
+		n, err := p.argument("a number of days")
+		if err != nil {
+			return nil, err
+		}
+		days, err := strconv.Atoi(n.text)
+		if err != nil || days < 0 {
+			return nil, n.errorf("invalid number of days '%s'", n.text)
+		}
+		unit, ok := p.consume()
+		if !ok || !(unit.is("days") || unit.is("day")) {
+			return nil, unit.errorf("expected 'days' after '%s'", n.text)
+		}
+		return func(_ string, a internal.UserAttributes, now time.Time) bool {
+			y, m, d := now.UTC().Date()
+			return !a.LastActivityOn.Before(time.Date(y, m, d-days, 0, 0, 0, 0, time.UTC))
+		}, nil
+	}
+
+	return nil, t.errorf("unknown user attribute '%s', use one of email, external, username, created or active", t.text)
+}
+
+// nextIsCondition checks whether the next tokens are an "and" followed by a
+// condition
+func (p *queryParser) nextIsCondition() bool {
+	if t, ok := p.peek(); !ok || !t.is("and") || p.next+1 >= len(p.tokens) {
+		return false
+	}
+	t := p.tokens[p.next+1]
+	if t.is("not") {
+		return p.next+2 < len(p.tokens) && p.tokens[p.next+2].is("external")
+	}
+	for _, k := range []string{"email", "external", "username", "created", "active"} {
+		if t.is(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// expect consumes the keyword that must follow the token t
+func (p *queryParser) expect(t queryToken, keyword string) error {
+	if !p.accept(keyword) {
+		next, _ := p.peek()
+		return next.errorf("expected '%s' after '%s'", keyword, t.text)
+	}
+	return nil
+}
+
+// argument consumes a word that is not a keyword nor a parenthesis
+func (p *queryParser) argument(what string) (queryToken, error) {
+	previous := p.tokens[p.next-1]
+	t, ok := p.consume()
+	if !ok || !isQueryPath(t) {
+		return t, t.errorf("expected %s after '%s'", what, previous.text)
+	}
+	return t, nil
+}
+
+func (p *queryParser) level() (internal.Level, error) {
+	t, ok := p.consume()
+	if !ok {
+		return 0, t.errorf("expected a level")
+	}
+	return parseQueryLevel(t)
+}
+
+// parseQueryLevel parses a level name, singular or plural and in any case
+func parseQueryLevel(t queryToken) (internal.Level, error) {
+	level, err := internal.ParseLevel(strings.TrimSuffix(strings.ToLower(t.text), "s"))
+	if err != nil {
+		return 0, t.errorf("invalid level '%s', use one of guest, reporter, developer, maintainer or owner", t.text)
+	}
+	return level, nil
+}
+
+func isQueryPath(t queryToken) bool {
+	return t.quoted || (t.text != "(" && t.text != ")" && !isQueryKeyword(t))
+}
+
+func isQueryKeyword(t queryToken) bool {
+	for _, k := range []string{"and", "or", "not", "in", "from", "where"} {
+		if t.is(k) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,639 @@
+package state_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryExpressions(t *testing.T) {
+	tt := []struct {
+		name          string
+		query         string
+		expected      map[string]internal.Level
+		expectedError string
+	}{
+		{
+			name:     "plain users",
+			query:    "users",
+			expected: map[string]internal.Level{"user1": internal.Developer, "user2": internal.Developer, "user3": internal.Developer},
+		},
+		{
+			name:     "acl in group",
+			query:    "developers in root_group",
+			expected: map[string]internal.Level{"user1": internal.Developer, "user2": internal.Developer},
+		},
+		{
+			name:     "union",
+			query:    "owners from root_group or guests in other_group",
+			expected: map[string]internal.Level{"admin": internal.Developer, "user3": internal.Developer},
+		},
+		{
+			name:     "intersection",
+			query:    "developers in root_group and developers in other_group",
+			expected: map[string]internal.Level{"user2": internal.Developer},
+		},
+		{
+			name:     "difference",
+			query:    "developers in root_group and not users in other_group",
+			expected: map[string]internal.Level{"user1": internal.Developer},
+		},
+		{
+			name:     "and binds tighter than or",
+			query:    "admins or users in root_group and not developers in other_group",
+			expected: map[string]internal.Level{"admin": internal.Developer, "user1": internal.Developer, "user3": internal.Developer},
+		},
+		{
+			name:     "parentheses",
+			query:    "(admins or users in root_group) and not (developers in other_group or reporters in root_group)",
+			expected: map[string]internal.Level{"admin": internal.Developer, "user1": internal.Developer},
+		},
+		{
+			name:     "keywords are case insensitive",
+			query:    "Developers IN root_group AND NOT Users FROM other_group",
+			expected: map[string]internal.Level{"user1": internal.Developer},
+		},
+		{
+			name:  "unclosed parenthesis",
+			query: "(users or admins",
+			expectedError: "failed to build local state: 1 error: invalid query '(users or admins' for 'skrrty/Developer': " +
+				"unclosed '(' at position 1",
+		},
+		{
+			name:  "unexpected token in parentheses",
+			query: "(users admins)",
+			expectedError: "failed to build local state: 1 error: invalid query '(users admins)' for 'skrrty/Developer': " +
+				"expected ')' but got 'admins' at position 8",
+		},
+		{
+			name:  "missing group",
+			query: "developers in",
+			expectedError: "failed to build local state: 1 error: invalid query 'developers in' for 'skrrty/Developer': " +
+				"expected a group after 'in' at position 14",
+		},
+		{
+			name:  "dangling operator",
+			query: "users and not",
+			expectedError: "failed to build local state: 1 error: invalid query 'users and not' for 'skrrty/Developer': " +
+				"unexpected end of query at position 14",
+		},
+		{
+			name:  "acl without group",
+			query: "developers or users",
+			expectedError: "failed to build local state: 1 error: invalid query 'developers or users' for 'skrrty/Developer': " +
+				"expected 'in' or 'from' after 'developers' at position 12",
+		},
+		{
+			name:  "trailing tokens",
+			query: "users admins",
+			expectedError: "failed to build local state: 1 error: invalid query 'users admins' for 'skrrty/Developer': " +
+				"unexpected 'admins' at position 7",
+		},
+		{
+			name:  "non existing group",
+			query: "users or developers in nowhere",
+			expectedError: "failed to build local state: 1 error: failed to execute query 'users or developers in nowhere' " +
+				"for 'skrrty/Developer': could not find group 'nowhere' to resolve query 'users or developers in nowhere' " +
+				"in 'skrrty/Developer'",
+		},
+		{
+			name:          "a group querying itself",
+			query:         "developers in skrrty",
+			expectedError: "failed to build local state: 1 error: queries form a cycle: skrrty -> skrrty",
+		},
+		{
+			name:     "at least a level",
+			query:    "developers+ in root_group",
+			expected: map[string]internal.Level{"admin": internal.Developer, "user1": internal.Developer, "user2": internal.Developer},
+		},
+		{
+			name:     "at least a level in words",
+			query:    "at least Developer in root_group",
+			expected: map[string]internal.Level{"admin": internal.Developer, "user1": internal.Developer, "user2": internal.Developer},
+		},
+		{
+			name:     "at most a level",
+			query:    "at most reporters in other_group",
+			expected: map[string]internal.Level{"user3": internal.Developer},
+		},
+		{
+			name:     "above a level",
+			query:    "above reporter in root_group",
+			expected: map[string]internal.Level{"admin": internal.Developer, "user1": internal.Developer, "user2": internal.Developer},
+		},
+		{
+			name:     "below a level",
+			query:    "below owner in other_group",
+			expected: map[string]internal.Level{"user2": internal.Developer, "user3": internal.Developer},
+		},
+		{
+			name:  "invalid level in a range",
+			query: "at least chief in root_group",
+			expectedError: "failed to build local state: 1 error: invalid query 'at least chief in root_group' " +
+				"for 'skrrty/Developer': invalid level 'chief', use one of guest, reporter, developer, maintainer or owner " +
+				"at position 10",
+		},
+		{
+			name:  "invalid bound",
+			query: "at best owner in root_group",
+			expectedError: "failed to build local state: 1 error: invalid query 'at best owner in root_group' " +
+				"for 'skrrty/Developer': expected 'least' or 'most' after 'at' at position 4",
+		},
+		{
+			name:  "range without group",
+			query: "at least maintainer",
+			expectedError: "failed to build local state: 1 error: invalid query 'at least maintainer' " +
+				"for 'skrrty/Developer': expected 'in' or 'from' after 'maintainer' at position 20",
+		},
+		{
+			name:  "invalid acl",
+			query: "users or whatever in root_group",
+			expectedError: "failed to build local state: 1 error: invalid query 'users or whatever in root_group' " +
+				"for 'skrrty/Developer': invalid acl 'whatever', use one of guests, reporters, developers, maintainers, " +
+				"owners, admins, bots or users at position 10",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			c := internal.Config{
+				Groups: map[string]internal.Acls{
+					"root_group": {
+						Owners:     []internal.Member{{Username: "admin"}},
+						Developers: []internal.Member{{Username: "user1"}, {Username: "user2"}},
+						Reporters:  []internal.Member{{Username: "user3"}},
+					},
+					"other_group": {
+						Owners:     []internal.Member{{Username: "admin"}},
+						Developers: []internal.Member{{Username: "user2"}},
+						Guests:     []internal.Member{{Username: "user3"}},
+					},
+					"skrrty": {
+						Developers: []internal.Member{{Username: "query: " + tc.query}},
+					},
+				},
+			}
+
+			s, err := state.LoadStateFromFile(c, querier, resolver)
+			if tc.expectedError != "" {
+				a.EqualError(err, tc.expectedError)
+				return
+			}
+			a.NoError(err)
+
+			g, ok := s.Group("skrrty")
+			a.True(ok)
+			a.Equal(tc.expected, g.GetMembers())
+		})
+	}
+}
+
+func TestNestedQueries(t *testing.T) {
+	a := assert.New(t)
+
+	c := internal.Config{
+		Groups: map[string]internal.Acls{
+			"root_group": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "user1"}, {Username: "user2"}, {Username: "user3"}},
+			},
+			"root_group/subgroup1": {
+				Owners:     []internal.Member{{Username: "query: owners in root_group/subgroup2"}},
+				Developers: []internal.Member{{Username: "query: developers in root_group/subgroup2"}},
+			},
+			"root_group/subgroup2": {
+				Owners:     []internal.Member{{Username: "query: owners in root_group"}},
+				Developers: []internal.Member{{Username: "query: developers in root_group and not developers in other_group"}},
+			},
+			"other_group": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "user3"}},
+			},
+		},
+		Projects: map[string]internal.Acls{
+			"root_group/a_project": {
+				Maintainers: []internal.Member{{Username: "query: developers in root_group/subgroup1"}},
+			},
+		},
+	}
+
+	s, err := state.LoadStateFromFile(c, querier, resolver)
+	a.NoError(err)
+
+	g, ok := s.Group("root_group/subgroup1")
+	a.True(ok)
+	a.Equal(map[string]internal.Level{
+		"admin": internal.Owner,
+		"user1": internal.Developer,
+		"user2": internal.Developer,
+	}, g.GetMembers())
+
+	p, ok := s.Project("root_group/a_project")
+	a.True(ok)
+	a.Equal(map[string]internal.Level{
+		"user1": internal.Maintainer,
+		"user2": internal.Maintainer,
+	}, p.GetMembers())
+}
+
+func TestQueryCyclesAreRejected(t *testing.T) {
+	a := assert.New(t)
+
+	c := internal.Config{
+		Groups: map[string]internal.Acls{
+			"root_group": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "query: developers in skrrty"}},
+			},
+			"skrrty": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "query: developers in other_group"}},
+			},
+			"other_group": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "query: users in root_group or developers in root_group/subgroup1"}},
+			},
+			"root_group/subgroup1": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "user1"}},
+			},
+			"root_group/subgroup2": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "query: developers in skrrty"}},
+			},
+		},
+	}
+
+	_, err := state.LoadStateFromFile(c, querier, resolver)
+	a.EqualError(err, "failed to build local state: 1 error: "+
+		"queries form a cycle: other_group -> root_group -> skrrty -> other_group")
+}
+
+func TestProjectQueries(t *testing.T) {
+	tt := []struct {
+		name          string
+		query         string
+		expected      map[string]internal.Level
+		expectedError string
+	}{
+		{
+			name:     "acl in project",
+			query:    "maintainers in project root_group/a_project",
+			expected: map[string]internal.Level{"user1": internal.Developer},
+		},
+		{
+			name:     "members of shared groups get the lowest level",
+			query:    "reporters in project root_group/a_project",
+			expected: map[string]internal.Level{"admin": internal.Developer, "user3": internal.Developer},
+		},
+		{
+			name:     "users in project",
+			query:    "users from project root_group/a_project and not developers in root_group",
+			expected: map[string]internal.Level{"user1": internal.Developer},
+		},
+		{
+			name:  "project not in the configuration",
+			query: "developers in project root_group/myawesomeproject",
+			expectedError: "failed to build local state: 1 error: failed to execute query " +
+				"'developers in project root_group/myawesomeproject' for 'skrrty/Developer': could not find project " +
+				"'root_group/myawesomeproject' to resolve query 'developers in project root_group/myawesomeproject' " +
+				"in 'skrrty/Developer'",
+		},
+		{
+			name:  "project that does not exist",
+			query: "developers in project root_group/nope",
+			expectedError: "failed to build local state: 1 error: failed to execute query " +
+				"'developers in project root_group/nope' for 'skrrty/Developer': project 'root_group/nope' " +
+				"does not exist at position 23",
+		},
+		{
+			name:  "a group called project",
+			query: "developers in project",
+			expectedError: "failed to build local state: 1 error: failed to execute query 'developers in project' " +
+				"for 'skrrty/Developer': could not find group 'project' to resolve query 'developers in project' " +
+				"in 'skrrty/Developer'",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			c := internal.Config{
+				Groups: map[string]internal.Acls{
+					"root_group": {
+						Owners:     []internal.Member{{Username: "admin"}},
+						Developers: []internal.Member{{Username: "user2"}, {Username: "user3"}},
+					},
+					"other_group": {
+						Owners:     []internal.Member{{Username: "admin"}},
+						Developers: []internal.Member{{Username: "query: developers in root_group"}},
+					},
+					"skrrty": {
+						Developers: []internal.Member{{Username: "query: " + tc.query}},
+					},
+				},
+				Projects: map[string]internal.Acls{
+					"root_group/a_project": {
+						Maintainers: []internal.Member{{Username: "user1"}},
+						Developers:  []internal.Member{{Username: "user2"}},
+						Reporters:   []internal.Member{{Username: "share_with: other_group"}},
+					},
+				},
+			}
+
+			s, err := state.LoadStateFromFile(c, querier, resolver)
+			if tc.expectedError != "" {
+				a.EqualError(err, tc.expectedError)
+				return
+			}
+			a.NoError(err)
+
+			g, ok := s.Group("skrrty")
+			a.True(ok)
+			a.Equal(tc.expected, g.GetMembers())
+		})
+	}
+}
+
+func TestProjectQueryCyclesAreRejected(t *testing.T) {
+	a := assert.New(t)
+
+	c := internal.Config{
+		Groups: map[string]internal.Acls{
+			"other_group": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "query: maintainers in project root_group/a_project"}},
+			},
+		},
+		Projects: map[string]internal.Acls{
+			"root_group/a_project": {
+				Maintainers: []internal.Member{{Username: "user1"}},
+				Developers:  []internal.Member{{Username: "share_with: other_group"}},
+			},
+			"root_group/myawesomeproject": {
+				Developers: []internal.Member{{Username: "query: developers in project root_group/a_project"}},
+			},
+		},
+	}
+
+	_, err := state.LoadStateFromFile(c, querier, resolver)
+	a.EqualError(err, "failed to build local state: 1 error: "+
+		"queries form a cycle: other_group -> project root_group/a_project -> other_group")
+}
+
+func TestUserAttributeQueries(t *testing.T) {
+	q := querier
+	q.attributes = map[string]internal.UserAttributes{
+		"admin": {
+			Email: "admin@corp.example",
+		},
+		"user1": {
+			Email:          "user1@corp.example",
+			CreatedAt:      time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC),
+			LastActivityOn: time.Now().AddDate(0, 0, -3),
+		},
+		"user2": {
+			Email:          "user2@contractor.example",
+			External:       true,
+			CreatedAt:      time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC),
+			LastActivityOn: time.Now().AddDate(0, 0, -90),
+		},
+		"user3": {
+			Email:     "user3@CORP.example",
+			CreatedAt: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		},
+	}
+
+	tt := []struct {
+		name          string
+		query         string
+		expected      map[string]internal.Level
+		expectedError string
+	}{
+		{
+			name:     "email domain",
+			query:    "users where email ends @corp.example",
+			expected: map[string]internal.Level{"user1": internal.Developer, "user3": internal.Developer},
+		},
+		{
+			name:     "external users",
+			query:    "users where external",
+			expected: map[string]internal.Level{"user2": internal.Developer},
+		},
+		{
+			name:     "internal users",
+			query:    "users where not external",
+			expected: map[string]internal.Level{"user1": internal.Developer, "user3": internal.Developer},
+		},
+		{
+			name:     "quoted username regex",
+			query:    "users where username matches '^user(1|2)$'",
+			expected: map[string]internal.Level{"user1": internal.Developer, "user2": internal.Developer},
+		},
+		{
+			name:     "created before a date",
+			query:    "users where created before 2020-01-01",
+			expected: map[string]internal.Level{"user1": internal.Developer},
+		},
+		{
+			name:     "created after a date",
+			query:    "users where created after 2020-01-01",
+			expected: map[string]internal.Level{"user2": internal.Developer},
+		},
+		{
+			name:     "recently active",
+			query:    "users where active within 30 days",
+			expected: map[string]internal.Level{"user1": internal.Developer},
+		},
+		{
+			name:     "conditions and intersections",
+			query:    "users where not external and email ends @corp.example and reporters in root_group",
+			expected: map[string]internal.Level{"user3": internal.Developer},
+		},
+		{
+			name:     "conditions apply to the closest factor",
+			query:    "admins or users where email ends \"@contractor.example\"",
+			expected: map[string]internal.Level{"admin": internal.Developer, "user2": internal.Developer},
+		},
+		{
+			name:     "conditions on group members",
+			query:    "developers in root_group where created before 2020-01-01",
+			expected: map[string]internal.Level{"user1": internal.Developer},
+		},
+		{
+			name:  "unknown attribute",
+			query: "users where height 2",
+			expectedError: "failed to build local state: 1 error: invalid query 'users where height 2' for 'skrrty/Developer': " +
+				"unknown user attribute 'height', use one of email, external, username, created or active at position 13",
+		},
+		{
+			name:  "missing keyword",
+			query: "users where email starts user",
+			expectedError: "failed to build local state: 1 error: invalid query 'users where email starts user' " +
+				"for 'skrrty/Developer': expected 'ends' after 'email' at position 19",
+		},
+		{
+			name:  "invalid date",
+			query: "users where created before yesterday",
+			expectedError: "failed to build local state: 1 error: invalid query 'users where created before yesterday' " +
+				"for 'skrrty/Developer': invalid date 'yesterday', use YYYY-MM-DD at position 28",
+		},
+		{
+			name:  "invalid regular expression",
+			query: "users where username matches '('",
+			expectedError: "failed to build local state: 1 error: invalid query 'users where username matches '('' " +
+				"for 'skrrty/Developer': invalid regular expression '(' at position 30",
+		},
+		{
+			name:  "invalid number of days",
+			query: "users where active within many days",
+			expectedError: "failed to build local state: 1 error: invalid query 'users where active within many days' " +
+				"for 'skrrty/Developer': invalid number of days 'many' at position 27",
+		},
+		{
+			name:  "unclosed quote",
+			query: "users where username matches 'user",
+			expectedError: "failed to build local state: 1 error: invalid query 'users where username matches 'user' " +
+				"for 'skrrty/Developer': unclosed quote at position 30",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			c := internal.Config{
+				Groups: map[string]internal.Acls{
+					"root_group": {
+						Owners:     []internal.Member{{Username: "admin"}},
+						Developers: []internal.Member{{Username: "user1"}, {Username: "user2"}},
+						Reporters:  []internal.Member{{Username: "user3"}},
+					},
+					"skrrty": {
+						Developers: []internal.Member{{Username: "query: " + tc.query}},
+					},
+				},
+			}
+
+			s, err := state.LoadStateFromFile(c, q, resolver)
+			if tc.expectedError != "" {
+				a.EqualError(err, tc.expectedError)
+				return
+			}
+			a.NoError(err)
+
+			g, ok := s.Group("skrrty")
+			a.True(ok)
+			a.Equal(tc.expected, g.GetMembers())
+		})
+	}
+}
+
+func TestEvaluatingQueries(t *testing.T) {
+	a := assert.New(t)
+
+	c := internal.Config{
+		Groups: map[string]internal.Acls{
+			"root_group": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "user1"}, {Username: "query: developers in other_group"}},
+			},
+			"other_group": {
+				Owners:     []internal.Member{{Username: "admin"}},
+				Developers: []internal.Member{{Username: "user2"}},
+			},
+			"skrrty": {
+				Developers: []internal.Member{{Username: "query: users in non_existing_group"}},
+			},
+		},
+	}
+
+	members, err := state.EvaluateQuery(c, querier, "developers in root_group or admins", internal.Maintainer)
+	a.NoError(err, "errors in other groups are ignored")
+	a.Equal([]state.QueryMember{
+		{Username: "admin", Level: internal.Maintainer},
+		{Username: "user1", Level: internal.Maintainer},
+		{Username: "user2", Level: internal.Maintainer},
+	}, members)
+
+	_, err = state.EvaluateQuery(c, querier, "developers in", internal.Developer)
+	a.EqualError(err, "failed to execute query 'developers in' for 'command line/Developer': "+
+		"expected a group after 'in' at position 14")
+}
+
+func TestBotAndBlockedQueries(t *testing.T) {
+	q := querier
+	q.users = map[string]bool{"user1": true, "user2": true, "bot1": true}
+	q.blocked = map[string]bool{"olduser": true}
+
+	tt := []struct {
+		name     string
+		query    string
+		expected map[string]internal.Level
+	}{
+		{
+			name:     "bots",
+			query:    "bots",
+			expected: map[string]internal.Level{"bot1": internal.Reporter, "bot2": internal.Reporter},
+		},
+		{
+			name:     "blocked",
+			query:    "blocked",
+			expected: map[string]internal.Level{"baduser": internal.Reporter, "olduser": internal.Reporter},
+		},
+		{
+			name:     "bots in group",
+			query:    "bots in root_group",
+			expected: map[string]internal.Level{"bot1": internal.Reporter},
+		},
+		{
+			name:     "users that are not bots",
+			query:    "users and not bots",
+			expected: map[string]internal.Level{"user1": internal.Reporter, "user2": internal.Reporter},
+		},
+		{
+			name:     "admins in group",
+			query:    "bots or admins in root_group",
+			expected: map[string]internal.Level{"admin": internal.Reporter, "bot1": internal.Reporter, "bot2": internal.Reporter},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			c := internal.Config{
+				Groups: map[string]internal.Acls{
+					"root_group": {
+						Owners:     []internal.Member{{Username: "admin"}},
+						Developers: []internal.Member{{Username: "user1"}, {Username: "bot1"}},
+					},
+					"skrrty": {
+						Reporters: []internal.Member{{Username: "query: " + tc.query}},
+					},
+				},
+				Users: internal.Users{
+					Blocked: []string{"baduser"},
+				},
+				Bots: []internal.Bot{
+					{Username: "bot1", Email: "bot1@example.com"},
+					{Username: "bot2", Email: "bot2@example.com"},
+				},
+			}
+
+			s, err := state.LoadStateFromFile(c, q, resolver)
+			a.NoError(err)
+
+			g, ok := s.Group("skrrty")
+			a.True(ok)
+			a.Equal(tc.expected, g.GetMembers())
+		})
+	}
+}
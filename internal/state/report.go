@@ -0,0 +1,156 @@
+package state
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+)
+
+// Variable report statuses
+const (
+	VariableInSync  = "in-sync"
+	VariableDrifted = "drifted"
+	VariableMissing = "missing"
+	VariableExtra   = "extra"
+)
+
+// VariableReport is the status of a variable in a group or project managed by
+// the desired state. It never includes the value of the variable.
+type VariableReport struct {
+	Group    string `json:"group,omitempty"`
+	Project  string `json:"project,omitempty"`
+	Variable string `json:"variable"`
+	Status   string `json:"status"`
+
+	Current *VariableFingerprint `json:"current,omitempty"`
+	Desired *VariableFingerprint `json:"desired,omitempty"`
+
+	Differences []string `json:"differences,omitempty"`
+}
+
+// VariableFingerprint describes a variable value without revealing it
+type VariableFingerprint struct {
+	Fingerprint  string `json:"fingerprint"`
+	Length       int    `json:"length"`
+	Protected    *bool  `json:"protected,omitempty"`
+	Masked       *bool  `json:"masked,omitempty"`
+	VariableType string `json:"variable_type,omitempty"`
+}
+
+// VariablesReport compares the variables of every group and project in the
+// desired state with the current ones. Values are fingerprinted with a HMAC
+// keyed with the salt, so the same salt is needed to compare reports.
+func VariablesReport(current, desired internal.State, salt []byte) []VariableReport {
+	fingerprint := func(v internal.Variable) *VariableFingerprint {
+		h := hmac.New(sha256.New, salt)
+		h.Write([]byte(v.Value))
+		return &VariableFingerprint{
+			Fingerprint:  hex.EncodeToString(h.Sum(nil))[:16],
+			Length:       len(v.Value),
+			Protected:    v.Protected,
+			Masked:       v.Masked,
+			VariableType: v.VariableType,
+		}
+	}
+
+	report := func(group, project string, current, desired map[string]internal.Variable) []VariableReport {
+		ids := make([]string, 0, len(current)+len(desired))
+		for id := range desired {
+			ids = append(ids, id)
+		}
+		for id := range current {
+			if _, ok := desired[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+
+		reports := make([]VariableReport, 0, len(ids))
+		for _, id := range ids {
+			r := VariableReport{
+				Group:    group,
+				Project:  project,
+				Variable: id,
+			}
+			c, inCurrent := current[id]
+			d, inDesired := desired[id]
+			if inCurrent {
+				r.Current = fingerprint(c)
+			}
+			if inDesired {
+				r.Desired = fingerprint(d)
+			}
+
+			switch {
+			case !inCurrent:
+				r.Status = VariableMissing
+			case !inDesired:
+				r.Status = VariableExtra
+			case c.Satisfies(d):
+				r.Status = VariableInSync
+			default:
+				r.Status = VariableDrifted
+				r.Differences = c.Differences(d)
+			}
+			reports = append(reports, r)
+		}
+		return reports
+	}
+
+	reports := make([]VariableReport, 0)
+
+	groups := desired.Groups()
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].GetFullpath() < groups[j].GetFullpath()
+	})
+	for _, g := range groups {
+		var currentVariables map[string]internal.Variable
+		if currentGroup, ok := current.Group(g.GetFullpath()); ok {
+			currentVariables = currentGroup.GetVariables()
+		}
+		reports = append(reports, report(g.GetFullpath(), "", currentVariables, g.GetVariables())...)
+	}
+
+	projects := desired.Projects()
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].GetFullpath() < projects[j].GetFullpath()
+	})
+	for _, p := range projects {
+		var currentVariables map[string]internal.Variable
+		if currentProject, ok := current.Project(p.GetFullpath()); ok {
+			currentVariables = currentProject.GetVariables()
+		}
+		reports = append(reports, report("", p.GetFullpath(), currentVariables, p.GetVariables())...)
+	}
+
+	return reports
+}
+
+func (r VariableReport) String() string {
+	b := &strings.Builder{}
+	if r.Group != "" {
+		fmt.Fprintf(b, "group '%s'", r.Group)
+	} else {
+		fmt.Fprintf(b, "project '%s'", r.Project)
+	}
+	fmt.Fprintf(b, " variable '%s' is %s", r.Variable, r.Status)
+
+	switch r.Status {
+	case VariableDrifted:
+		fmt.Fprintf(b, ": %s, current %s, desired %s", strings.Join(r.Differences, ", "), r.Current, r.Desired)
+	case VariableMissing:
+		fmt.Fprintf(b, ", desired %s", r.Desired)
+	default:
+		fmt.Fprintf(b, ", current %s", r.Current)
+	}
+	return b.String()
+}
+
+func (f VariableFingerprint) String() string {
+	return fmt.Sprintf("fingerprint %s length %d", f.Fingerprint, f.Length)
+}
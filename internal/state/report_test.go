@@ -0,0 +1,53 @@
+package state_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariablesReport(t *testing.T) {
+	a := assert.New(t)
+
+	defer os.Unsetenv("myenvkey")
+	defer os.Unsetenv("myenvgroupkey")
+	defer os.Unsetenv("myotherenvkey")
+
+	a.NoError(os.Setenv("myenvkey", "value"))
+	a.NoError(os.Setenv("myenvgroupkey", "oldgroupvalue"))
+	a.NoError(os.Setenv("myotherenvkey", "productionvalue"))
+	current := loadFixture(t, "fixtures/plain-with-project-with-scoped-secrets.yaml")
+
+	a.NoError(os.Setenv("myenvgroupkey", "newgroupvalue"))
+	desired := loadFixture(t, "fixtures/plain-with-project-with-drifted-secrets.yaml")
+
+	reports := state.VariablesReport(current, desired, []byte("salt"))
+
+	lines := make([]string, 0)
+	for _, r := range reports {
+		lines = append(lines, r.String())
+	}
+	a.Equal([]string{
+		"group 'other_group' variable 'mygroupkey' is drifted: value, masked true -> false, " +
+			"current fingerprint e141163659219aff length 13, desired fingerprint c94fe773e4f71888 length 13",
+		"project 'root_group/a_project' variable 'mykey' is in-sync, current fingerprint aaf15d64f29e7a06 length 5",
+		"project 'root_group/a_project' variable 'mykey@production' is extra, current fingerprint fbf7dc720ff56594 length 15",
+		"project 'root_group/a_project' variable 'mynewkey' is missing, desired fingerprint aaf15d64f29e7a06 length 5",
+	}, lines)
+
+	b, err := json.Marshal(reports)
+	a.NoError(err)
+	for _, secret := range []string{"oldgroupvalue", "newgroupvalue", "productionvalue"} {
+		a.NotContains(string(b), secret)
+	}
+
+	other := state.VariablesReport(current, desired, []byte("pepper"))
+	a.NotEqual(reports[1].Current.Fingerprint, other[1].Current.Fingerprint,
+		"fingerprints depend on the salt")
+	a.Equal(reports[1].Current.Fingerprint, reports[3].Desired.Fingerprint,
+		"the same value gets the same fingerprint")
+}
@@ -2,13 +2,14 @@ package state
 
 import (
 	"fmt"
-	"os"
-	"regexp"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"gitlab.com/yakshaving.art/hurrdurr/internal"
 	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/secrets"
 	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
 
 	"github.com/sirupsen/logrus"
@@ -17,11 +18,22 @@ import (
 // LocalGroup represents a group with a fullpath and it's members that is loaded from a yaml file
 type LocalGroup struct {
 	Fullpath   string
+	Pattern    string
 	SharedWith map[string]internal.Level
 	Members    map[string]internal.Level
 	Subquery   bool
+	Additive   bool
+	Prune      bool
 
-	Variables map[string]string
+	// Expirations holds the membership expiration dates by username, it's
+	// nil when no member expires
+	Expirations map[string]string
+
+	// Provenance holds the entries that gave a level to each member, it's
+	// nil unless the state is loaded to explain memberships
+	Provenance map[string][]Provenance
+
+	Variables map[string]internal.Variable
 }
 
 // GetFullpath implements Group interface
@@ -45,24 +57,39 @@ func (g LocalGroup) HasSubquery() bool {
 }
 
 // HasVariable implements Group interface
-func (g LocalGroup) HasVariable(key string) bool {
-	_, ok := g.Variables[key]
+func (g LocalGroup) HasVariable(id string) bool {
+	_, ok := g.Variables[id]
 	return ok
 }
 
 // VariableEquals implements Group interface
-func (g LocalGroup) VariableEquals(key, value string) bool {
-	if v, ok := g.Variables[key]; ok {
-		return value == v
+func (g LocalGroup) VariableEquals(v internal.Variable) bool {
+	if current, ok := g.Variables[v.ID()]; ok {
+		return current.Satisfies(v)
 	}
 	return false
 }
 
 // GetVariables implements Group interface
-func (g LocalGroup) GetVariables() map[string]string {
+func (g LocalGroup) GetVariables() map[string]internal.Variable {
 	return g.Variables
 }
 
+// IsAdditive implements Group interface
+func (g LocalGroup) IsAdditive() bool {
+	return g.Additive
+}
+
+// PrunesVariables implements Group interface
+func (g LocalGroup) PrunesVariables() bool {
+	return g.Prune
+}
+
+// GetExpirations implements Group interface
+func (g LocalGroup) GetExpirations() map[string]string {
+	return g.Expirations
+}
+
 func (g LocalGroup) addSharedGroups(fullpath string, level internal.Level) {
 	l, ok := g.SharedWith[fullpath]
 	if ok && l > level {
@@ -71,12 +98,29 @@ func (g LocalGroup) addSharedGroups(fullpath string, level internal.Level) {
 	g.SharedWith[fullpath] = level
 }
 
+// addMember adds a member returned by a query. Queries can't expire, a query
+// that raises the level of a member drops its expiration, while one at the
+// same level keeps the expiration of the entries of the member.
 func (g LocalGroup) addMember(username string, level internal.Level) {
 	l, ok := g.Members[username]
-	if ok && l > level {
+	if ok && l >= level {
 		return
 	}
 	g.Members[username] = level
+	delete(g.Expirations, username)
+}
+
+// addMemberUntil adds a member declared in the configuration. Members are
+// added before the queries run, and the expiration comes from the entries at
+// the highest level: a permanent one wins, otherwise the latest date does.
+func (g *LocalGroup) addMemberUntil(username string, level internal.Level, expires string) {
+	g.Expirations = mergeExpiration(g.Members, g.Expirations, username, level, expires)
+}
+
+func (g LocalGroup) record(username string, p Provenance) {
+	if g.Provenance != nil {
+		g.Provenance[username] = append(g.Provenance[username], p)
+	}
 }
 
 func (g LocalGroup) String() string {
@@ -90,10 +134,21 @@ func (g *LocalGroup) setHasSubquery(b bool) {
 // LocalProject is a local implementation of projects loaded from a file
 type LocalProject struct {
 	Fullpath     string
+	Pattern      string
 	SharedGroups map[string]internal.Level
 	Members      map[string]internal.Level
+	Additive     bool
+	Prune        bool
+
+	// Expirations holds the membership expiration dates by username, it's
+	// nil when no member expires
+	Expirations map[string]string
 
-	Variables map[string]string
+	// Provenance holds the entries that gave a level to each member, it's
+	// nil unless the state is loaded to explain memberships
+	Provenance map[string][]Provenance
+
+	Variables map[string]internal.Variable
 }
 
 // GetFullpath implements internal.Project interface
@@ -113,24 +168,39 @@ func (l LocalProject) GetGroupLevel(group string) (internal.Level, bool) {
 }
 
 // HasVariable implements Group interface
-func (l LocalProject) HasVariable(key string) bool {
-	_, ok := l.Variables[key]
+func (l LocalProject) HasVariable(id string) bool {
+	_, ok := l.Variables[id]
 	return ok
 }
 
 // VariableEquals implements Group interface
-func (l LocalProject) VariableEquals(key, value string) bool {
-	if v, ok := l.Variables[key]; ok {
-		return value == v
+func (l LocalProject) VariableEquals(v internal.Variable) bool {
+	if current, ok := l.Variables[v.ID()]; ok {
+		return current.Satisfies(v)
 	}
 	return false
 }
 
 // GetVariables implements Project interface
-func (l LocalProject) GetVariables() map[string]string {
+func (l LocalProject) GetVariables() map[string]internal.Variable {
 	return l.Variables
 }
 
+// IsAdditive implements Project interface
+func (l LocalProject) IsAdditive() bool {
+	return l.Additive
+}
+
+// PrunesVariables implements Project interface
+func (l LocalProject) PrunesVariables() bool {
+	return l.Prune
+}
+
+// GetExpirations implements Project interface
+func (l LocalProject) GetExpirations() map[string]string {
+	return l.Expirations
+}
+
 func (l *LocalProject) addGroupSharing(group string, level internal.Level) {
 	l.SharedGroups[group] = level
 }
@@ -140,21 +210,34 @@ func (l LocalProject) GetMembers() map[string]internal.Level {
 	return l.Members
 }
 
+func (l LocalProject) record(username string, p Provenance) {
+	if l.Provenance != nil {
+		l.Provenance[username] = append(l.Provenance[username], p)
+	}
+}
+
 func (l LocalProject) String() string {
 	return l.GetFullpath()
 }
 
 func (l LocalProject) addMember(username string, level internal.Level) {
 	lvl, ok := l.Members[username]
-	if ok && lvl > level {
+	if ok && lvl >= level {
 		return
 	}
 	l.Members[username] = level
+	delete(l.Expirations, username)
+}
+
+// addMemberUntil works as the one of LocalGroup
+func (l *LocalProject) addMemberUntil(username string, level internal.Level, expires string) {
+	l.Expirations = mergeExpiration(l.Members, l.Expirations, username, level, expires)
 }
 
-// LoadStateFromFile loads the desired state from a file
-func LoadStateFromFile(c internal.Config, q internal.Querier) (internal.State, error) {
-	l, err := configToLocalState(c, q)
+// LoadStateFromFile loads the desired state from a file, reading the secret
+// variables with the resolver
+func LoadStateFromFile(c internal.Config, q internal.Querier, r secrets.Resolver) (internal.State, error) {
+	l, err := configToLocalState(c, q, &r, false)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build local state: %s", err)
 	}
@@ -258,7 +341,11 @@ func (s localState) GetUserEmail(username string) (string, bool) {
 	return u, ok
 }
 
-func configToLocalState(c internal.Config, q internal.Querier) (localState, error) {
+// configToLocalState builds the local state out of the configuration, when
+// explain is set it records the provenance of every member. Secret variables
+// are left empty without resolver, as queries and explanations don't need
+// their values.
+func configToLocalState(c internal.Config, q internal.Querier, r *secrets.Resolver, explain bool) (localState, error) {
 	logrus.Debugf("loading local state from configuration, current user: %s, with Config %+v", q.CurrentUser(), c)
 	l := localState{
 		currentUser: q.CurrentUser(),
@@ -271,35 +358,64 @@ func configToLocalState(c internal.Config, q internal.Querier) (localState, erro
 
 	errs := errors.New() // This object aggregates all the errors to dump them all at the end
 	queries := make([]query, 0)
+	teams := resolveTeams(c.Teams, c.Origins.Teams, c.Positions.Teams, q, &errs)
+
+	groups := expandPatterns("group", c.Groups, c.Origins.Groups, c.Positions.Groups, q.Groups(), &errs)
+	c.Groups, c.Origins.Groups = groups.acls, groups.origins
+	projects := expandPatterns("project", c.Projects, c.Origins.Projects, c.Positions.Projects, q.Projects(), &errs)
+	c.Projects, c.Origins.Projects = projects.acls, projects.origins
 
 	for fullpath, g := range c.Groups {
+		positions := c.Positions.Groups[groups.key(fullpath)]
 		if !q.GroupExists(fullpath) {
-			errs.Append(fmt.Errorf("Group '%s' does not exist", fullpath))
+			errs.Append(positions.Errorf("Group '%s' does not exist", fullpath))
+			continue
+		}
+
+		additive, ok := checkMode("group", fullpath, g.Mode, positions, &errs)
+		if !ok {
 			continue
 		}
 
 		group := &LocalGroup{
 			Fullpath:   fullpath,
+			Pattern:    groups.patterns[fullpath],
 			SharedWith: make(map[string]internal.Level, 0),
 			Members:    make(map[string]internal.Level, 0),
-			Variables:  make(map[string]string, 0),
+			Additive:   additive,
+			Prune:      g.PruneVariables,
+			Variables:  make(map[string]internal.Variable, 0),
+		}
+		if explain {
+			group.Provenance = make(map[string][]Provenance)
 		}
 
-		for k, envKey := range g.Variables {
-			value, ok := os.LookupEnv(envKey)
-			if !ok {
-				errs.Append(fmt.Errorf("Group contains secret '%s'='%s' which is not loaded in the environment", k, envKey))
-				continue
+		checkSecretScopes("group", fullpath, g.Variables, positions, &errs)
+		for k, definitions := range g.Variables {
+			for _, d := range definitions {
+				value, err := resolve(r, d.Source, positions.Variable(k))
+				if err != nil {
+					errs.Append(positions.Variable(k).Errorf("Group contains secret '%s'='%s' which %s", k, d.Source, err))
+					continue
+				}
+				v := internal.NewVariable(k, value, d.VariableType, d.Protected, d.Masked, d.EnvironmentScope)
+				if !group.HasVariable(v.ID()) {
+					group.Variables[v.ID()] = v
+				}
 			}
-			group.Variables[k] = value
 		}
 
-		addMembers := func(members []string, level internal.Level) {
-			for _, member := range members {
+		addMembers := func(members []internal.Member, level internal.Level) {
+			for _, m := range members {
+				member := m.Username
+				position := positions.Member(member)
+				if !checkMember("group", fullpath, level, m, c.Teams, position, q, &errs) {
+					continue
+				}
 				if strings.HasPrefix(member, "share_with:") {
 					member = strings.TrimSpace(member[11:])
 					if !q.GroupExists(member) {
-						errs.Append(fmt.Errorf("can't share group '%s' with non-existing group '%s'", fullpath, member))
+						errs.Append(position.Errorf("can't share group '%s' with non-existing group '%s'", fullpath, member))
 						continue
 					}
 					group.addSharedGroups(member, level)
@@ -310,20 +426,41 @@ func configToLocalState(c internal.Config, q internal.Querier) (localState, erro
 						query:       strings.TrimSpace(member[6:]),
 						level:       level,
 						memberAdder: group,
+						origin:      Provenance{Level: level, Entry: member, File: c.Origins.Groups[fullpath]},
+						position:    position,
 					})
 					group.setHasSubquery(true)
 					continue
 				}
-				if q.IsBlocked(member) {
-					errs.Append(fmt.Errorf("User '%s' is blocked, it should not be included in group '%s'", member, fullpath))
+				if isTeam(member) {
+					t, ok := teams[teamName(member)]
+					if !ok {
+						continue
+					}
+					for _, tm := range t.members {
+						group.addMemberUntil(tm.Username, level, tm.Expires)
+						group.record(tm.Username, tm.provenance(level))
+					}
+					for _, tq := range t.queries {
+						queries = append(queries, query{
+							query:       tq.query(),
+							level:       level,
+							memberAdder: group,
+							origin:      tq.provenance(level),
+							position:    tq.position,
+						})
+						group.setHasSubquery(true)
+					}
 					continue
 				}
-				if !q.IsUser(member) && !q.IsAdmin(member) {
-					errs.Append(fmt.Errorf("User '%s' does not exist for group '%s'", member, fullpath))
+				if hasExpired(m) {
+					logrus.Warnf("membership of '%s' in group '%s' expired on %s, skipping it", member, fullpath, m.Expires)
 					continue
 				}
 
-				group.addMember(member, level)
+				group.addMemberUntil(member, level, m.Expires)
+				group.record(member, Provenance{Level: level, Entry: member, Expires: m.Expires,
+					File: c.Origins.Groups[fullpath]})
 			}
 		}
 
@@ -350,34 +487,57 @@ func configToLocalState(c internal.Config, q internal.Querier) (localState, erro
 	l.unhandledGroups = unhandledGroups
 
 	for projectPath, acls := range c.Projects {
+		positions := c.Positions.Projects[projects.key(projectPath)]
 		if !q.ProjectExists(projectPath) {
-			errs.Append(fmt.Errorf("Project '%s' does not exist", projectPath))
+			errs.Append(positions.Errorf("Project '%s' does not exist", projectPath))
+			continue
+		}
+
+		additive, ok := checkMode("project", projectPath, acls.Mode, positions, &errs)
+		if !ok {
 			continue
 		}
 
 		project := &LocalProject{
 			Fullpath:     projectPath,
+			Pattern:      projects.patterns[projectPath],
 			SharedGroups: make(map[string]internal.Level, 0),
 			Members:      make(map[string]internal.Level, 0),
+			Additive:     additive,
+			Prune:        acls.PruneVariables,
 
-			Variables: make(map[string]string, 0),
+			Variables: make(map[string]internal.Variable, 0),
+		}
+		if explain {
+			project.Provenance = make(map[string][]Provenance)
 		}
 
-		for k, envKey := range acls.Variables {
-			value, ok := os.LookupEnv(envKey)
-			if !ok {
-				errs.Append(fmt.Errorf("Project contains secret '%s'='%s' which is not loaded in the environment", k, envKey))
-				continue
+		checkSecretScopes("project", projectPath, acls.Variables, positions, &errs)
+		for k, definitions := range acls.Variables {
+			for _, d := range definitions {
+				value, err := resolve(r, d.Source, positions.Variable(k))
+				if err != nil {
+					errs.Append(positions.Variable(k).Errorf("Project contains secret '%s'='%s' which %s", k, d.Source, err))
+					continue
+				}
+				v := internal.NewVariable(k, value, d.VariableType, d.Protected, d.Masked, d.EnvironmentScope)
+				if !project.HasVariable(v.ID()) {
+					project.Variables[v.ID()] = v
+				}
 			}
-			project.Variables[k] = value
 		}
 
-		addSharedGroups := func(members []string, level internal.Level) {
-			for _, member := range members {
+		addSharedGroups := func(members []internal.Member, level internal.Level) {
+			for _, m := range members {
+				member := m.Username
+				position := positions.Member(member)
+				if !checkMember("project", projectPath, level, m, c.Teams, position, q, &errs) {
+					continue
+				}
 				if strings.HasPrefix(member, "share_with:") {
 					member = strings.TrimSpace(member[11:])
 					if !q.GroupExists(member) {
-						errs.Append(fmt.Errorf("can't share project '%s' with non-existing group '%s'", projectPath, member))
+						errs.Append(position.Errorf("can't share project '%s' with non-existing group '%s'", projectPath, member))
 						continue
 					}
 					project.addGroupSharing(member, level)
@@ -389,22 +549,41 @@ func configToLocalState(c internal.Config, q internal.Querier) (localState, erro
 						query:       strings.TrimSpace(member[6:]),
 						level:       level,
 						memberAdder: project,
+						origin:      Provenance{Level: level, Entry: member, File: c.Origins.Projects[projectPath]},
+						position:    position,
 					})
 					continue
 				}
 
-				if !q.IsUser(member) && !q.IsAdmin(member) {
-					errs.Append(fmt.Errorf("User '%s' does not exists for project '%s'", member, project))
+				if isTeam(member) {
+					t, ok := teams[teamName(member)]
+					if !ok {
+						continue
+					}
+					for _, tm := range t.members {
+						project.addMemberUntil(tm.Username, level, tm.Expires)
+						project.record(tm.Username, tm.provenance(level))
+					}
+					for _, tq := range t.queries {
+						queries = append(queries, query{
+							query:       tq.query(),
+							level:       level,
+							memberAdder: project,
+							origin:      tq.provenance(level),
+							position:    tq.position,
+						})
+					}
 					continue
 				}
 
-				if level == internal.Owner {
-					errs.Append(fmt.Errorf("User '%s' cannot be assigned as project owner of '%s', use groups for this level instead",
-						member, project))
+				if hasExpired(m) {
+					logrus.Warnf("membership of '%s' in project '%s' expired on %s, skipping it", member, projectPath, m.Expires)
 					continue
 				}
 
-				project.addMember(member, level)
+				project.addMemberUntil(member, level, m.Expires)
+				project.record(member, Provenance{Level: level, Entry: member, Expires: m.Expires,
+					File: c.Origins.Projects[projectPath]})
 			}
 		}
 
@@ -417,12 +596,6 @@ func configToLocalState(c internal.Config, q internal.Querier) (localState, erro
 		l.addProject(project)
 	}
 
-	for _, query := range queries {
-		if err := query.Execute(l, q); err != nil {
-			errs.Append(fmt.Errorf("failed to execute query %s: %s", query, err))
-		}
-	}
-
 	for _, u := range c.Users.Admins {
 		l.admins[u] = 1
 	}
@@ -435,111 +608,67 @@ func configToLocalState(c internal.Config, q internal.Querier) (localState, erro
 		l.bots[b.Username] = b.Email
 	}
 
-	return l, errs.ErrorOrNil()
-}
-
-var queryMatch = regexp.MustCompile("^(.*?) (?:from|in) (.*?)$")
-
-type query struct {
-	query       string
-	level       internal.Level
-	memberAdder memberAdder
-}
+	// queries can pick the bots and blocked users, so they are resolved last
+	resolveQueries(l, q, queries, &errs)
 
-type memberAdder interface {
-	addMember(member string, level internal.Level)
-	String() string
+	return l, errs.ErrorOrNil()
 }
 
-func (q query) String() string {
-	return fmt.Sprintf("'%s' for '%s/%s'", q.query, q.memberAdder, q.level)
+// resolve returns the value of a secret variable source, relative paths are
+// read from the directory of the file that declares it
+func resolve(r *secrets.Resolver, source string, declared internal.Position) (string, error) {
+	if r == nil {
+		return "", nil
+	}
+	return r.Resolve(source, filepath.Dir(declared.File))
 }
 
-func (q query) Execute(state localState, querier internal.Querier) error {
-	addMembers := func(members []string) error {
-		for _, member := range members {
-			q.memberAdder.addMember(member, q.level)
-		}
-		return nil
+func isAdditive(mode string) (bool, error) {
+	switch mode {
+	case "", internal.AuthoritativeMode:
+		return false, nil
+	case internal.AdditiveMode:
+		return true, nil
 	}
-
-	switch q.query {
-	case "users":
-		addMembers(querier.Users())
-		break
-
-	case "admins":
-		addMembers(querier.Admins())
-		break
-
-	default:
-		matching := queryMatch.FindAllStringSubmatch(q.query, -1)
-		if len(matching) == 0 {
-			return fmt.Errorf("Invalid query '%s'", q.query)
-		}
-		logrus.Debugf("matching query: %#v", matching)
-
-		queriedACL, queriedGroupName := matching[0][1], matching[0][2]
-		grp, ok := state.Group(queriedGroupName)
-		if !ok {
-			return fmt.Errorf("could not find group '%s' to resolve query '%s' in '%s/%s'",
-				queriedGroupName, q.query, q.memberAdder, q.level)
-		}
-		queriedGroup := grp.(*LocalGroup)
-		if queriedGroup.HasSubquery() {
-			return fmt.Errorf("group '%s' points at '%s/%s' which contains '%s'. Subquerying is not allowed",
-				queriedGroupName, q.memberAdder, q.level, q.query)
-		}
-
-		filterByLevel := func(members map[string]internal.Level, level internal.Level) []string {
-			matched := make([]string, 0)
-			for u, l := range members {
-				if l == level {
-					matched = append(matched, u)
-				}
-			}
-			return matched
+	return false, fmt.Errorf("invalid mode '%s', use %s or %s", mode, internal.AuthoritativeMode, internal.AdditiveMode)
+}
+
+// mergeExpiration adds a member declared in the configuration to the members
+// and returns the expirations
+func mergeExpiration(members map[string]internal.Level, expirations map[string]string,
+	username string, level internal.Level, expires string) map[string]string {
+	current, ok := members[username]
+	switch {
+	case ok && current > level:
+		return expirations
+	case ok && current == level:
+		previous, expiring := expirations[username]
+		if !expiring || (expires != "" && expires <= previous) {
+			return expirations
 		}
-		filterByAdminness := func(members map[string]internal.Level, shouldBeAdmin bool) []string {
-			matched := make([]string, 0)
-			for u := range members {
-				switch shouldBeAdmin {
-				case true:
-					if querier.IsAdmin(u) {
-						matched = append(matched, u)
-					}
-				default:
-					if querier.IsUser(u) {
-						matched = append(matched, u)
-					}
-				}
-			}
-			return matched
-		}
-
-		switch strings.Title(queriedACL) {
-		case "Guests":
-			return addMembers(filterByLevel(queriedGroup.GetMembers(), internal.Guest))
-
-		case "Reporters":
-			return addMembers(filterByLevel(queriedGroup.GetMembers(), internal.Reporter))
-
-		case "Developers":
-			return addMembers(filterByLevel(queriedGroup.GetMembers(), internal.Developer))
-
-		case "Maintainers":
-			return addMembers(filterByLevel(queriedGroup.GetMembers(), internal.Maintainer))
-
-		case "Owners":
-			return addMembers(filterByLevel(queriedGroup.GetMembers(), internal.Owner))
-
-		case "Admins":
-			return addMembers(filterByAdminness(queriedGroup.GetMembers(), true))
+	}
 
-		case "Users":
-			return addMembers(filterByAdminness(queriedGroup.GetMembers(), false))
+	members[username] = level
+	if expires == "" {
+		delete(expirations, username)
+		return expirations
+	}
+	if expirations == nil {
+		expirations = make(map[string]string)
+	}
+	expirations[username] = expires
+	return expirations
+}
 
-		}
+// hasExpired returns true when the member expiration date is today or earlier,
+// as gitlab removes the membership at the start of that day
+func hasExpired(m internal.Member) bool {
+	if m.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(internal.ExpiresFormat, m.Expires)
+	if err != nil {
+		return false // already validated when loading the configuration
 	}
-	return nil
+	return !expires.After(time.Now())
 }
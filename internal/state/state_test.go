@@ -64,7 +64,8 @@ func TestLoadingState(t *testing.T) {
 		{
 			"group with blocked user fails",
 			"fixtures/bad-actor.yaml",
-			"failed to build local state: 1 error: User 'bad_actor_1' is blocked, it should not be included in group 'root_group'",
+			"failed to build local state: 1 error: fixtures/bad-actor.yaml:5:7: " +
+				"User 'bad_actor_1' is blocked, it should not be included in group 'root_group'",
 			nil,
 			nil,
 			nil,
@@ -90,33 +91,49 @@ func TestLoadingState(t *testing.T) {
 			"non existing user and group",
 			"fixtures/non_existing.yaml",
 			"failed to build local state: " +
-				"2 errors: Group 'non_existing_group' does not exist; " +
-				"User 'non_existing' does not exist for group 'root_group'",
+				"2 errors: fixtures/non_existing.yaml:3:3: Group 'non_existing_group' does not exist; " +
+				"fixtures/non_existing.yaml:8:7: User 'non_existing' does not exist for group 'root_group'",
 			nil,
 			nil,
 			nil,
 		},
 		{
-			"invalid because of subqueries",
-			"fixtures/invalid-with-subqueries.yaml",
-			"failed to build local state: " +
-				"1 error: failed to execute query 'owners from root_group' for 'skrrty/Guest': " +
-				"group 'root_group' points at 'skrrty/Guest' which contains 'owners from root_group'. " +
-				"Subquerying is not allowed",
-			[]hurrdurr.LocalGroup{},
-			nil,
+			"nested queries",
+			"fixtures/with-nested-queries.yaml",
+			"",
+			[]hurrdurr.LocalGroup{
+				{
+					Fullpath:   "root_group",
+					SharedWith: map[string]internal.Level{},
+					Members: map[string]internal.Level{
+						"admin": internal.Owner,
+					},
+					Subquery:  true,
+					Variables: map[string]internal.Variable{},
+				},
+				{
+					Fullpath:   "skrrty",
+					SharedWith: map[string]internal.Level{},
+					Members: map[string]internal.Level{
+						"admin": internal.Owner,
+					},
+					Subquery:  true,
+					Variables: map[string]internal.Variable{},
+				},
+			},
 			nil,
+			[]hurrdurr.LocalProject{},
 		},
 		{
-			"invalid because of non existing group in query",
+			"invalid because of non existing group and acl in query",
 			"fixtures/invalid-subquery.yaml",
 			"failed to build local state: " +
-				"2 errors: failed to execute query 'guests from non_existing_group' " +
+				"2 errors: fixtures/invalid-subquery.yaml:5:7: failed to execute query 'guests from non_existing_group' " +
 				"for 'root_group/Guest': could not find group 'non_existing_group' " +
 				"to resolve query 'guests from non_existing_group' in 'root_group/Guest'; " +
-				"failed to execute query 'whatever from root_group' for 'root_group/Reporter': " +
-				"group 'root_group' points at 'root_group/Reporter' which contains " +
-				"'whatever from root_group'. Subquerying is not allowed",
+				"fixtures/invalid-subquery.yaml:9:7: invalid query 'whatever from root_group' for 'root_group/Reporter': " +
+				"invalid acl 'whatever', use one of guests, reporters, developers, maintainers, owners, " +
+				"admins, bots or users at position 1",
 			[]hurrdurr.LocalGroup{},
 			nil,
 			nil,
@@ -124,7 +141,27 @@ func TestLoadingState(t *testing.T) {
 		{
 			"invalid because of blocked user being assigned",
 			"fixtures/invalid-with-blocked-user.yaml",
-			"failed to build local state: 1 error: User 'bad_actor_1' is blocked, it should not be included in group 'root_group'",
+			"failed to build local state: 1 error: fixtures/invalid-with-blocked-user.yaml:8:7: " +
+				"User 'bad_actor_1' is blocked, it should not be included in group 'root_group'",
+			[]hurrdurr.LocalGroup{},
+			nil,
+			nil,
+		},
+		{
+			"invalid because of unknown mode",
+			"fixtures/invalid-mode.yaml",
+			"failed to build local state: 1 error: fixtures/invalid-mode.yaml:3:3: " +
+				"invalid mode 'lenient', use authoritative or additive for group 'root_group'",
+			[]hurrdurr.LocalGroup{},
+			nil,
+			nil,
+		},
+		{
+			"invalid because of a secret defined twice for the same scope",
+			"fixtures/invalid-duplicated-secret-scope.yaml",
+			"failed to build local state: 1 error: fixtures/invalid-duplicated-secret-scope.yaml:7:7: " +
+				"Group 'root_group' defines secret 'mygroupkey' " +
+				"more than once for environment scope 'production'",
 			[]hurrdurr.LocalGroup{},
 			nil,
 			nil,
@@ -140,7 +177,7 @@ func TestLoadingState(t *testing.T) {
 					Members: map[string]internal.Level{
 						"user2": internal.Owner,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 				{
 					Fullpath:   "root_group",
@@ -149,7 +186,7 @@ func TestLoadingState(t *testing.T) {
 						"admin": internal.Owner,
 						"user1": internal.Developer,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 			},
 			[]string{"simple_group", "skrrty", "yet_another_group"},
@@ -166,7 +203,7 @@ func TestLoadingState(t *testing.T) {
 					Members: map[string]internal.Level{
 						"user2": internal.Owner,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 				{
 					Fullpath:   "root_group",
@@ -175,7 +212,7 @@ func TestLoadingState(t *testing.T) {
 						"admin": internal.Owner,
 						"user1": internal.Developer,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 			},
 			[]string{"simple_group", "skrrty", "yet_another_group"},
@@ -189,7 +226,7 @@ func TestLoadingState(t *testing.T) {
 						"admin": internal.Maintainer,
 						"user2": internal.Developer,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 			},
 		},
@@ -209,7 +246,7 @@ func TestLoadingState(t *testing.T) {
 						"user3": internal.Developer,
 						"user4": internal.Developer,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 				{
 					Fullpath:   "root_group",
@@ -217,7 +254,7 @@ func TestLoadingState(t *testing.T) {
 					Members: map[string]internal.Level{
 						"admin": internal.Owner,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 				{
 					Fullpath:   "simple_group",
@@ -229,7 +266,7 @@ func TestLoadingState(t *testing.T) {
 						"user3": internal.Reporter,
 						"user4": internal.Guest,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 				{
 					Fullpath:   "skrrty",
@@ -242,7 +279,7 @@ func TestLoadingState(t *testing.T) {
 						"user3": internal.Guest,
 						"user4": internal.Guest,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 				{
 					Fullpath:   "yet_another_group",
@@ -255,7 +292,7 @@ func TestLoadingState(t *testing.T) {
 						"user3": internal.Reporter,
 						"user4": internal.Guest,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 			},
 			[]string{},
@@ -273,7 +310,7 @@ func TestLoadingState(t *testing.T) {
 					Members: map[string]internal.Level{
 						"admin": internal.Owner,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 			},
 			[]string{"other_group", "simple_group", "skrrty", "yet_another_group"},
@@ -290,7 +327,7 @@ func TestLoadingState(t *testing.T) {
 					Members: map[string]internal.Level{
 						"user2": internal.Owner,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
 				},
 				{
 					Fullpath: "root_group",
@@ -301,12 +338,120 @@ func TestLoadingState(t *testing.T) {
 						"user1": internal.Developer,
 						"admin": internal.Owner,
 					},
-					Variables: map[string]string{},
+					Variables: map[string]internal.Variable{},
+				},
+			},
+			[]string{"other_group", "simple_group", "skrrty", "yet_another_group"},
+			[]hurrdurr.LocalProject{},
+		},
+		{
+			"members with expiration dates",
+			"fixtures/plain-with-expiring-members.yaml",
+			"",
+			[]hurrdurr.LocalGroup{
+				{
+					Fullpath:   "root_group",
+					SharedWith: map[string]internal.Level{},
+					Members: map[string]internal.Level{
+						"admin": internal.Owner,
+						"user1": internal.Developer,
+					},
+					Expirations: map[string]string{
+						"user1": "2099-12-31",
+					},
+					Variables: map[string]internal.Variable{},
+				},
+			},
+			[]string{"other_group", "simple_group", "skrrty", "yet_another_group"},
+			[]hurrdurr.LocalProject{
+				{
+					Fullpath:     "root_group/a_project",
+					SharedGroups: map[string]internal.Level{},
+					Members: map[string]internal.Level{
+						"user3": internal.Reporter,
+					},
+					Expirations: map[string]string{
+						"user3": "2099-06-30",
+					},
+					Variables: map[string]internal.Variable{},
+				},
+			},
+		},
+		{
+			"members declared more than once with expiration dates",
+			"fixtures/plain-with-overlapping-expirations.yaml",
+			"",
+			[]hurrdurr.LocalGroup{
+				{
+					Fullpath:   "root_group",
+					SharedWith: map[string]internal.Level{},
+					Members: map[string]internal.Level{
+						"admin": internal.Owner,
+						"user1": internal.Developer,
+						"user2": internal.Developer,
+						"user3": internal.Developer,
+						"user4": internal.Developer,
+					},
+					Subquery: true,
+					Expirations: map[string]string{
+						"user2": "2099-12-31",
+						"user3": "2099-12-31",
+					},
+					Variables: map[string]internal.Variable{},
+				},
+			},
+			[]string{"other_group", "simple_group", "skrrty", "yet_another_group"},
+			[]hurrdurr.LocalProject{
+				{
+					Fullpath:     "root_group/a_project",
+					SharedGroups: map[string]internal.Level{},
+					Members: map[string]internal.Level{
+						"user1": internal.Developer,
+						"user2": internal.Developer,
+						"user3": internal.Reporter,
+						"user4": internal.Reporter,
+					},
+					Expirations: map[string]string{
+						"user2": "2099-12-31",
+						"user3": "2099-12-31",
+					},
+					Variables: map[string]internal.Variable{},
+				},
+			},
+		},
+		{
+			"query raising the level of an expiring member",
+			"fixtures/plain-with-expiring-member-raised-by-query.yaml",
+			"",
+			[]hurrdurr.LocalGroup{
+				{
+					Fullpath:   "root_group",
+					SharedWith: map[string]internal.Level{},
+					Members: map[string]internal.Level{
+						"admin": internal.Owner,
+						"user1": internal.Maintainer,
+						"user2": internal.Maintainer,
+						"user3": internal.Maintainer,
+						"user4": internal.Maintainer,
+					},
+					Subquery:    true,
+					Expirations: map[string]string{},
+					Variables:   map[string]internal.Variable{},
 				},
 			},
 			[]string{"other_group", "simple_group", "skrrty", "yet_another_group"},
 			[]hurrdurr.LocalProject{},
 		},
+		{
+			"invalid because a query can't expire",
+			"fixtures/invalid-expiring-query.yaml",
+			"failed to build local state: 1 error: fixtures/invalid-expiring-query.yaml:7:7: " +
+				"'query: users' in group 'root_group' can't expire, " +
+				"expiration dates are only supported for users",
+			[]hurrdurr.LocalGroup{},
+			nil,
+			nil,
+		},
 	}
 
 	loadState := func(filename string, querier internal.Querier) (internal.State, error) {
@@ -314,7 +459,7 @@ func TestLoadingState(t *testing.T) {
 		if err != nil {
 			return nil, err
 		}
-		return hurrdurr.LoadStateFromFile(c, querier)
+		return hurrdurr.LoadStateFromFile(c, querier, resolver)
 
 	}
 
@@ -362,6 +507,7 @@ type querierMock struct {
 	blocked     map[string]bool
 	groups      map[string]bool
 	projects    map[string]bool
+	attributes  map[string]internal.UserAttributes
 }
 
 func (q querierMock) CurrentUser() string {
@@ -435,3 +581,8 @@ func (querierMock) GetUserID(_ string) int {
 func (querierMock) GetUserEmail(string) (string, bool) {
 	return "", false
 }
+
+func (q querierMock) GetUserAttributes(u string) (internal.UserAttributes, bool) {
+	a, ok := q.attributes[u]
+	return a, ok
+}
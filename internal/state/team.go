@@ -0,0 +1,167 @@
+package state
+
+import (
+	"sort"
+	"strings"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// team is a resolved team, with the members of the teams it includes and
+// only the users that are valid
+type team struct {
+	members []teamEntry
+	queries []teamEntry
+}
+
+// teamEntry is a user or a query of a team along with the chain of teams it
+// is included through and the file and position it is written in
+type teamEntry struct {
+	internal.Member
+	teams    []string
+	file     string
+	position internal.Position
+}
+
+// query returns the query of a query entry
+func (e teamEntry) query() string {
+	return strings.TrimSpace(e.Username[6:])
+}
+
+func (e teamEntry) provenance(level internal.Level) Provenance {
+	return Provenance{
+		Level:   level,
+		Entry:   e.Username,
+		Expires: e.Expires,
+		Teams:   e.teams,
+		File:    e.file,
+	}
+}
+
+// included returns the entries of an included team as entries of the team
+// with the given name
+func included(name string, entries []teamEntry) []teamEntry {
+	result := make([]teamEntry, 0, len(entries))
+	for _, e := range entries {
+		e.teams = append([]string{name}, e.teams...)
+		result = append(result, e)
+	}
+	return result
+}
+
+func isTeam(member string) bool {
+	return strings.HasPrefix(member, "team:")
+}
+
+func teamName(member string) string {
+	return strings.TrimSpace(member[5:])
+}
+
+// resolveTeams validates the entries of every team and expands the teams they
+// include. Teams that are part of a cycle, or that include one, are not
+// resolved.
+func resolveTeams(teams map[string][]internal.Member, files map[string]string,
+	positions map[string]internal.EntryPositions, users userChecker, errs *errors.Errors) map[string]team {
+	resolved := make(map[string]team, len(teams))
+	failed := make(map[string]bool)
+	stack := make([]string, 0)
+
+	var resolve func(name string) (team, bool)
+	resolve = func(name string) (team, bool) {
+		if t, ok := resolved[name]; ok {
+			return t, true
+		}
+		if failed[name] {
+			return team{}, false
+		}
+		for i, n := range stack {
+			if n == name {
+				cycle := append(append([]string{}, stack[i:]...), name)
+				errs.Append(positions[name].Errorf("teams form a cycle: %s", strings.Join(cycle, " -> ")))
+				return team{}, false
+			}
+		}
+
+		stack = append(stack, name)
+		defer func() { stack = stack[:len(stack)-1] }()
+
+		t := team{
+			members: make([]teamEntry, 0),
+			queries: make([]teamEntry, 0),
+		}
+		ok := true
+		for _, m := range teams[name] {
+			member := m.Username
+			position := positions[name].Member(member)
+			entry := teamEntry{
+				Member:   m,
+				teams:    []string{name},
+				file:     files[name],
+				position: position,
+			}
+			if m.Expires != "" && (isTeam(member) || strings.HasPrefix(member, "query:")) {
+				errs.Append(position.Errorf("'%s' in team '%s' can't expire, expiration dates are only supported for users", member, name))
+				continue
+			}
+			switch {
+			case strings.HasPrefix(member, "share_with:"):
+				errs.Append(position.Errorf("'%s' in team '%s' is not supported, teams can only include users, queries and teams",
+					member, name))
+
+			case strings.HasPrefix(member, "query:"):
+				if _, err := parseQuery(entry.query()); err != nil {
+					errs.Append(position.Errorf("invalid query '%s' in team '%s': %s", entry.query(), name, err))
+					continue
+				}
+				t.queries = append(t.queries, entry)
+
+			case isTeam(member):
+				other := teamName(member)
+				if _, exists := teams[other]; !exists {
+					errs.Append(position.Errorf("team '%s' included in team '%s' does not exist", other, name))
+					continue
+				}
+				includedTeam, resolvedOK := resolve(other)
+				if !resolvedOK {
+					ok = false
+					continue
+				}
+				t.members = append(t.members, included(name, includedTeam.members)...)
+				t.queries = append(t.queries, included(name, includedTeam.queries)...)
+
+			case users.IsBlocked(member):
+				errs.Append(position.Errorf("User '%s' is blocked, it should not be included in team '%s'", member, name))
+
+			case !users.IsUser(member) && !users.IsAdmin(member):
+				errs.Append(position.Errorf("User '%s' does not exist for team '%s'", member, name))
+
+			case hasExpired(m):
+				logrus.Warnf("membership of '%s' in team '%s' expired on %s, skipping it", member, name, m.Expires)
+
+			default:
+				t.members = append(t.members, entry)
+			}
+		}
+
+		if !ok {
+			failed[name] = true
+			return team{}, false
+		}
+		resolved[name] = t
+		return t, true
+	}
+
+	names := make([]string, 0, len(teams))
+	for name := range teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resolve(name)
+	}
+
+	return resolved
+}
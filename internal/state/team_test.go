@@ -0,0 +1,157 @@
+package state_test
+
+import (
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadingStateWithTeams(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := util.LoadConfig("fixtures/with-teams.yaml", false)
+	a.NoError(err)
+
+	s, err := state.LoadStateFromFile(c, querier, resolver)
+	a.NoError(err)
+
+	g, ok := s.Group("root_group")
+	a.True(ok)
+	a.Equal(map[string]internal.Level{
+		"admin": internal.Owner,
+		"user1": internal.Developer,
+		"user2": internal.Developer,
+		"user3": internal.Developer,
+	}, g.GetMembers())
+
+	g, ok = s.Group("skrrty")
+	a.True(ok)
+	a.Equal(map[string]internal.Level{
+		"admin": internal.Owner,
+		"user2": internal.Reporter,
+		"user3": internal.Reporter,
+	}, g.GetMembers())
+
+	p, ok := s.Project("root_group/a_project")
+	a.True(ok)
+	a.Equal(map[string]internal.Level{
+		"user1": internal.Maintainer,
+		"user2": internal.Maintainer,
+		"user3": internal.Maintainer,
+	}, p.GetMembers())
+}
+
+func TestInvalidTeams(t *testing.T) {
+	q := querier
+	q.blocked = map[string]bool{"baduser": true}
+
+	tt := []struct {
+		name          string
+		teams         map[string][]internal.Member
+		group         []internal.Member
+		project       internal.Acls
+		expectedError string
+	}{
+		{
+			name:  "non existing user",
+			teams: map[string][]internal.Member{"sre": {{Username: "nobody"}}},
+			expectedError: "failed to build local state: 1 error: " +
+				"User 'nobody' does not exist for team 'sre'",
+		},
+		{
+			name:  "blocked user",
+			teams: map[string][]internal.Member{"sre": {{Username: "baduser"}}},
+			expectedError: "failed to build local state: 1 error: " +
+				"User 'baduser' is blocked, it should not be included in team 'sre'",
+		},
+		{
+			name:  "sharing",
+			teams: map[string][]internal.Member{"sre": {{Username: "share_with: other_group"}}},
+			expectedError: "failed to build local state: 1 error: " +
+				"'share_with: other_group' in team 'sre' is not supported, teams can only include users, queries and teams",
+		},
+		{
+			name:  "expiring team",
+			teams: map[string][]internal.Member{"sre": {{Username: "user1"}}},
+			group: []internal.Member{{Username: "team: sre", Expires: "2100-01-01"}},
+			expectedError: "failed to build local state: 1 error: " +
+				"'team: sre' in group 'skrrty' can't expire, expiration dates are only supported for users",
+		},
+		{
+			name:  "non existing team in a group",
+			group: []internal.Member{{Username: "team: sre"}},
+			expectedError: "failed to build local state: 1 error: " +
+				"team 'sre' in group 'skrrty' does not exist",
+		},
+		{
+			name:    "non existing team in a project",
+			project: internal.Acls{Developers: []internal.Member{{Username: "team: sre"}}},
+			expectedError: "failed to build local state: 1 error: " +
+				"team 'sre' in project 'root_group/a_project' does not exist",
+		},
+		{
+			name:  "non existing included team",
+			teams: map[string][]internal.Member{"sre": {{Username: "team: oncall"}}},
+			expectedError: "failed to build local state: 1 error: " +
+				"team 'oncall' included in team 'sre' does not exist",
+		},
+		{
+			name: "cycle",
+			teams: map[string][]internal.Member{
+				"sre":    {{Username: "user1"}, {Username: "team: oncall"}},
+				"oncall": {{Username: "user2"}, {Username: "team: sre"}},
+			},
+			group: []internal.Member{{Username: "team: sre"}},
+			expectedError: "failed to build local state: 1 error: " +
+				"teams form a cycle: oncall -> sre -> oncall",
+		},
+		{
+			name:    "project owners",
+			teams:   map[string][]internal.Member{"sre": {{Username: "user1"}}},
+			project: internal.Acls{Owners: []internal.Member{{Username: "team: sre"}}},
+			expectedError: "failed to build local state: 1 error: " +
+				"Team 'sre' cannot be assigned as project owner of 'root_group/a_project', use groups for this level instead",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			c := internal.Config{
+				Teams: tc.teams,
+				Groups: map[string]internal.Acls{
+					"skrrty": {
+						Owners:     []internal.Member{{Username: "admin"}},
+						Developers: tc.group,
+					},
+				},
+				Projects: map[string]internal.Acls{
+					"root_group/a_project": tc.project,
+				},
+			}
+
+			_, err := state.LoadStateFromFile(c, q, resolver)
+			a.EqualError(err, tc.expectedError)
+		})
+	}
+}
+
+func TestTeamErrorsHavePositions(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := util.LoadConfig("fixtures/with-positions.yaml", false)
+	a.NoError(err)
+
+	_, err = state.LoadStateFromFile(c, querier, resolver)
+	a.EqualError(err, "failed to build local state: 3 errors: "+
+		"fixtures/with-positions.yaml:5:5: User 'nobody' does not exist for team 'sre'; "+
+		"fixtures/with-positions.yaml:6:5: invalid query 'whatever in root_group' in team 'sre': "+
+		"invalid acl 'whatever', use one of guests, reporters, developers, maintainers, owners, admins, bots or users "+
+		"at position 1; "+
+		"fixtures/with-positions.yaml:16:7: team 'missing' in project 'root_group/a_project' does not exist")
+}
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+)
+
+// UnmanagedMembers returns the memberships and sharings that additive groups
+// and projects keep in the current state beyond what the desired state declares
+func UnmanagedMembers(current, desired internal.State) []string {
+	unmanaged := make([]string, 0)
+
+	for _, desiredGroup := range desired.Groups() {
+		if !desiredGroup.IsAdditive() {
+			continue
+		}
+		currentGroup, ok := current.Group(desiredGroup.GetFullpath())
+		if !ok {
+			continue
+		}
+		unmanaged = append(unmanaged, unmanagedLevels("group", desiredGroup.GetFullpath(), "member",
+			currentGroup.GetMembers(), desiredGroup.GetMembers())...)
+		unmanaged = append(unmanaged, unmanagedLevels("group", desiredGroup.GetFullpath(), "shared group",
+			currentGroup.GetSharedGroups(), desiredGroup.GetSharedGroups())...)
+	}
+
+	for _, desiredProject := range desired.Projects() {
+		if !desiredProject.IsAdditive() {
+			continue
+		}
+		currentProject, ok := current.Project(desiredProject.GetFullpath())
+		if !ok {
+			continue
+		}
+		unmanaged = append(unmanaged, unmanagedLevels("project", desiredProject.GetFullpath(), "member",
+			currentProject.GetMembers(), desiredProject.GetMembers())...)
+		unmanaged = append(unmanaged, unmanagedLevels("project", desiredProject.GetFullpath(), "shared group",
+			currentProject.GetSharedGroups(), desiredProject.GetSharedGroups())...)
+	}
+
+	sort.Strings(unmanaged)
+	return unmanaged
+}
+
+func unmanagedLevels(kind, fullpath, what string, current, desired map[string]internal.Level) []string {
+	unmanaged := make([]string, 0)
+	for name, currentLevel := range current {
+		desiredLevel, ok := desired[name]
+		if !ok {
+			unmanaged = append(unmanaged, fmt.Sprintf("%s '%s' %s '%s' at level '%s' is not managed",
+				kind, fullpath, what, name, currentLevel))
+		} else if currentLevel > desiredLevel {
+			unmanaged = append(unmanaged, fmt.Sprintf("%s '%s' %s '%s' is kept at level '%s' above the desired '%s'",
+				kind, fullpath, what, name, currentLevel, desiredLevel))
+		}
+	}
+	return unmanaged
+}
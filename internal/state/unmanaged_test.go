@@ -0,0 +1,63 @@
+package state_test
+
+import (
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmanagedMembers(t *testing.T) {
+	tt := []struct {
+		name         string
+		currentState string
+		desiredState string
+		expected     []string
+	}{
+		{
+			"authoritative entries have no unmanaged members",
+			"fixtures/plain-with-other-levels-project.yaml",
+			"fixtures/plain-with-project.yaml",
+			[]string{},
+		},
+		{
+			"additive entries report extra and higher members",
+			"fixtures/plain-with-other-levels-project.yaml",
+			"fixtures/plain-with-additive-project.yaml",
+			[]string{
+				"group 'root_group' member 'user1' at level 'Developer' is not managed",
+				"project 'root_group/a_project' member 'user1' at level 'Developer' is not managed",
+				"project 'root_group/a_project' member 'user2' is kept at level 'Maintainer' above the desired 'Developer'",
+				"project 'root_group/a_project' member 'user3' at level 'Reporter' is not managed",
+			},
+		},
+		{
+			"additive entries missing in the current state are ignored",
+			"fixtures/plain-minimal.yaml",
+			"fixtures/plain-with-additive-project.yaml",
+			[]string{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			currentConfig, err := util.LoadConfig(tc.currentState, false)
+			a.NoError(err, "current config")
+
+			currentState, err := state.LoadStateFromFile(currentConfig, querier, resolver)
+			a.NoError(err, "current state")
+
+			desiredConfig, err := util.LoadConfig(tc.desiredState, false)
+			a.NoError(err, "desired config")
+
+			desiredState, err := state.LoadStateFromFile(desiredConfig, querier, resolver)
+			a.NoError(err, "desired state")
+
+			a.Equal(tc.expected, state.UnmanagedMembers(currentState, desiredState))
+		})
+	}
+}
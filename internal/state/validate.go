@@ -0,0 +1,157 @@
+package state
+
+import (
+	"strings"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+)
+
+// Validate runs the checks of the configuration that don't need GitLab: modes,
+// queries syntax, teams, expirations, secrets defined twice, blocked users,
+// project owners and bots. They are the same checks the desired state is
+// loaded with, but it doesn't check that groups, projects and users exist.
+func Validate(c internal.Config, botUsernameRegex string) error {
+	errs := errors.New()
+	errs.Append(util.ValidateBots(c.Bots, botUsernameRegex))
+
+	users := offlineUsers(make(map[string]bool, len(c.Users.Blocked)))
+	for _, u := range c.Users.Blocked {
+		users[u] = true
+	}
+
+	resolveTeams(c.Teams, c.Origins.Teams, c.Positions.Teams, users, &errs)
+	for name, acls := range c.Groups {
+		checkAcls("group", name, acls, c.Teams, c.Positions.Groups[name], users, &errs)
+	}
+	for name, acls := range c.Projects {
+		checkAcls("project", name, acls, c.Teams, c.Positions.Projects[name], users, &errs)
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// userChecker tells which users can be members, it's the querier when the
+// desired state is loaded
+type userChecker interface {
+	IsUser(username string) bool
+	IsAdmin(username string) bool
+	IsBlocked(username string) bool
+}
+
+// offlineUsers takes every user as existing but the ones blocked in the
+// configuration, as gitlab is not available
+type offlineUsers map[string]bool
+
+func (offlineUsers) IsUser(string) bool {
+	return true
+}
+
+func (offlineUsers) IsAdmin(string) bool {
+	return false
+}
+
+func (u offlineUsers) IsBlocked(username string) bool {
+	return u[username]
+}
+
+// checkAcls runs the checks of a group or project and of every one of its
+// members
+func checkAcls(kind, name string, acls internal.Acls, teams map[string][]internal.Member,
+	positions internal.EntryPositions, users userChecker, errs *errors.Errors) {
+	checkMode(kind, name, acls.Mode, positions, errs)
+	checkSecretScopes(kind, name, acls.Variables, positions, errs)
+
+	for _, l := range []struct {
+		level   internal.Level
+		members []internal.Member
+	}{
+		{internal.Owner, acls.Owners},
+		{internal.Maintainer, acls.Maintainers},
+		{internal.Developer, acls.Developers},
+		{internal.Reporter, acls.Reporters},
+		{internal.Guest, acls.Guests},
+	} {
+		for _, m := range l.members {
+			checkMember(kind, name, l.level, m, teams, positions.Member(m.Username), users, errs)
+		}
+	}
+}
+
+// checkMode returns whether the mode of a group or project is additive, and
+// false as second value when the mode is not valid
+func checkMode(kind, name, mode string, positions internal.EntryPositions, errs *errors.Errors) (bool, bool) {
+	additive, err := isAdditive(mode)
+	if err != nil {
+		errs.Append(positions.Errorf("%s for %s '%s'", err, kind, name))
+		return false, false
+	}
+	return additive, true
+}
+
+// checkSecretScopes fails for every secret variable defined more than once
+// for the same environment scope
+func checkSecretScopes(kind, name string, variables map[string]internal.VariableDefinitions,
+	positions internal.EntryPositions, errs *errors.Errors) {
+	for key, definitions := range variables {
+		scopes := make(map[string]bool, len(definitions))
+		for _, d := range definitions {
+			scope := internal.NewVariable(key, "", d.VariableType, d.Protected, d.Masked, d.EnvironmentScope).EnvironmentScope
+			if scopes[scope] {
+				errs.Append(positions.Variable(key).Errorf("%s '%s' defines secret '%s' more than once for environment scope '%s'",
+					strings.Title(kind), name, key, scope))
+			}
+			scopes[scope] = true
+		}
+	}
+}
+
+// checkMember returns false when the member can't be added to the group or
+// project at the given level. Groups to share with are not checked, it needs
+// gitlab.
+func checkMember(kind, name string, level internal.Level, m internal.Member, teams map[string][]internal.Member,
+	position internal.Position, users userChecker, errs *errors.Errors) bool {
+	member := m.Username
+	if m.Expires != "" && (strings.HasPrefix(member, "share_with:") || strings.HasPrefix(member, "query:") || isTeam(member)) {
+		errs.Append(position.Errorf("'%s' in %s '%s' can't expire, expiration dates are only supported for users",
+			member, kind, name))
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(member, "share_with:"):
+
+	case strings.HasPrefix(member, "query:"):
+		if _, err := parseQuery(strings.TrimSpace(member[6:])); err != nil {
+			errs.Append(position.Errorf("invalid query '%s' for '%s/%s': %s", strings.TrimSpace(member[6:]),
+				name, level, err))
+			return false
+		}
+
+	case isTeam(member):
+		if _, ok := teams[teamName(member)]; !ok {
+			errs.Append(position.Errorf("team '%s' in %s '%s' does not exist", teamName(member), kind, name))
+			return false
+		}
+		if kind == "project" && level == internal.Owner {
+			errs.Append(position.Errorf("Team '%s' cannot be assigned as project owner of '%s', use groups for this level instead",
+				teamName(member), name))
+			return false
+		}
+
+	case users.IsBlocked(member):
+		errs.Append(position.Errorf("User '%s' is blocked, it should not be included in %s '%s'", member, kind, name))
+		return false
+
+	case !users.IsUser(member) && !users.IsAdmin(member):
+		errs.Append(position.Errorf("User '%s' does not exist for %s '%s'", member, kind, name))
+		return false
+
+	case kind == "project" && level == internal.Owner:
+		errs.Append(position.Errorf("User '%s' cannot be assigned as project owner of '%s', use groups for this level instead",
+			member, name))
+		return false
+	}
+	return true
+}
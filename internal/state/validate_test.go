@@ -0,0 +1,90 @@
+package state_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatingConfigurationOffline(t *testing.T) {
+	tt := []struct {
+		name          string
+		filename      string
+		expectedError string
+	}{
+		{
+			name:     "valid configuration",
+			filename: "fixtures/with-teams.yaml",
+		},
+		{
+			name:     "invalid configuration",
+			filename: "fixtures/invalid-offline.yaml",
+			expectedError: "10 errors: " +
+				"fixtures/invalid-offline.yaml:11:5: 'share_with: root_group' in team 'sre' is not supported, " +
+				"teams can only include users, queries and teams; " +
+				"fixtures/invalid-offline.yaml:13:3: teams form a cycle: oncall -> sre -> oncall; " +
+				"fixtures/invalid-offline.yaml:15:5: invalid query 'developers of root_group' in team 'oncall': " +
+				"expected 'in' or 'from' after 'developers' at position 12; " +
+				"fixtures/invalid-offline.yaml:17:3: invalid mode 'lenient', use authoritative or additive " +
+				"for group 'root_group'; " +
+				"fixtures/invalid-offline.yaml:23:7: User 'baduser' is blocked, it should not be included in group 'root_group'; " +
+				"fixtures/invalid-offline.yaml:24:7: invalid query '(users' for 'root_group/Developer': " +
+				"unclosed '(' at position 1; " +
+				"fixtures/invalid-offline.yaml:28:7: User 'user1' cannot be assigned as project owner of " +
+				"'root_group/a_project', use groups for this level instead; " +
+				"fixtures/invalid-offline.yaml:29:7: Team 'sre' cannot be assigned as project owner of " +
+				"'root_group/a_project', use groups for this level instead; " +
+				"fixtures/invalid-offline.yaml:31:7: Project 'root_group/a_project' defines secret 'KEY' more than once " +
+				"for environment scope '*'; " +
+				"invalid bot username not-a-bot",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			c, err := util.LoadConfig(tc.filename, false)
+			a.NoError(err)
+
+			err = state.Validate(c, "^bot_[a-z]+$")
+			if tc.expectedError == "" {
+				a.NoError(err)
+				return
+			}
+			a.EqualError(err, tc.expectedError)
+		})
+	}
+}
+
+func TestValidatingReportsTheErrorsOfLoadingTheState(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := util.LoadConfig("fixtures/invalid-offline.yaml", false)
+	a.NoError(err)
+
+	a.NoError(os.Setenv("SOURCE", "value"))
+	a.NoError(os.Setenv("OTHER", "value"))
+	defer os.Unsetenv("SOURCE")
+	defer os.Unsetenv("OTHER")
+
+	q := querier
+	q.users = map[string]bool{"user1": true, "baduser": true}
+	q.blocked = map[string]bool{"baduser": true}
+
+	_, loadErr := state.LoadStateFromFile(c, q, resolver)
+	validateErr := state.Validate(c, "^bot_[a-z]+$")
+	a.Error(loadErr)
+	a.Error(validateErr)
+
+	loaded := strings.SplitN(loadErr.Error(), " errors: ", 2)
+	a.Len(loaded, 2)
+	for _, e := range strings.Split(loaded[1], "; ") {
+		a.Contains(validateErr.Error(), e)
+	}
+}
@@ -0,0 +1,129 @@
+package util
+
+import (
+	"bytes"
+	"io"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// decodeConfig parses a configuration file once, failing on unknown fields,
+// and records where its sections, groups, projects, teams, members and secret
+// variables are defined
+func decodeConfig(filename string, content []byte) (internal.Config, error) {
+	d := document{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&d); err != nil && err != io.EOF {
+		return d.config, err
+	}
+	d.config.Positions = positions(filename, (*yaml.Node)(&d.root))
+
+	return d.config, nil
+}
+
+// document is a configuration file decoded along with its root node. Node.Decode
+// can't check for unknown fields, so both are decoded from the same node by
+// the decoder instead.
+type document struct {
+	config internal.Config
+	root   root
+}
+
+// UnmarshalYAML implements the obsolete yaml.Unmarshaler, as it decodes with
+// the options of the decoder
+func (d *document) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&d.root); err != nil {
+		return err
+	}
+	return unmarshal(&d.config)
+}
+
+// root keeps the node it's decoded from
+type root yaml.Node
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (r *root) UnmarshalYAML(n *yaml.Node) error {
+	*r = root(*n)
+	return nil
+}
+
+func positions(filename string, root *yaml.Node) internal.Positions {
+	p := internal.Positions{
+		Sections: make(map[string]internal.Position),
+		Groups:   make(map[string]internal.EntryPositions),
+		Projects: make(map[string]internal.EntryPositions),
+		Teams:    make(map[string]internal.EntryPositions),
+	}
+
+	at := func(n *yaml.Node) internal.Position {
+		return internal.Position{File: filename, Line: n.Line, Column: n.Column}
+	}
+	entry := func(n *yaml.Node) internal.EntryPositions {
+		return internal.EntryPositions{
+			Position:  at(n),
+			Members:   make(map[string]internal.Position),
+			Variables: make(map[string]internal.Position),
+		}
+	}
+	members := func(e internal.EntryPositions, list *yaml.Node) {
+		for _, m := range list.Content {
+			username := m.Value
+			eachPair(m, func(key, value *yaml.Node) {
+				if key.Value == "username" {
+					username = value.Value
+				}
+			})
+			if _, ok := e.Members[username]; !ok {
+				e.Members[username] = at(m)
+			}
+		}
+	}
+
+	eachPair(root, func(section, value *yaml.Node) {
+		p.Sections[section.Value] = at(section)
+
+		switch section.Value {
+		case "groups", "projects":
+			entries := p.Groups
+			if section.Value == "projects" {
+				entries = p.Projects
+			}
+			eachPair(value, func(name, acls *yaml.Node) {
+				e := entry(name)
+				eachPair(acls, func(key, value *yaml.Node) {
+					switch key.Value {
+					case "guests", "reporters", "developers", "maintainers", "owners":
+						members(e, value)
+					case "secret_variables":
+						eachPair(value, func(variable, _ *yaml.Node) {
+							e.Variables[variable.Value] = at(variable)
+						})
+					}
+				})
+				entries[name.Value] = e
+			})
+
+		case "teams":
+			eachPair(value, func(name, list *yaml.Node) {
+				e := entry(name)
+				members(e, list)
+				p.Teams[name.Value] = e
+			})
+		}
+	})
+	return p
+}
+
+// eachPair calls f with every key and value of a mapping node
+func eachPair(n *yaml.Node, f func(key, value *yaml.Node)) {
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		f(n.Content[i], n.Content[i+1])
+	}
+}
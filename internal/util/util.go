@@ -2,15 +2,18 @@ package util
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/errors"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -59,27 +62,265 @@ func LoadConfig(filename string, checksumCheck bool) (internal.Config, error) {
 	if err != nil {
 		return c, err
 	}
-	mergeConfigs(&c, cc)
-
 	c.Files = cc.Files
-	for _, f := range c.Files {
-		cc, err := loadFile(f, checksumCheck)
+
+	c.MergeStrategy = cc.MergeStrategy
+	switch c.MergeStrategy {
+	case "", internal.StrictMergeStrategy, internal.DeepMergeStrategy:
+	default:
+		return c, fmt.Errorf("invalid merge strategy '%s', use %s or %s", c.MergeStrategy,
+			internal.StrictMergeStrategy, internal.DeepMergeStrategy)
+	}
+
+	errs := errors.New()
+	l := configLoader{
+		checksumCheck: checksumCheck,
+		loaded:        make(map[string]bool),
+		errs:          &errs,
+	}
+	if err := l.include(&c, filename, cc, []string{filename}, nil); err != nil {
+		return c, err
+	}
+	if err := errs.ErrorOrNil(); err != nil {
+		return c, fmt.Errorf("failed to merge configuration files: %s", err)
+	}
+
+	return c, nil
+}
+
+// configLoader loads the files included by a configuration file, depth first
+type configLoader struct {
+	checksumCheck bool
+	loaded        map[string]bool
+	errs          *errors.Errors
+}
+
+// include merges the configuration loaded from filename and then the files it
+// includes, in order. The chain holds the files that included this one, to
+// detect cycles, and the allowances the restrictions of the files entries that
+// led to this one. A file that is included more than once is only loaded once.
+func (l configLoader) include(c *internal.Config, filename string, cc internal.Config, chain []string,
+	allowances []internal.File) error {
+	if len(chain) > 1 && cc.MergeStrategy != "" {
+		return fmt.Errorf("merge_strategy in %s can only be set in the main configuration file", filename)
+	}
+	if err := checkAllowances(c, filename, cc, allowances); err != nil {
+		return err
+	}
+	mergeConfigs(c, cc, filename, l.errs)
+	l.loaded[absPath(filename)] = true
+
+	for _, include := range cc.Files {
+		files, err := resolveInclude(filename, include.Path)
 		if err != nil {
-			return c, fmt.Errorf("failed to load file %s: %s", f, err)
+			return err
 		}
 
-		mergeConfigs(&c, cc)
+		includeAllowances := allowances
+		if include.Restricted() {
+			includeAllowances = append(append([]internal.File{}, allowances...), include)
+		}
+
+		for _, f := range files {
+			for i, included := range chain {
+				if absPath(included) == absPath(f) {
+					cycle := append(append([]string{}, chain[i:]...), f)
+					return fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+				}
+			}
+			if l.loaded[absPath(f)] {
+				logrus.Debugf("file %s is already included, skipping it", f)
+				continue
+			}
+
+			icc, err := loadFile(f, l.checksumCheck)
+			if err != nil {
+				return fmt.Errorf("failed to load file %s: %s", f, err)
+			}
+			if err := l.include(c, f, icc, append(chain, f), includeAllowances); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkAllowances fails when the configuration loaded from filename defines
+// a section, a path or a secret variable source that any of the allowances
+// doesn't include. Restricted files can't extend the teams defined by other
+// files either.
+func checkAllowances(c *internal.Config, filename string, cc internal.Config, allowances []internal.File) error {
+	if len(allowances) == 0 {
+		return nil
 	}
 
-	return c, nil
+	sections := make([]string, 0)
+	if len(cc.Groups) > 0 {
+		sections = append(sections, "groups")
+	}
+	if len(cc.Projects) > 0 {
+		sections = append(sections, "projects")
+	}
+	if len(cc.Teams) > 0 {
+		sections = append(sections, "teams")
+	}
+	if len(cc.Users.Admins)+len(cc.Users.Blocked) > 0 {
+		sections = append(sections, "users")
+	}
+	if len(cc.Bots) > 0 {
+		sections = append(sections, "bots")
+	}
+	if len(cc.Files) > 0 {
+		sections = append(sections, "files")
+	}
+
+	errs := errors.New()
+	for _, allowance := range allowances {
+		for _, section := range sections {
+			if !allowance.Allows(section) {
+				errs.Append(cc.Positions.Sections[section].Errorf("can't define %s, %s is only allowed %s", section,
+					filename, strings.Join(allowance.Sections, ", ")))
+			}
+		}
+		for _, path := range sortedKeys(cc.Groups) {
+			if !allowance.AllowsPath(path) {
+				errs.Append(cc.Positions.Groups[path].Errorf("can't define group '%s', %s is only allowed paths under %s",
+					path, filename, strings.Join(allowance.Paths, ", ")))
+			}
+			checkSecretSources(allowance, "group", path, filename, cc.Groups[path], cc.Positions.Groups[path], &errs)
+		}
+		for _, path := range sortedKeys(cc.Projects) {
+			if !allowance.AllowsPath(path) {
+				errs.Append(cc.Positions.Projects[path].Errorf("can't define project '%s', %s is only allowed paths under %s",
+					path, filename, strings.Join(allowance.Paths, ", ")))
+			}
+			checkSecretSources(allowance, "project", path, filename, cc.Projects[path], cc.Positions.Projects[path], &errs)
+		}
+	}
+	for name := range cc.Teams {
+		if origin, ok := c.Origins.Teams[name]; ok {
+			errs.Append(cc.Positions.Teams[name].Errorf("can't extend team '%s' defined in %s", name, origin))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// checkSecretSources fails for every secret variable read from a source the
+// allowance doesn't include, a restricted file could otherwise run commands or
+// read any file or environment variable, like the gitlab token
+func checkSecretSources(allowance internal.File, kind, path, filename string, acls internal.Acls,
+	positions internal.EntryPositions, errs *errors.Errors) {
+	for key, definitions := range acls.Variables {
+		for _, d := range definitions {
+			switch {
+			case len(allowance.SecretSources) == 0:
+				errs.Append(positions.Variable(key).Errorf("can't define secret '%s' of %s '%s', %s is not allowed secret variables",
+					key, kind, path, filename))
+			case !allowance.AllowsSecretSource(d.SourceType()):
+				errs.Append(positions.Variable(key).Errorf("can't read secret '%s' of %s '%s' from %s source, %s is only allowed %s sources",
+					key, kind, path, d.SourceType(), filename, strings.Join(allowance.SecretSources, ", ")))
+			}
+		}
+	}
+}
+
+func sortedKeys(m map[string]internal.Acls) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resolveInclude returns the files an include matches, relative to the
+// directory of the including file and in lexical order. Includes that match
+// nothing there are looked up relative to the working directory, as they used
+// to be.
+func resolveInclude(from, include string) ([]string, error) {
+	candidates := []string{include}
+	if !filepath.IsAbs(include) {
+		candidates = []string{filepath.Join(filepath.Dir(from), include), include}
+	}
+
+	for _, candidate := range candidates {
+		matches, err := filepath.Glob(candidate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include '%s' in %s: %s", include, from, err)
+		}
+		if len(matches) > 0 {
+			return matches, nil
+		}
+	}
+
+	if strings.ContainsAny(include, "*?[") {
+		return nil, fmt.Errorf("include '%s' in %s does not match any file", include, from)
+	}
+	return []string{candidates[0]}, nil
 }
 
-func mergeConfigs(c *internal.Config, cc internal.Config) {
+func absPath(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filename
+}
+
+// mergeConfigs adds the configuration cc, loaded from filename, to c. Groups,
+// projects and teams that are already defined are an error, unless the merge
+// strategy is deep.
+func mergeConfigs(c *internal.Config, cc internal.Config, filename string, errs *errors.Errors) {
+	deep := c.MergeStrategy == internal.DeepMergeStrategy
+
 	for k, v := range cc.Groups {
+		origin := filename
+		if previous, ok := c.Groups[k]; ok {
+			merged, err := mergeEntries("group", k, previous, v, c.Origins.Groups[k], filename,
+				cc.Positions.Groups[k], deep)
+			if err != nil {
+				errs.Append(err)
+				continue
+			}
+			v = merged
+			origin = c.Origins.Groups[k] + ", " + filename
+		}
 		c.Groups[k] = v
+		c.Origins.Groups = setOrigin(c.Origins.Groups, k, origin)
+		c.Positions.Groups = mergePositions(c.Positions.Groups, k, cc.Positions.Groups[k])
 	}
 	for k, v := range cc.Projects {
+		origin := filename
+		if previous, ok := c.Projects[k]; ok {
+			merged, err := mergeEntries("project", k, previous, v, c.Origins.Projects[k], filename,
+				cc.Positions.Projects[k], deep)
+			if err != nil {
+				errs.Append(err)
+				continue
+			}
+			v = merged
+			origin = c.Origins.Projects[k] + ", " + filename
+		}
 		c.Projects[k] = v
+		c.Origins.Projects = setOrigin(c.Origins.Projects, k, origin)
+		c.Positions.Projects = mergePositions(c.Positions.Projects, k, cc.Positions.Projects[k])
+	}
+	for k, v := range cc.Teams {
+		origin := filename
+		if c.Teams == nil {
+			c.Teams = make(map[string][]internal.Member)
+		}
+		if previous, ok := c.Teams[k]; ok {
+			if !deep {
+				errs.Append(cc.Positions.Teams[k].Errorf("team '%s' is defined in both %s and %s", k,
+					c.Origins.Teams[k], filename))
+				continue
+			}
+			v = joinMembers(previous, v)
+			origin = c.Origins.Teams[k] + ", " + filename
+		}
+		c.Teams[k] = v
+		c.Origins.Teams = setOrigin(c.Origins.Teams, k, origin)
+		c.Positions.Teams = mergePositions(c.Positions.Teams, k, cc.Positions.Teams[k])
 	}
 
 	for _, u := range cc.Users.Admins {
@@ -93,6 +334,91 @@ func mergeConfigs(c *internal.Config, cc internal.Config) {
 	}
 }
 
+// mergeEntries merges two definitions of the same group or project, joining
+// the members of every level, the highest level wins when the state is built.
+// Both definitions must have the same mode and can't define the same
+// variable.
+func mergeEntries(kind, name string, a, b internal.Acls, fileA, fileB string, at internal.EntryPositions,
+	deep bool) (internal.Acls, error) {
+	if !deep {
+		return a, at.Errorf("%s '%s' is defined in both %s and %s", kind, name, fileA, fileB)
+	}
+
+	fail := func(p internal.Position, format string, args ...interface{}) (internal.Acls, error) {
+		return a, p.Errorf("can't merge %s '%s' from %s and %s: %s", kind, name, fileA, fileB,
+			fmt.Sprintf(format, args...))
+	}
+
+	merged := internal.Acls{
+		Mode:           a.Mode,
+		PruneVariables: a.PruneVariables || b.PruneVariables,
+		Guests:         joinMembers(a.Guests, b.Guests),
+		Reporters:      joinMembers(a.Reporters, b.Reporters),
+		Developers:     joinMembers(a.Developers, b.Developers),
+		Maintainers:    joinMembers(a.Maintainers, b.Maintainers),
+		Owners:         joinMembers(a.Owners, b.Owners),
+	}
+	if merged.Mode == "" {
+		merged.Mode = b.Mode
+	} else if b.Mode != "" && b.Mode != a.Mode {
+		return fail(at.Position, "the modes '%s' and '%s' differ", a.Mode, b.Mode)
+	}
+
+	if len(a.Variables)+len(b.Variables) > 0 {
+		merged.Variables = make(map[string]internal.VariableDefinitions, len(a.Variables)+len(b.Variables))
+		for k, v := range a.Variables {
+			merged.Variables[k] = v
+		}
+		for k, v := range b.Variables {
+			if _, ok := merged.Variables[k]; ok {
+				return fail(at.Variable(k), "the secret variable '%s' is defined in both", k)
+			}
+			merged.Variables[k] = v
+		}
+	}
+	return merged, nil
+}
+
+func joinMembers(a, b []internal.Member) []internal.Member {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+	return append(append(make([]internal.Member, 0, len(a)+len(b)), a...), b...)
+}
+
+// mergePositions keeps the position of the first definition of an entry, and
+// of each of its members and secret variables
+func mergePositions(positions map[string]internal.EntryPositions, name string,
+	p internal.EntryPositions) map[string]internal.EntryPositions {
+	if positions == nil {
+		positions = make(map[string]internal.EntryPositions)
+	}
+	previous, ok := positions[name]
+	if !ok {
+		positions[name] = p
+		return positions
+	}
+	for member, position := range p.Members {
+		if _, ok := previous.Members[member]; !ok {
+			previous.Members[member] = position
+		}
+	}
+	for variable, position := range p.Variables {
+		if _, ok := previous.Variables[variable]; !ok {
+			previous.Variables[variable] = position
+		}
+	}
+	return positions
+}
+
+func setOrigin(origins map[string]string, name, filename string) map[string]string {
+	if origins == nil {
+		origins = make(map[string]string)
+	}
+	origins[name] = filename
+	return origins
+}
+
 func loadFile(filename string, checksumCheck bool) (internal.Config, error) {
 	c := internal.Config{}
 
@@ -116,13 +442,52 @@ func loadFile(filename string, checksumCheck bool) (internal.Config, error) {
 		logrus.Info("configuration md5 sum validated correctly")
 	}
 
-	if err := yaml.UnmarshalStrict(content, &c); err != nil {
+	c, err = decodeConfig(filename, content)
+	if err != nil {
 		return c, fmt.Errorf("failed to unmarshal state file %s: %s", filename, err)
 	}
 
 	return c, nil
 }
 
+// ConfigFingerprint calculates a hash of the merged configuration, it does
+// not change with formatting, comments or the order of map keys
+func ConfigFingerprint(c internal.Config) (string, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal configuration: %s", err)
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// IsPathPattern returns true when a group or project key is a pattern
+func IsPathPattern(key string) bool {
+	return strings.Contains(key, "*")
+}
+
+// CompilePathPattern turns a path pattern into a regular expression, "*"
+// matches anything but "/", and "**" matches anything
+func CompilePathPattern(pattern string) *regexp.Regexp {
+	b := &strings.Builder{}
+	b.WriteString("^")
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			i++
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
 // ValidateBots validates bots, duh
 func ValidateBots(bots []internal.Bot, usernameRegex string) error {
 	r, err := regexp.Compile(usernameRegex)
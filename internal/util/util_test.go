@@ -17,12 +17,12 @@ func TestLoadingValidMD5Check(t *testing.T) {
 	a.EqualValues(internal.Config{
 		Groups: map[string]internal.Acls{
 			"yakshavers": {
-				Owners: []string{"root"},
+				Owners: []internal.Member{{Username: "root"}},
 			},
 		},
 		Projects: map[string]internal.Acls{
 			"someproject": {
-				Owners: []string{"root"},
+				Owners: []internal.Member{{Username: "root"}},
 			},
 		},
 		Users: internal.Users{
@@ -35,6 +35,30 @@ func TestLoadingValidMD5Check(t *testing.T) {
 				Email:    "bot@bot.com",
 			},
 		},
+		Origins: internal.Origins{
+			Groups:   map[string]string{"yakshavers": "fixtures/config-sample.yml"},
+			Projects: map[string]string{"someproject": "fixtures/config-sample.yml"},
+		},
+		Positions: internal.Positions{
+			Groups: map[string]internal.EntryPositions{
+				"yakshavers": {
+					Position: internal.Position{File: "fixtures/config-sample.yml", Line: 7, Column: 3},
+					Members: map[string]internal.Position{
+						"root": {File: "fixtures/config-sample.yml", Line: 9, Column: 7},
+					},
+					Variables: map[string]internal.Position{},
+				},
+			},
+			Projects: map[string]internal.EntryPositions{
+				"someproject": {
+					Position: internal.Position{File: "fixtures/config-sample.yml", Line: 12, Column: 3},
+					Members: map[string]internal.Position{
+						"root": {File: "fixtures/config-sample.yml", Line: 14, Column: 7},
+					},
+					Variables: map[string]internal.Position{},
+				},
+			},
+		},
 	}, c)
 }
 
@@ -43,31 +67,41 @@ func TestLoadingMultifileConfig(t *testing.T) {
 	c, err := util.LoadConfig("fixtures/multifile-config.yml", true)
 
 	a.NoError(err)
+	a.Equal("fixtures/multifile-config.yml:6:3", c.Positions.Projects["myproject"].String())
+	a.Equal("fixtures/config-sample.yml:14:7", c.Positions.Projects["someproject"].Member("root").String())
+	c.Positions = internal.Positions{}
 	a.EqualValues(internal.Config{
 		Groups: map[string]internal.Acls{
 			"yakshavers": {
-				Owners: []string{"root"},
+				Owners: []internal.Member{{Username: "root"}},
 			},
 		},
 		Projects: map[string]internal.Acls{
 			"myproject": {
-				Owners: []string{"me"},
+				Owners: []internal.Member{{Username: "me"}},
 			},
 			"someproject": {
-				Owners: []string{"root"},
+				Owners: []internal.Member{{Username: "root"}},
 			},
 		},
 		Users: internal.Users{
 			Admins:  []string{"root"},
 			Blocked: []string{"bad_actor"},
 		},
-		Files: []string{"fixtures/config-sample.yml"},
+		Files: []internal.File{{Path: "fixtures/config-sample.yml"}},
 		Bots: []internal.Bot{
 			internal.Bot{
 				Username: "bot_one",
 				Email:    "bot@bot.com",
 			},
 		},
+		Origins: internal.Origins{
+			Groups: map[string]string{"yakshavers": "fixtures/config-sample.yml"},
+			Projects: map[string]string{
+				"myproject":   "fixtures/multifile-config.yml",
+				"someproject": "fixtures/config-sample.yml",
+			},
+		},
 	}, c)
 }
 
@@ -79,6 +113,49 @@ func TestLoadingInvalidConfig(t *testing.T) {
 		"  line 3: field not-valid-key not found in type internal.Config")
 }
 
+func TestLoadingExpiringMembers(t *testing.T) {
+	a := assert.New(t)
+	c, err := util.LoadConfig("fixtures/expiring-members-config.yml", false)
+
+	a.NoError(err)
+	a.EqualValues(map[string]internal.Acls{
+		"yakshavers": {
+			Owners: []internal.Member{{Username: "root"}},
+			Developers: []internal.Member{
+				{Username: "contractor_1", Expires: "2026-12-31"},
+			},
+		},
+	}, c.Groups)
+
+	_, err = util.LoadConfig("fixtures/invalid-expiration-config.yml", false)
+	a.EqualError(err, "failed to unmarshal state file fixtures/invalid-expiration-config.yml: "+
+		"invalid expiration date 'next tuesday' for member 'root', use YYYY-MM-DD")
+}
+
+func TestLoadingVariableDefinitions(t *testing.T) {
+	a := assert.New(t)
+	c, err := util.LoadConfig("fixtures/variables-config.yml", false)
+
+	a.NoError(err)
+	enabled := true
+	a.EqualValues(map[string]internal.VariableDefinitions{
+		"PLAIN": {
+			{Source: "PLAIN_SOURCE"},
+		},
+		"PROTECTED": {
+			{Source: "PROTECTED_SOURCE", Protected: &enabled, Masked: &enabled},
+		},
+		"SCOPED": {
+			{Source: "SCOPED_SOURCE"},
+			{Source: "SCOPED_PRODUCTION_SOURCE", VariableType: "file", EnvironmentScope: "production"},
+		},
+	}, c.Groups["yakshavers"].Variables)
+
+	_, err = util.LoadConfig("fixtures/invalid-variable-type-config.yml", false)
+	a.EqualError(err, "failed to unmarshal state file fixtures/invalid-variable-type-config.yml: "+
+		"invalid variable type 'directory' for source 'SOURCE', use env_var or file")
+}
+
 func TestLoadingNonExistingConfig(t *testing.T) {
 	a := assert.New(t)
 	_, err := util.LoadConfig("fixtures/non-existing-config.yml", true)
@@ -111,6 +188,24 @@ func TestLoadingInvalidMD5Check(t *testing.T) {
 		"does not match the provided md5 ' 671cc46a43b1632047ba2677a51f8b5a'")
 }
 
+func TestConfigFingerprint(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := util.LoadConfig("fixtures/config-sample.yml", false)
+	a.NoError(err)
+
+	f1, err := util.ConfigFingerprint(c)
+	a.NoError(err)
+	f2, err := util.ConfigFingerprint(c)
+	a.NoError(err)
+	a.Equal(f1, f2)
+
+	c.Users.Admins = append(c.Users.Admins, "someone_else")
+	f3, err := util.ConfigFingerprint(c)
+	a.NoError(err)
+	a.NotEqual(f1, f3)
+}
+
 func TestToStringSlice(t *testing.T) {
 	s := util.ToStringSlice(map[string]int{
 		"a": 0,
@@ -148,3 +243,200 @@ func TestBotUsernames(t *testing.T) {
 		{Username: "bot1", Email: ""},
 	}, "^bot.+$"), "bot bot1 has an empty email")
 }
+
+func TestPathPatterns(t *testing.T) {
+	a := assert.New(t)
+
+	a.False(util.IsPathPattern("platform/service"))
+	a.True(util.IsPathPattern("platform/*"))
+
+	single := util.CompilePathPattern("platform/service-*")
+	a.True(single.MatchString("platform/service-a"))
+	a.False(single.MatchString("platform/service-a/nested"))
+	a.False(single.MatchString("other/platform/service-a"))
+
+	double := util.CompilePathPattern("platform/**")
+	a.True(double.MatchString("platform/service-a"))
+	a.True(double.MatchString("platform/service-a/nested"))
+	a.False(double.MatchString("platform"))
+
+	literal := util.CompilePathPattern("team.a/*")
+	a.True(literal.MatchString("team.a/x"))
+	a.False(literal.MatchString("teamXa/x"))
+}
+
+func TestLoadingRecursiveIncludes(t *testing.T) {
+	a := assert.New(t)
+	c, err := util.LoadConfig("fixtures/includes/root.yml", false)
+
+	a.NoError(err)
+	a.Equal("fixtures/includes/teams/b.yml:6:5", c.Positions.Teams["team-b"].Member("bob").String())
+	c.Positions = internal.Positions{}
+	a.EqualValues(internal.Config{
+		Groups: map[string]internal.Acls{
+			"root": {
+				Owners: []internal.Member{{Username: "root"}},
+			},
+			"team-a": {
+				Owners: []internal.Member{{Username: "alice"}},
+			},
+		},
+		Projects: map[string]internal.Acls{
+			"team-a/service": {
+				Developers: []internal.Member{{Username: "alice"}},
+			},
+		},
+		Teams: map[string][]internal.Member{
+			"team-b": {{Username: "bob"}},
+		},
+		Users: internal.Users{
+			Admins:  []string{"root"},
+			Blocked: []string{},
+		},
+		Files: []internal.File{{Path: "teams/*.yml"}, {Path: "shared.yml"}},
+		Bots:  []internal.Bot{},
+		Origins: internal.Origins{
+			Groups: map[string]string{
+				"root":   "fixtures/includes/root.yml",
+				"team-a": "fixtures/includes/teams/a.yml",
+			},
+			Projects: map[string]string{"team-a/service": "fixtures/includes/nested/extra.yml"},
+			Teams:    map[string]string{"team-b": "fixtures/includes/teams/b.yml"},
+		},
+	}, c, "files are loaded once, relative to the file that includes them")
+}
+
+func TestLoadingIncludeCycleFails(t *testing.T) {
+	a := assert.New(t)
+	_, err := util.LoadConfig("fixtures/cycle/a.yml", false)
+
+	a.EqualError(err, "include cycle: fixtures/cycle/a.yml -> fixtures/cycle/b.yml -> fixtures/cycle/a.yml")
+}
+
+func TestLoadingIncludeWithoutMatchesFails(t *testing.T) {
+	a := assert.New(t)
+	_, err := util.LoadConfig("fixtures/includes-missing.yml", false)
+
+	a.EqualError(err, "include 'nothing/*.yml' in fixtures/includes-missing.yml does not match any file")
+}
+
+func TestLoadingDuplicatedDefinitionsFails(t *testing.T) {
+	a := assert.New(t)
+	_, err := util.LoadConfig("fixtures/merge/base.yml", false)
+
+	a.EqualError(err, "failed to merge configuration files: 3 errors: "+
+		"fixtures/merge/other.yml:3:3: group 'backend' is defined in both fixtures/merge/base.yml and fixtures/merge/other.yml; "+
+		"fixtures/merge/other.yml:10:3: project 'backend/api' is defined in both fixtures/merge/base.yml and fixtures/merge/other.yml; "+
+		"fixtures/merge/other.yml:15:3: team 'sre' is defined in both fixtures/merge/base.yml and fixtures/merge/other.yml")
+}
+
+func TestLoadingWithDeepMergeStrategy(t *testing.T) {
+	a := assert.New(t)
+	c, err := util.LoadConfig("fixtures/merge/deep.yml", false)
+
+	a.NoError(err)
+	a.Equal(internal.DeepMergeStrategy, c.MergeStrategy)
+	a.EqualValues(map[string]internal.Acls{
+		"backend": {
+			Mode:        internal.AdditiveMode,
+			Developers:  []internal.Member{{Username: "alice"}, {Username: "bob"}},
+			Maintainers: []internal.Member{{Username: "alice"}},
+			Owners:      []internal.Member{{Username: "root"}},
+		},
+	}, c.Groups, "levels are joined, the mode is taken from the file that sets it")
+	a.EqualValues(map[string]internal.Acls{
+		"backend/api": {
+			PruneVariables: true,
+			Developers:     []internal.Member{{Username: "alice"}},
+			Maintainers:    []internal.Member{{Username: "bob"}},
+		},
+	}, c.Projects)
+	a.EqualValues(map[string][]internal.Member{
+		"sre": {{Username: "alice"}, {Username: "bob"}},
+	}, c.Teams)
+	a.Equal("fixtures/merge/base.yml, fixtures/merge/other.yml", c.Origins.Groups["backend"])
+	a.Equal("fixtures/merge/base.yml, fixtures/merge/other.yml", c.Origins.Teams["sre"])
+}
+
+func TestLoadingWithDeepMergeConflictsFails(t *testing.T) {
+	a := assert.New(t)
+	_, err := util.LoadConfig("fixtures/merge/conflicts.yml", false)
+
+	a.EqualError(err, "failed to merge configuration files: 2 errors: "+
+		"fixtures/merge/conflicting.yml:3:3: can't merge group 'backend' from fixtures/merge/conflicts.yml and "+
+		"fixtures/merge/conflicting.yml: the modes 'authoritative' and 'additive' differ; "+
+		"fixtures/merge/conflicting.yml:8:7: can't merge project 'backend/api' from fixtures/merge/conflicts.yml and "+
+		"fixtures/merge/conflicting.yml: the secret variable 'TOKEN' is defined in both")
+}
+
+func TestLoadingInvalidMergeStrategyFails(t *testing.T) {
+	a := assert.New(t)
+	_, err := util.LoadConfig("fixtures/merge/invalid-strategy.yml", false)
+	a.EqualError(err, "invalid merge strategy 'shallow', use strict or deep")
+
+	_, err = util.LoadConfig("fixtures/merge/nested-strategy.yml", false)
+	a.EqualError(err, "merge_strategy in fixtures/merge/deep.yml can only be set in the main configuration file")
+}
+
+func TestLoadingRestrictedIncludes(t *testing.T) {
+	a := assert.New(t)
+	c, err := util.LoadConfig("fixtures/delegated/root.yml", false)
+
+	a.NoError(err)
+	a.Equal([]internal.File{
+		{Path: "teams/backend.yml", Paths: []string{"backend"}, Sections: []string{"groups", "projects"},
+			SecretSources: []string{"age"}},
+		{Path: "teams/sre.yml", Paths: []string{"sre/"}, Sections: []string{"groups", "teams"}},
+	}, c.Files, "files with paths and without sections are allowed groups and projects")
+	a.Equal(map[string]string{
+		"backend":   "fixtures/delegated/teams/backend.yml",
+		"root":      "fixtures/delegated/root.yml",
+		"sre/tools": "fixtures/delegated/teams/sre.yml",
+	}, c.Origins.Groups)
+	a.Equal(map[string]string{"backend/*": "fixtures/delegated/teams/backend.yml"}, c.Origins.Projects)
+	a.Equal(map[string]string{
+		"oncall": "fixtures/delegated/root.yml",
+		"sre":    "fixtures/delegated/teams/sre.yml",
+	}, c.Origins.Teams)
+}
+
+func TestLoadingRestrictedIncludesOutOfTheirAllowanceFails(t *testing.T) {
+	a := assert.New(t)
+	_, err := util.LoadConfig("fixtures/delegated/violating.yml", false)
+
+	a.EqualError(err, "7 errors: "+
+		"fixtures/delegated/teams/rogue.yml:2:1: can't define files, "+
+		"fixtures/delegated/teams/rogue.yml is only allowed groups, projects; "+
+		"fixtures/delegated/teams/rogue.yml:4:1: can't define users, "+
+		"fixtures/delegated/teams/rogue.yml is only allowed groups, projects; "+
+		"fixtures/delegated/teams/rogue.yml:8:3: can't define group 'backend-legacy', "+
+		"fixtures/delegated/teams/rogue.yml is only allowed paths under backend; "+
+		"fixtures/delegated/teams/rogue.yml:11:1: can't define teams, "+
+		"fixtures/delegated/teams/rogue.yml is only allowed groups, projects; "+
+		"fixtures/delegated/teams/rogue.yml:12:3: can't extend team 'oncall' defined in fixtures/delegated/violating.yml; "+
+		"fixtures/delegated/teams/rogue.yml:17:7: can't define secret 'TOKEN' of project 'backend/api', "+
+		"fixtures/delegated/teams/rogue.yml is not allowed secret variables; "+
+		"fixtures/delegated/teams/rogue.yml:18:7: can't define secret 'DEPLOY_KEY' of project 'backend/api', "+
+		"fixtures/delegated/teams/rogue.yml is not allowed secret variables")
+
+	_, err = util.LoadConfig("fixtures/delegated/secret-sources.yml", false)
+	a.EqualError(err, "2 errors: "+
+		"fixtures/delegated/teams/rogue-secrets.yml:7:7: can't read secret 'TOKEN' of group 'backend' from env source, "+
+		"fixtures/delegated/teams/rogue-secrets.yml is only allowed age, file sources; "+
+		"fixtures/delegated/teams/rogue-secrets.yml:8:7: can't read secret 'DEPLOY_KEY' of group 'backend' from exec source, "+
+		"fixtures/delegated/teams/rogue-secrets.yml is only allowed age, file sources",
+		"restricted files can only read secrets from the sources they are allowed")
+
+	_, err = util.LoadConfig("fixtures/delegated/nested.yml", false)
+	a.EqualError(err, "1 error: fixtures/delegated/teams/platform.yml:3:3: can't define group 'platform', "+
+		"fixtures/delegated/teams/platform.yml is only allowed paths under backend",
+		"restrictions apply to the files included by a restricted file")
+
+	_, err = util.LoadConfig("fixtures/delegated/invalid-section.yml", false)
+	a.EqualError(err, "failed to unmarshal state file fixtures/delegated/invalid-section.yml: "+
+		"invalid section 'secret_variables' for file 'teams/backend.yml', use one of groups, projects, teams, users, bots, files")
+
+	_, err = util.LoadConfig("fixtures/delegated/invalid-secret-source.yml", false)
+	a.EqualError(err, "failed to unmarshal state file fixtures/delegated/invalid-secret-source.yml: "+
+		"invalid secret source 'vault' for file 'teams/backend.yml', use one of env, file, exec, age")
+}
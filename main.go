@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
 	"strings"
 
 	"gitlab.com/yakshaving.art/hurrdurr/internal"
 	"gitlab.com/yakshaving.art/hurrdurr/internal/api"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/secrets"
 	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
 	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
 
@@ -16,6 +21,27 @@ func main() {
 		DisableTimestamp: true,
 	})
 
+	if len(os.Args) > 1 && os.Args[1] == "restore-variables" {
+		restoreVariables(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		evaluateQuery(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		explainMemberships(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validateConfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		printSchema()
+		return
+	}
+
 	args := parseArgs()
 
 	SetupLogger(args.Debug, args.Trace)
@@ -69,7 +95,8 @@ func main() {
 		logrus.Infof("done loading full state from gitlab")
 	}
 
-	desiredState, err := state.LoadStateFromFile(conf, client.Querier)
+	resolver := secrets.NewResolver(args.AgeIdentityFile, args.AllowExecSecrets)
+	desiredState, err := state.LoadStateFromFile(conf, client.Querier, resolver)
 	logrus.Infof("loading desired state from file %s", args.ConfigFile)
 	if err != nil {
 		logrus.Fatalf("failed to load desired state from file %s: %s", args.ConfigFile, err)
@@ -77,23 +104,81 @@ func main() {
 
 	logrus.Infof("done loading desired state from file %s", args.ConfigFile)
 
-	actions, err := state.Diff(currentState, desiredState, state.DiffArgs{
-		DiffGroups:   args.ManageACLs,
-		DiffProjects: args.ManageACLs,
-		DiffUsers:    args.ManageUsers,
-		DiffBots:     args.ManageBots,
+	if args.VariablesReport {
+		printVariablesReport(args, currentState, desiredState)
+		return
+	}
 
-		Yolo: args.YoloMode,
-	})
-	if err != nil {
-		logrus.Fatalf("failed to diff current and desired state: %s", err)
+	var actions []internal.Action
+	if args.ApplyPlan != "" {
+		actions = loadPlannedActions(args.ApplyPlan, conf, currentState, desiredState)
+		logrus.Debugf("plan loaded from file %s", args.ApplyPlan)
+
+	} else {
+		actions, err = state.Diff(currentState, desiredState, state.DiffArgs{
+			DiffGroups:   args.ManageACLs,
+			DiffProjects: args.ManageACLs,
+			DiffUsers:    args.ManageUsers,
+			DiffBots:     args.ManageBots,
+
+			Yolo:           args.YoloMode,
+			PruneVariables: args.PruneVariables,
+		})
+		if err != nil {
+			logrus.Fatalf("failed to diff current and desired state: %s", err)
+		}
+
+		logrus.Debugf("diff calculated")
+	}
+
+	if err := state.CheckBlastRadius(currentState, actions, state.BlastRadius{
+		MaxRemovals:       args.MaxRemovals,
+		MaxRemovalPercent: args.MaxRemovalPercent,
+	}); err != nil {
+		switch {
+		case args.OverrideBlastRadius:
+			logrus.Warnf("%s\nblast radius limits overridden, carrying on", err)
+		case args.DryRun:
+			logrus.Warnf("%s\nthis plan will be refused unless -override-blast-radius is set", err)
+		default:
+			logrus.Fatalf("%s\nrefusing to apply, use -override-blast-radius if this is intended", err)
+		}
 	}
 
-	logrus.Debugf("diff calculated")
+	if args.PlanFile != "" || args.PlanFormat != "text" {
+		plan := buildPlan(actions, conf, currentState, desiredState)
+
+		if args.PlanFile != "" {
+			format := args.PlanFormat
+			if format == "text" {
+				format = "json"
+			}
+			if err := plan.Save(args.PlanFile, format); err != nil {
+				logrus.Fatalf("failed to save plan: %s", err)
+			}
+			logrus.Infof("plan with %d changes saved to %s", len(plan.Changes), args.PlanFile)
+		}
+
+		if args.PlanFormat != "text" {
+			b, err := plan.Marshal(args.PlanFormat)
+			if err != nil {
+				logrus.Fatalf("failed to serialize plan: %s", err)
+			}
+			fmt.Fprintln(os.Stdout, string(b))
+			return
+		}
+	}
 
 	var actionClient internal.APIClient
 
 	if args.DryRun {
+		if matches := state.MatchedPatterns(desiredState); len(matches) > 0 {
+			logrus.Print("groups and projects matched by patterns:")
+			for _, m := range matches {
+				logrus.Printf("  %s", m)
+			}
+		}
+
 		logrus.Println("changes proposed [dryrun]:")
 		actionClient = api.DryRunAPIClient{
 			Append: func(change string) {
@@ -101,6 +186,8 @@ func main() {
 			},
 		}
 	} else {
+		backupVariables(args, currentState, actions)
+
 		logrus.Print("executing changes:")
 		actionClient = client
 	}
@@ -116,6 +203,13 @@ func main() {
 
 	logrus.Debugf("all actions executed")
 
+	if unmanaged := state.UnmanagedMembers(currentState, desiredState); len(unmanaged) > 0 {
+		logrus.Print("unmanaged members kept by additive groups and projects:")
+		for _, u := range unmanaged {
+			logrus.Printf("  %s", u)
+		}
+	}
+
 	if len(desiredState.UnhandledGroups()) > 0 {
 		logrus.Print("unhandled groups detected:")
 		for _, ug := range desiredState.UnhandledGroups() {
@@ -127,3 +221,101 @@ func main() {
 
 	logrus.Infof("done")
 }
+
+func buildPlan(actions []internal.Action, conf internal.Config, current, desired internal.State) state.Plan {
+	plan, err := state.NewPlan(actions)
+	if err != nil {
+		logrus.Fatalf("failed to build plan: %s", err)
+	}
+
+	plan.ConfigFingerprint, err = util.ConfigFingerprint(conf)
+	if err != nil {
+		logrus.Fatalf("failed to fingerprint configuration: %s", err)
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		logrus.Fatalf("failed to generate plan salt: %s", err)
+	}
+	plan.Salt = hex.EncodeToString(salt)
+	plan.StateFingerprint = state.Fingerprint(current, desired, salt)
+
+	return plan
+}
+
+func loadPlannedActions(filename string, conf internal.Config, current, desired internal.State) []internal.Action {
+	plan, err := state.LoadPlan(filename)
+	if err != nil {
+		logrus.Fatalf("failed to load plan: %s", err)
+	}
+
+	configFingerprint, err := util.ConfigFingerprint(conf)
+	if err != nil {
+		logrus.Fatalf("failed to fingerprint configuration: %s", err)
+	}
+	if plan.ConfigFingerprint != configFingerprint {
+		logrus.Fatalf("configuration changed since plan %s was created, refusing to apply it", filename)
+	}
+	salt, err := hex.DecodeString(plan.Salt)
+	if err != nil {
+		logrus.Fatalf("invalid salt in plan %s: %s", filename, err)
+	}
+	if plan.StateFingerprint != state.Fingerprint(current, desired, salt) {
+		logrus.Fatalf("gitlab state or secret values changed since plan %s was created, refusing to apply it", filename)
+	}
+
+	actions, err := plan.Actions(desired)
+	if err != nil {
+		logrus.Fatalf("failed to load actions from plan %s: %s", filename, err)
+	}
+	return actions
+}
+
+// backupVariables saves the current value of the variables the actions are
+// going to overwrite or delete, refusing to carry on if it can't or if there
+// is no backup recipient, unless backups are disabled
+func backupVariables(args Args, current internal.State, actions []internal.Action) {
+	snapshot := state.VariablesBackup(current, actions)
+	if len(snapshot.Variables) == 0 {
+		return
+	}
+
+	if args.BackupRecipient == "" {
+		if !args.NoBackup {
+			logrus.Fatalf("%d variables will be overwritten or deleted, refusing to apply without a backup: "+
+				"set -backup-recipient to keep one, or -no-backup if this is intended", len(snapshot.Variables))
+		}
+		logrus.Warnf("%d variables will be overwritten or deleted without a backup", len(snapshot.Variables))
+		return
+	}
+
+	filename, err := snapshot.Save(args.BackupDir, args.BackupRecipient)
+	if err != nil {
+		logrus.Fatalf("failed to backup variables, refusing to apply: %s", err)
+	}
+	logrus.Infof("backup of %d variables saved to %s", len(snapshot.Variables), filename)
+}
+
+// printVariablesReport prints the status of every managed variable using
+// salted fingerprints instead of the values
+func printVariablesReport(args Args, current, desired internal.State) {
+	salt := []byte(args.ReportSalt)
+	if len(salt) == 0 {
+		salt = make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			logrus.Fatalf("failed to generate report salt: %s", err)
+		}
+		logrus.Infof("HURRDURR_REPORT_SALT is not set, fingerprints can only be compared within this report")
+	}
+
+	reports := state.VariablesReport(current, desired, salt)
+
+	counts := make(map[string]int)
+	logrus.Print("variables report:")
+	for _, r := range reports {
+		counts[r.Status]++
+		logrus.Printf("  %s", r)
+	}
+	logrus.Printf("%d in-sync, %d drifted, %d missing, %d extra", counts[state.VariableInSync],
+		counts[state.VariableDrifted], counts[state.VariableMissing], counts[state.VariableExtra])
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/api"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// QueryArgs is used to load the flags and arguments of the query command
+type QueryArgs struct {
+	Query string
+	Level internal.Level
+
+	ConfigFile    string
+	ChecksumCheck bool
+	Format        string
+
+	GitlabToken   string
+	GitlabBaseURL string
+	GhostUser     string
+
+	AutoDevOpsMode bool
+	Concurrency    int
+	Debug          bool
+}
+
+func parseQueryArgs(arguments []string) QueryArgs {
+	args := QueryArgs{}
+
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	flags.Usage = func() {
+		logrus.Printf("usage: hurrdurr query [flags] 'developers in backend and not admins'")
+		flags.PrintDefaults()
+	}
+
+	var level string
+	flags.StringVar(&args.ConfigFile, "config", "config.yaml", "configuration file to load")
+	flags.BoolVar(&args.ChecksumCheck, "checksum-check", false, "validates the configuration checksum "+
+		"reading it from a file called as the configuratio file ended in .md5")
+	flags.StringVar(&level, "level", "developer", "level the query is assigned at")
+	flags.StringVar(&args.Format, "format", "text", "format used to print the result: text or json")
+	flags.StringVar(&args.GhostUser, "ghost-user", "ghost", "system wide gitlab ghost user.")
+	flags.BoolVar(&args.AutoDevOpsMode, "autodevopsmode", false,
+		"where you have no admin rights but still do what you gotta do")
+	flags.IntVar(&args.Concurrency, "concurrency", 50, "how many concurrent jobs we allow when pre-loading from Gitlab")
+	flags.BoolVar(&args.Debug, "debug", false, "executes with logging in debug mode")
+
+	flags.Parse(arguments)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		logrus.Fatal("query needs exactly one query, quote it")
+	}
+	args.Query = strings.TrimSpace(strings.TrimPrefix(flags.Arg(0), "query:"))
+
+	l, err := internal.ParseLevel(level)
+	if err != nil {
+		logrus.Fatalf("%s, use one of guest, reporter, developer, maintainer or owner", err)
+	}
+	args.Level = l
+
+	switch args.Format {
+	case "text", "json":
+	default:
+		logrus.Fatalf("invalid format '%s', use one of text or json", args.Format)
+	}
+
+	args.GitlabToken, args.GitlabBaseURL = parseGitlabEnvironment()
+
+	return args
+}
+
+// evaluateQuery prints the users a query returns with the level they get
+func evaluateQuery(arguments []string) {
+	args := parseQueryArgs(arguments)
+
+	SetupLogger(args.Debug, false)
+
+	conf, err := util.LoadConfig(args.ConfigFile, args.ChecksumCheck)
+	if err != nil {
+		logrus.Fatalf("failed to load configuration: %s", err)
+	}
+
+	client := api.NewGitlabAPIClient(
+		api.GitlabAPIClientArgs{
+			GitlabToken:     args.GitlabToken,
+			GitlabBaseURL:   args.GitlabBaseURL,
+			GitlabGhostUser: args.GhostUser,
+			Concurrency:     args.Concurrency,
+		})
+
+	createQuerier(&client, args.AutoDevOpsMode)
+
+	members, err := state.EvaluateQuery(conf, client.Querier, args.Query, args.Level)
+	if err != nil {
+		logrus.Fatalf("%s", err)
+	}
+
+	if args.Format == "json" {
+		b, err := json.MarshalIndent(members, "", "  ")
+		if err != nil {
+			logrus.Fatalf("failed to serialize query result: %s", err)
+		}
+		fmt.Fprintln(os.Stdout, string(b))
+		return
+	}
+
+	for _, m := range members {
+		fmt.Fprintf(os.Stdout, "%s %s\n", m.Username, m.Level)
+	}
+	logrus.Infof("%d users", len(members))
+}
+
+// createQuerier loads a lazy querier in autodevops mode, and a preloaded one
+// otherwise
+func createQuerier(client *api.GitlabAPIClient, autoDevOpsMode bool) {
+	if autoDevOpsMode {
+		if err := api.CreateLazyQuerier(client); err != nil {
+			logrus.Fatalf("failed to create lazy querier from gitlab instance: %s", err)
+		}
+		return
+	}
+	if err := api.CreatePreloadedQuerier(client); err != nil {
+		logrus.Fatalf("failed to preload querier from gitlab instance: %s", err)
+	}
+}
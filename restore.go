@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/api"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/backup"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/secrets"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RestoreArgs is used to load the flags and arguments of the restore-variables
+// command
+type RestoreArgs struct {
+	Snapshot     string
+	IdentityFile string
+
+	GitlabToken   string
+	GitlabBaseURL string
+
+	DryRun bool
+	Debug  bool
+}
+
+func parseRestoreArgs(arguments []string) RestoreArgs {
+	args := RestoreArgs{}
+
+	flags := flag.NewFlagSet("restore-variables", flag.ExitOnError)
+	flags.Usage = func() {
+		logrus.Printf("usage: hurrdurr restore-variables [flags] snapshot.age")
+		flags.PrintDefaults()
+	}
+
+	flags.BoolVar(&args.DryRun, "dryrun", false, "shows the changes to restore the snapshot without making them")
+	flags.BoolVar(&args.Debug, "debug", false, "executes with logging in debug mode")
+	flags.StringVar(&args.IdentityFile, "identity", os.Getenv(secrets.AgeIdentityFileVariable),
+		"age identity file used to decrypt the snapshot, defaults to "+secrets.AgeIdentityFileVariable)
+
+	flags.Parse(arguments)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		logrus.Fatal("restore-variables needs exactly one snapshot file")
+	}
+	args.Snapshot = flags.Arg(0)
+
+	args.GitlabToken, args.GitlabBaseURL = parseGitlabEnvironment()
+
+	return args
+}
+
+// restoreVariables puts back the variables saved in a backup snapshot
+func restoreVariables(arguments []string) {
+	args := parseRestoreArgs(arguments)
+
+	SetupLogger(args.Debug, false)
+
+	snapshot, err := backup.Load(args.Snapshot, args.IdentityFile)
+	if err != nil {
+		logrus.Fatalf("failed to load snapshot: %s", err)
+	}
+	logrus.Infof("loaded snapshot %s with %d variables taken at %s", args.Snapshot, len(snapshot.Variables),
+		snapshot.Created.UTC().Format("2006-01-02 15:04:05 MST"))
+
+	client := api.NewGitlabAPIClient(
+		api.GitlabAPIClientArgs{
+			GitlabToken:   args.GitlabToken,
+			GitlabBaseURL: args.GitlabBaseURL,
+			Concurrency:   1,
+		})
+
+	if err := api.CreateLazyQuerier(&client); err != nil {
+		logrus.Fatalf("failed to create lazy querier from gitlab instance: %s", err)
+	}
+
+	// Only the projects in the snapshot are loaded, groups are always loaded
+	conf := internal.Config{
+		Projects: make(map[string]internal.Acls),
+	}
+	for _, e := range snapshot.Variables {
+		if e.Project != "" {
+			conf.Projects[e.Project] = internal.Acls{}
+		}
+	}
+
+	currentState, err := api.LoadPartialGitlabState(conf, client)
+	if err != nil {
+		logrus.Fatalf("failed to load partial live state from gitlab instance: %s", err)
+	}
+
+	actions, err := state.RestoreVariables(currentState, snapshot)
+	if err != nil {
+		logrus.Fatalf("failed to restore snapshot: %s", err)
+	}
+
+	var actionClient internal.APIClient = client
+	if args.DryRun {
+		logrus.Println("changes proposed [dryrun]:")
+		actionClient = api.DryRunAPIClient{
+			Append: func(change string) {
+				logrus.Printf("  %s", change)
+			},
+		}
+	} else {
+		logrus.Print("executing changes:")
+	}
+
+	if len(actions) == 0 {
+		logrus.Print("  no changes necessary")
+	}
+	for _, action := range actions {
+		if err := action.Execute(actionClient); err != nil {
+			logrus.Fatalf("Failed to run action: %s", err)
+		}
+	}
+
+	logrus.Infof("done")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gitlab.com/yakshaving.art/hurrdurr/internal/schema"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/state"
+	"gitlab.com/yakshaving.art/hurrdurr/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ValidateArgs is used to load the flags of the validate command
+type ValidateArgs struct {
+	ConfigFile       string
+	ChecksumCheck    bool
+	BotUsernameRegex string
+	Debug            bool
+}
+
+func parseValidateArgs(arguments []string) ValidateArgs {
+	args := ValidateArgs{}
+
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Usage = func() {
+		logrus.Printf("usage: hurrdurr validate [flags]")
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&args.ConfigFile, "config", "config.yaml", "configuration file to load")
+	flags.BoolVar(&args.ChecksumCheck, "checksum-check", false, "validates the configuration checksum "+
+		"reading it from a file called as the configuratio file ended in .md5")
+	flags.StringVar(&args.BotUsernameRegex, "bot-username-regex", os.Getenv("BOT_USERNAME_REGEX"),
+		"regex bot usernames must match, defaults to BOT_USERNAME_REGEX")
+	flags.BoolVar(&args.Debug, "debug", false, "executes with logging in debug mode")
+
+	flags.Parse(arguments)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		logrus.Fatal("validate takes no arguments")
+	}
+
+	return args
+}
+
+// validateConfig runs every check of the configuration that doesn't need
+// GitLab, it doesn't need a token
+func validateConfig(arguments []string) {
+	args := parseValidateArgs(arguments)
+
+	SetupLogger(args.Debug, false)
+
+	conf, err := util.LoadConfig(args.ConfigFile, args.ChecksumCheck)
+	if err != nil {
+		logrus.Fatalf("failed to load configuration: %s", err)
+	}
+
+	if err := state.Validate(conf, args.BotUsernameRegex); err != nil {
+		logrus.Fatalf("invalid configuration: %s", err)
+	}
+
+	logrus.Infof("configuration %s is valid", args.ConfigFile)
+}
+
+// printSchema prints the JSON Schema of the configuration file
+func printSchema() {
+	b, err := schema.Generate()
+	if err != nil {
+		logrus.Fatalf("failed to generate the configuration schema: %s", err)
+	}
+	fmt.Fprint(os.Stdout, string(b))
+}